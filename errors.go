@@ -0,0 +1,97 @@
+package wal
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrClosed is returned when an operation is attempted on a closed WAL.
+var ErrClosed = errors.New("WAL is closed")
+
+// ErrReaderClosed is returned when reading from a closed Reader.
+var ErrReaderClosed = errors.New("reader is closed")
+
+// errCRCMismatch is returned when the CRC of an entry does not match its
+// contents.
+var errCRCMismatch = errors.New("CRC mismatch: data may be corrupted")
+
+// errMalformedRecord is returned when a record cannot be decoded, e.g. because
+// its size is invalid or its contents are not a valid entry.
+var errMalformedRecord = errors.New("malformed record")
+
+// ErrCorruptRecord matches every *CorruptRecordError with errors.Is.
+var ErrCorruptRecord = errors.New("corrupt record")
+
+// CorruptRecordError is returned when a record of a log segment cannot be read
+// back, either because it is incomplete (e.g. torn by a crash), because it
+// cannot be decoded, or because its contents do not match its CRC.
+type CorruptRecordError struct {
+	Segment int   // Index of the log segment containing the record.
+	Offset  int64 // Byte offset of the record in the segment file.
+	// Sequence number expected for the record, i.e. the one following the last
+	// valid record. Zero if unknown.
+	SequenceNo uint64
+	Err        error // Underlying error.
+}
+
+func (e *CorruptRecordError) Error() string {
+	return fmt.Sprintf("corrupt record in segment %d at offset %d (sequence number %d): %v",
+		e.Segment, e.Offset, e.SequenceNo, e.Err)
+}
+
+func (e *CorruptRecordError) Unwrap() error {
+	return e.Err
+}
+
+// Is reports whether target is ErrCorruptRecord.
+func (e *CorruptRecordError) Is(target error) bool {
+	return target == ErrCorruptRecord
+}
+
+// ErrSequenceNumberRemoved is returned when reading from a sequence number that
+// is no longer part of the log.
+var ErrSequenceNumberRemoved = errors.New("sequence number has been removed from the log")
+
+// ErrLocked is returned when opening a WAL that is already open for writing,
+// by this process or another one.
+var ErrLocked = errors.New("WAL is locked by another writer")
+
+// ErrReadOnly is returned when writing to a WAL opened in read-only mode.
+var ErrReadOnly = errors.New("WAL is read-only")
+
+// ErrUnsupportedFormat is returned when a log segment was written in a format
+// (version or flags) that this version of the WAL cannot read.
+var ErrUnsupportedFormat = errors.New("unsupported segment format")
+
+// ErrSequenceGap matches every *SequenceNumberError for a sequence number past
+// the next one of the log with errors.Is.
+var ErrSequenceGap = errors.New("sequence number would leave a gap in the log")
+
+// ErrSequenceDuplicate matches every *SequenceNumberError for a sequence number
+// already assigned with errors.Is.
+var ErrSequenceDuplicate = errors.New("sequence number is already assigned")
+
+// SequenceNumberError is returned when appending entries with a sequence number
+// chosen by the caller (see AppendAt) that is not the next one of the log.
+type SequenceNumberError struct {
+	SequenceNo uint64 // Sequence number chosen by the caller.
+	Expected   uint64 // Next sequence number of the log.
+}
+
+func (e *SequenceNumberError) Error() string {
+	if e.SequenceNo > e.Expected {
+		return fmt.Sprintf("cannot append entry %d, the next entry of the log is %d: %v", e.SequenceNo,
+			e.Expected, ErrSequenceGap)
+	}
+	return fmt.Sprintf("cannot append entry %d, the next entry of the log is %d: %v", e.SequenceNo,
+		e.Expected, ErrSequenceDuplicate)
+}
+
+// Is reports whether target is ErrSequenceGap or ErrSequenceDuplicate,
+// depending on the sequence number.
+func (e *SequenceNumberError) Is(target error) bool {
+	if e.SequenceNo > e.Expected {
+		return target == ErrSequenceGap
+	}
+	return target == ErrSequenceDuplicate
+}
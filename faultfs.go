@@ -0,0 +1,241 @@
+package wal
+
+import (
+	"errors"
+	"io"
+	"os"
+	"sync"
+)
+
+// FaultOp is a kind of file system operation a FaultFS can inject faults into.
+type FaultOp int
+
+const (
+	// FaultOpen covers opening and creating files.
+	FaultOpen FaultOp = iota
+	FaultWrite
+	FaultSync
+	FaultRename
+	FaultRemove
+	FaultTruncate
+	// FaultSyncDir covers syncing directories.
+	FaultSyncDir
+)
+
+// ErrInjectedFault is the default error returned by the operations failed by a
+// FaultFS.
+var ErrInjectedFault = errors.New("injected fault")
+
+// Fault describes a fault to inject with FaultFS.Inject.
+type Fault struct {
+	// Op is the kind of operation to fail.
+	Op FaultOp
+	// N selects the N-th operation of kind Op issued after the fault was
+	// injected, counting from 1. Zero is the same as 1.
+	N int
+	// Err is the error returned by the failed operation, ErrInjectedFault if
+	// nil.
+	Err error
+	// TornBytes is, for writes, the number of bytes of the failed write that
+	// reach the file before the error is returned.
+	TornBytes int
+	// Crash makes every operation following the failed one fail as well, as if
+	// the process had lost access to the disk (see FaultFS.Crashed).
+	Crash bool
+}
+
+// FaultFS is an FS wrapping another FS, failing or tearing the operations
+// selected with Inject. It is safe for concurrent use.
+type FaultFS struct {
+	fs     FS
+	lock   sync.Mutex
+	faults []*Fault
+	counts map[FaultOp]int
+	crash  error // Returned by every operation once a crashing fault fired.
+}
+
+// NewFaultFS returns a FaultFS wrapping the given FS, without any fault.
+func NewFaultFS(fs FS) *FaultFS {
+	return &FaultFS{fs: fs, counts: make(map[FaultOp]int)}
+}
+
+// Inject schedules the given fault.
+func (f *FaultFS) Inject(fault Fault) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if fault.N <= 0 {
+		fault.N = 1
+	}
+	if fault.Err == nil {
+		fault.Err = ErrInjectedFault
+	}
+	f.faults = append(f.faults, &fault)
+}
+
+// Count returns the number of operations of the given kind issued so far,
+// including the failed ones.
+func (f *FaultFS) Count(op FaultOp) int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	return f.counts[op]
+}
+
+// Crashed returns true if a crashing fault fired.
+func (f *FaultFS) Crashed() bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	return f.crash != nil
+}
+
+// Reset removes the pending faults, and recovers from a crash.
+func (f *FaultFS) Reset() {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.faults = nil
+	f.crash = nil
+}
+
+// fault counts an operation of the given kind, and returns the fault it must
+// fail with, if any.
+func (f *FaultFS) fault(op FaultOp) *Fault {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.counts[op]++
+	if f.crash != nil {
+		return &Fault{Op: op, Err: f.crash}
+	}
+
+	for i, fault := range f.faults {
+		if fault.Op != op {
+			continue
+		}
+		if fault.N--; fault.N > 0 {
+			continue
+		}
+
+		f.faults = append(f.faults[:i], f.faults[i+1:]...)
+		if fault.Crash {
+			f.crash = fault.Err
+		}
+		return fault
+	}
+
+	return nil
+}
+
+// crashed returns the error of the crash, if any.
+func (f *FaultFS) crashed() error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	return f.crash
+}
+
+func (f *FaultFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	if fault := f.fault(FaultOpen); fault != nil {
+		return nil, &os.PathError{Op: "open", Path: name, Err: fault.Err}
+	}
+
+	file, err := f.fs.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+
+	return &faultFile{File: file, fs: f, name: name}, nil
+}
+
+func (f *FaultFS) Rename(oldpath, newpath string) error {
+	if fault := f.fault(FaultRename); fault != nil {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: fault.Err}
+	}
+	return f.fs.Rename(oldpath, newpath)
+}
+
+func (f *FaultFS) Remove(name string) error {
+	if fault := f.fault(FaultRemove); fault != nil {
+		return &os.PathError{Op: "remove", Path: name, Err: fault.Err}
+	}
+	return f.fs.Remove(name)
+}
+
+func (f *FaultFS) Stat(name string) (os.FileInfo, error) {
+	if err := f.crashed(); err != nil {
+		return nil, &os.PathError{Op: "stat", Path: name, Err: err}
+	}
+	return f.fs.Stat(name)
+}
+
+func (f *FaultFS) ReadDir(name string) ([]string, error) {
+	if err := f.crashed(); err != nil {
+		return nil, &os.PathError{Op: "readdir", Path: name, Err: err}
+	}
+	return f.fs.ReadDir(name)
+}
+
+func (f *FaultFS) MkdirAll(path string, perm os.FileMode) error {
+	if err := f.crashed(); err != nil {
+		return &os.PathError{Op: "mkdir", Path: path, Err: err}
+	}
+	return f.fs.MkdirAll(path, perm)
+}
+
+func (f *FaultFS) SyncDir(name string) error {
+	if fault := f.fault(FaultSyncDir); fault != nil {
+		return &os.PathError{Op: "sync", Path: name, Err: fault.Err}
+	}
+	return f.fs.SyncDir(name)
+}
+
+// Lock fails like OpenFile, since taking a lock opens the lock file.
+func (f *FaultFS) Lock(name string, perm os.FileMode) (io.Closer, error) {
+	if fault := f.fault(FaultOpen); fault != nil {
+		return nil, &os.PathError{Op: "lock", Path: name, Err: fault.Err}
+	}
+	return f.fs.Lock(name, perm)
+}
+
+// faultFile is a file opened from a FaultFS.
+type faultFile struct {
+	File
+	fs   *FaultFS
+	name string
+}
+
+func (f *faultFile) Read(p []byte) (int, error) {
+	if err := f.fs.crashed(); err != nil {
+		return 0, &os.PathError{Op: "read", Path: f.name, Err: err}
+	}
+	return f.File.Read(p)
+}
+
+func (f *faultFile) Write(p []byte) (int, error) {
+	fault := f.fs.fault(FaultWrite)
+	if fault == nil {
+		return f.File.Write(p)
+	}
+
+	n := 0
+	if fault.TornBytes > 0 {
+		n, _ = f.File.Write(p[:min(fault.TornBytes, len(p))])
+	}
+	return n, &os.PathError{Op: "write", Path: f.name, Err: fault.Err}
+}
+
+func (f *faultFile) Sync() error {
+	if fault := f.fs.fault(FaultSync); fault != nil {
+		return &os.PathError{Op: "sync", Path: f.name, Err: fault.Err}
+	}
+	return f.File.Sync()
+}
+
+func (f *faultFile) Truncate(size int64) error {
+	if fault := f.fs.fault(FaultTruncate); fault != nil {
+		return &os.PathError{Op: "truncate", Path: f.name, Err: fault.Err}
+	}
+	return f.File.Truncate(size)
+}
@@ -0,0 +1,92 @@
+package wal
+
+import (
+	"context"
+	"io"
+	"math"
+	"time"
+)
+
+// Follower tails the WAL: it iterates over its entries like a Reader, but once
+// it reaches the end of the log it waits for new entries to be written instead
+// of returning io.EOF, and it moves on to the new segments created by log
+// rotations. Entries are read from the segment files as they are written, so
+// that the log is never read twice. A Follower is not safe for concurrent use.
+type Follower struct {
+	wal    *WAL
+	reader *Reader
+}
+
+// Follow returns a Follower over the entries of the WAL, starting from the entry
+// with the given sequence number, inclusive, which may not have been written
+// yet. Returns ErrSequenceNumberRemoved if the entry has already been removed
+// from the log.
+func (wal *WAL) Follow(sequenceNo uint64) (*Follower, error) {
+	reader, err := wal.NewReaderFrom(sequenceNo)
+	if err != nil {
+		return nil, err
+	}
+	// Followers read the entries as they are flushed, past the snapshot.
+	reader.follow = true
+	reader.lastSequenceNo = math.MaxUint64
+
+	return &Follower{wal: wal, reader: reader}, nil
+}
+
+// Next returns the next entry of the WAL, waiting for it to be written if
+// needed. Entries become visible once they are flushed to the segment file,
+// i.e. on the next sync (see Sync, WaitDurable and the sync interval). A
+// Follower of a read-only WAL looks for the entries written by the other
+// process every sync interval.
+//
+// Returns ctx.Err() if the context is done before the next entry is written,
+// in which case Next can be called again to keep following the log, and
+// ErrClosed once the WAL is closed and all the entries flushed before have been
+// returned. Like Reader.Next, it returns a *CorruptRecordError if a record
+// cannot be read back.
+func (f *Follower) Next(ctx context.Context) (*WAL_Entry, error) {
+	for {
+		// Get the notification before reading, so that a flush happening in
+		// between is not missed.
+		flushed := f.wal.flushed.wait()
+
+		entry, err := f.reader.Next()
+		if err != io.EOF {
+			return entry, err
+		}
+
+		if f.wal.isClosed() {
+			return nil, ErrClosed
+		}
+		if err := f.wal.waitForFlush(ctx, flushed); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// Close releases the resources held by the Follower. Subsequent calls to Next
+// return ErrReaderClosed.
+func (f *Follower) Close() error {
+	return f.reader.Close()
+}
+
+// waitForFlush blocks until the given flush notification fires, or until the
+// next sync interval for read-only WALs, since their entries are flushed by
+// another process.
+func (wal *WAL) waitForFlush(ctx context.Context, flushed <-chan struct{}) error {
+	var poll <-chan time.Time
+	if wal.readOnly {
+		timer := time.NewTimer(wal.syncInterval)
+		defer timer.Stop()
+		poll = timer.C
+	}
+
+	select {
+	case <-flushed:
+		return nil
+	case <-poll:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
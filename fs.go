@@ -0,0 +1,140 @@
+package wal
+
+import (
+	"io"
+	"os"
+	"sort"
+)
+
+// FS is the file system the WAL stores its files in. Every file operation of
+// the WAL goes through it, so that the WAL can run on top of MemFS or FaultFS
+// in tests. The default is the OS file system.
+type FS interface {
+	// OpenFile opens the named file with the given flags (os.O_RDONLY, etc.),
+	// creating it with the given permissions if needed.
+	OpenFile(name string, flag int, perm os.FileMode) (File, error)
+	// Rename renames (moves) oldpath to newpath, replacing newpath if it
+	// exists.
+	Rename(oldpath, newpath string) error
+	// Remove removes the named file.
+	Remove(name string) error
+	// Stat returns the os.FileInfo of the named file.
+	Stat(name string) (os.FileInfo, error)
+	// ReadDir returns the names of the entries of the named directory, sorted
+	// by name.
+	ReadDir(name string) ([]string, error)
+	// MkdirAll creates the named directory, along with any missing parents.
+	MkdirAll(path string, perm os.FileMode) error
+	// SyncDir commits the entries of the named directory to stable storage,
+	// making the files created, renamed and removed in it durable.
+	SyncDir(name string) error
+	// Lock takes an exclusive advisory lock on the named file, creating it
+	// with the given permissions if needed. The lock is held until the
+	// returned io.Closer is closed. Returns an error wrapping ErrLocked if the
+	// lock is already held, by this process or another one.
+	Lock(name string, perm os.FileMode) (io.Closer, error)
+}
+
+// File is a file opened from an FS.
+type File interface {
+	io.Reader
+	io.Writer
+	io.Seeker
+	io.Closer
+	// Sync commits the contents of the file to stable storage.
+	Sync() error
+	// Truncate changes the size of the file.
+	Truncate(size int64) error
+	// Stat returns the os.FileInfo of the file.
+	Stat() (os.FileInfo, error)
+}
+
+// OSFS returns the FS backed by the OS file system.
+func OSFS() FS {
+	return osFS{}
+}
+
+type osFS struct{}
+
+func (osFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	file, err := os.OpenFile(name, flag, perm)
+	if err != nil {
+		// Avoid returning a non-nil File wrapping a nil *os.File.
+		return nil, err
+	}
+	return file, nil
+}
+
+func (osFS) Rename(oldpath, newpath string) error {
+	return os.Rename(oldpath, newpath)
+}
+
+func (osFS) Remove(name string) error {
+	return os.Remove(name)
+}
+
+func (osFS) Stat(name string) (os.FileInfo, error) {
+	return os.Stat(name)
+}
+
+func (osFS) ReadDir(name string) ([]string, error) {
+	entries, err := os.ReadDir(name)
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	sort.Strings(names)
+
+	return names, nil
+}
+
+func (osFS) MkdirAll(path string, perm os.FileMode) error {
+	return os.MkdirAll(path, perm)
+}
+
+func (osFS) SyncDir(name string) error {
+	return syncDir(name)
+}
+
+func (osFS) Lock(name string, perm os.FileMode) (io.Closer, error) {
+	return lockFile(name, perm)
+}
+
+// readFile reads the whole named file from the given FS.
+func readFile(fs FS, name string) ([]byte, error) {
+	file, err := fs.OpenFile(name, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return io.ReadAll(file)
+}
+
+// writeFile writes data to the named file of the given FS, creating it if
+// needed and truncating it otherwise. If sync is true, the file is fsynced
+// before being closed.
+func writeFile(fs FS, name string, data []byte, perm os.FileMode, sync bool) error {
+	file, err := fs.OpenFile(name, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, perm)
+	if err != nil {
+		return err
+	}
+
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+
+	if sync {
+		if err := file.Sync(); err != nil {
+			file.Close()
+			return err
+		}
+	}
+
+	return file.Close()
+}
@@ -0,0 +1,307 @@
+package wal
+
+import (
+	"fmt"
+)
+
+// Durability is the guarantee an append provides once it returns.
+type Durability int
+
+const (
+	// DurabilityBuffered returns as soon as the entry is in the WAL's in-memory
+	// buffer. The entry is written out by the next sync, and only fsynced if
+	// fsync was enabled when opening the WAL.
+	DurabilityBuffered Durability = iota
+	// DurabilityFlushed returns once the entry has been written to the segment
+	// file, i.e. it survives a crash of the process but not of the machine.
+	DurabilityFlushed
+	// DurabilityFsynced returns once the entry has been fsynced to the segment
+	// file, as with WaitDurable.
+	DurabilityFsynced
+)
+
+// AppendWithDurability writes an entry to the WAL like Append, and returns once
+// the entry has reached the given durability level. Since entries are flushed
+// and fsynced in order, every entry written before it has reached at least the
+// same durability level.
+func (wal *WAL) AppendWithDurability(data []byte, durability Durability) (uint64, error) {
+	if err := validateDurability(durability); err != nil {
+		return 0, err
+	}
+
+	sequenceNo, err := wal.Append(data)
+	if err != nil {
+		return 0, err
+	}
+
+	return sequenceNo, wal.waitForDurability(sequenceNo, durability)
+}
+
+// AppendBatchWithDurability writes a batch of entries to the WAL like
+// AppendBatch, and returns once the whole batch has reached the given
+// durability level.
+func (wal *WAL) AppendBatchWithDurability(entries [][]byte, durability Durability) (uint64, error) {
+	if err := validateDurability(durability); err != nil {
+		return 0, err
+	}
+
+	sequenceNo, err := wal.AppendBatch(entries)
+	if err != nil || len(entries) == 0 {
+		return sequenceNo, err
+	}
+
+	return sequenceNo, wal.waitForDurability(sequenceNo+uint64(len(entries))-1, durability)
+}
+
+func validateDurability(durability Durability) error {
+	if durability < DurabilityBuffered || durability > DurabilityFsynced {
+		return fmt.Errorf("invalid durability level: %d", durability)
+	}
+	return nil
+}
+
+// waitForDurability blocks until the entry with the given sequence number has
+// reached the given durability level.
+func (wal *WAL) waitForDurability(sequenceNo uint64, durability Durability) error {
+	switch durability {
+	case DurabilityFlushed:
+		// Flushing the buffer writes out our entry, unless it was already
+		// written out by a sync or a log rotation in the meantime.
+		wal.lock.Lock()
+		defer wal.lock.Unlock()
+		return wal.flushBuffer()
+	case DurabilityFsynced:
+		return wal.WaitDurable(sequenceNo)
+	default:
+		return nil
+	}
+}
+
+// durabilityWaiter is a caller blocked in WaitDurable until the entry with the
+// given sequence number has been fsynced.
+type durabilityWaiter struct {
+	sequenceNo uint64
+	done       chan error
+}
+
+// WaitDurable blocks until the entry with the given sequence number (and every
+// entry before it) has been written and fsynced to the segment file, regardless
+// of whether fsync was enabled when opening the WAL. If it was not, the
+// directory is synced as well, once per segment, so that the segment itself
+// survives a power cut.
+//
+// Waiting writers are committed as a group: a single flush and fsync performed
+// by the background syncing goroutine makes all the entries written so far
+// durable at once, so concurrent writers share the cost of the fsync.
+//
+// Returns ErrReadOnly if the WAL is read-only, since it cannot sync the entries
+// of another writer, and an error if the sequence number has not been assigned
+// yet, since nothing would ever make it durable.
+func (wal *WAL) WaitDurable(sequenceNo uint64) error {
+	if wal.readOnly {
+		return ErrReadOnly
+	}
+
+	// The lock keeps the last sequence number from changing until we are
+	// queued, e.g. because of TruncateBack.
+	wal.lock.Lock()
+	wal.durabilityLock.Lock()
+	if sequenceNo <= wal.durableSequenceNo {
+		wal.durabilityLock.Unlock()
+		wal.lock.Unlock()
+		return nil
+	}
+	if wal.closed {
+		wal.durabilityLock.Unlock()
+		wal.lock.Unlock()
+		return ErrClosed
+	}
+	if sequenceNo > wal.lastSequenceNo {
+		lastSequenceNo := wal.lastSequenceNo
+		wal.durabilityLock.Unlock()
+		wal.lock.Unlock()
+		return fmt.Errorf("cannot wait for entry %d, past the last entry %d of the log", sequenceNo,
+			lastSequenceNo)
+	}
+
+	done := make(chan error, 1)
+	wal.durabilityWaiters = append(wal.durabilityWaiters, durabilityWaiter{sequenceNo, done})
+	wal.durabilityLock.Unlock()
+	wal.lock.Unlock()
+
+	wal.requestSync()
+
+	return <-done
+}
+
+// requestSync wakes up the background syncing goroutine for a group commit.
+func (wal *WAL) requestSync() {
+	select {
+	case wal.syncRequests <- struct{}{}:
+	default:
+		// A group commit is already pending, it will pick up our entries.
+	}
+}
+
+// groupCommit flushes the buffered entries to the segment file and, if fsync is
+// true, fsyncs it. The fsync happens outside of the WAL lock so that writers
+// can keep appending entries (which will be part of the next group commit)
+// while it is in progress.
+func (wal *WAL) groupCommit(fsync bool) {
+	wal.lock.Lock()
+	if wal.isClosed() {
+		wal.lock.Unlock()
+		return
+	}
+
+	if err := wal.flushBuffer(); err != nil {
+		wal.lock.Unlock()
+		wal.reportSyncError(err)
+		wal.markDurable(wal.lastSequenceNo, err)
+		return
+	}
+	wal.resetTimer()
+
+	if !fsync {
+		wal.lock.Unlock()
+		return
+	}
+
+	sequenceNo := wal.lastSequenceNo
+	segment := wal.currentSegment
+
+	// Prevent the segment from being closed while we fsync it, and TruncateBack
+	// from discarding the entries we are about to mark as durable.
+	wal.syncLock.Lock()
+	defer wal.syncLock.Unlock()
+	wal.lock.Unlock()
+
+	err := segment.Sync()
+	if err == nil {
+		err = wal.syncSegmentDir()
+	}
+	if err != nil {
+		wal.reportSyncError(err)
+	}
+
+	wal.markDurable(sequenceNo, err)
+}
+
+// reportSyncError logs an error of a periodic sync, and passes it to the
+// OnSyncError hook.
+func (wal *WAL) reportSyncError(err error) {
+	wal.dir.logger.Printf("Error while performing sync: %v", err)
+	if wal.hooks.OnSyncError != nil {
+		wal.hooks.OnSyncError(err)
+	}
+}
+
+// syncSegmentDir fsyncs the directory of the WAL if the directory entry of the
+// current segment may not be durable yet, i.e. if fsync is disabled: the
+// entries fsynced by a group commit would not survive a power cut otherwise.
+// The directory is only synced once per segment, and never if no writer waits
+// for durability. Must be called with the sync lock held.
+func (wal *WAL) syncSegmentDir() error {
+	if wal.segmentDirSynced {
+		return nil
+	}
+	if err := wal.dir.fs.SyncDir(wal.dir.path); err != nil {
+		return err
+	}
+
+	wal.segmentDirSynced = true
+	return nil
+}
+
+// fsyncCurrentSegment fsyncs the current segment file and marks every entry
+// written so far as durable, unless the directory entry of the segment is not
+// durable yet (see syncSegmentDir), in which case the next group commit does.
+// Must be called with the WAL lock held, after the buffer has been flushed.
+func (wal *WAL) fsyncCurrentSegment() error {
+	err := wal.currentSegment.Sync()
+
+	wal.syncLock.Lock()
+	dirSynced := wal.segmentDirSynced
+	wal.syncLock.Unlock()
+	if err == nil && !dirSynced {
+		return nil
+	}
+
+	wal.markDurable(wal.lastSequenceNo, err)
+	return err
+}
+
+// markDurable records the outcome of an fsync covering all the entries up to
+// the given sequence number, and releases the writers waiting on them.
+func (wal *WAL) markDurable(sequenceNo uint64, err error) {
+	wal.durabilityLock.Lock()
+	defer wal.durabilityLock.Unlock()
+
+	if err == nil && sequenceNo > wal.durableSequenceNo {
+		wal.durableSequenceNo = sequenceNo
+		wal.durable.notify()
+	}
+
+	remaining := wal.durabilityWaiters[:0]
+	for _, waiter := range wal.durabilityWaiters {
+		switch {
+		case waiter.sequenceNo <= wal.durableSequenceNo:
+			waiter.done <- nil
+		case err != nil && waiter.sequenceNo <= sequenceNo:
+			waiter.done <- err
+		default:
+			remaining = append(remaining, waiter)
+		}
+	}
+	wal.durabilityWaiters = remaining
+}
+
+// discardDurability forgets about the entries after the given sequence number,
+// removed by TruncateBack, and fails the writers waiting for them to become
+// durable. Must be called with the sync lock held, so that a group commit in
+// progress cannot mark them as durable afterwards.
+func (wal *WAL) discardDurability(sequenceNo uint64) {
+	wal.durabilityLock.Lock()
+	defer wal.durabilityLock.Unlock()
+
+	wal.durableSequenceNo = min(wal.durableSequenceNo, sequenceNo)
+
+	remaining := wal.durabilityWaiters[:0]
+	for _, waiter := range wal.durabilityWaiters {
+		if waiter.sequenceNo > sequenceNo {
+			waiter.done <- fmt.Errorf("entry %d: %w", waiter.sequenceNo, ErrSequenceNumberRemoved)
+		} else {
+			remaining = append(remaining, waiter)
+		}
+	}
+	wal.durabilityWaiters = remaining
+}
+
+// durableSequenceNumber returns the sequence number of the last durable entry.
+func (wal *WAL) durableSequenceNumber() uint64 {
+	wal.durabilityLock.Lock()
+	defer wal.durabilityLock.Unlock()
+
+	return wal.durableSequenceNo
+}
+
+// isClosed returns true if the WAL has been closed.
+func (wal *WAL) isClosed() bool {
+	wal.durabilityLock.Lock()
+	defer wal.durabilityLock.Unlock()
+
+	return wal.closed
+}
+
+// releaseWaiters fails all the writers still waiting for their entries to
+// become durable. Called once the WAL has been closed.
+func (wal *WAL) releaseWaiters() {
+	wal.durabilityLock.Lock()
+	defer wal.durabilityLock.Unlock()
+
+	wal.closed = true
+	for _, waiter := range wal.durabilityWaiters {
+		waiter.done <- ErrClosed
+	}
+	wal.durabilityWaiters = nil
+}
@@ -0,0 +1,190 @@
+package wal
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+)
+
+const (
+	// indexInterval is the minimum number of bytes between two consecutive
+	// entries of a segment index.
+	indexInterval = 64 * 1024
+	indexSuffix   = ".index"
+	// Size of a serialized index point: sequence number and offset.
+	indexPointSize = 16
+)
+
+// indexPoint maps the sequence number of an entry to the offset of its record
+// in the segment file.
+type indexPoint struct {
+	sequenceNo uint64
+	offset     int64
+}
+
+// segmentIndex is a sparse index of the entries of a log segment, with roughly
+// one point every indexInterval bytes. Points are only added at offsets where a
+// reader can start reading, i.e. never in the middle of a batch, so that
+// looking up a sequence number is a seek followed by a short scan.
+//
+// The index of a segment is persisted to a file next to it (segment-N.index)
+// when the segment is sealed by a log rotation, and rebuilt when missing. The
+// index of the current segment is only kept in memory.
+type segmentIndex struct {
+	points []indexPoint
+}
+
+// add records that an entry with the given sequence number starts at the given
+// offset, if it is far enough from the previous point.
+func (idx *segmentIndex) add(sequenceNo uint64, offset int64) {
+	if n := len(idx.points); n > 0 && offset < idx.points[n-1].offset+indexInterval {
+		return
+	}
+	idx.points = append(idx.points, indexPoint{sequenceNo, offset})
+}
+
+// firstSequenceNo returns the sequence number of the first entry of the
+// segment, or 0 if the segment is empty.
+func (idx *segmentIndex) firstSequenceNo() uint64 {
+	if len(idx.points) == 0 {
+		return 0
+	}
+	return idx.points[0].sequenceNo
+}
+
+// lookup returns the offset from which to scan the segment to find the entry
+// with the given sequence number.
+func (idx *segmentIndex) lookup(sequenceNo uint64) int64 {
+	i := sort.Search(len(idx.points), func(i int) bool {
+		return idx.points[i].sequenceNo > sequenceNo
+	})
+	if i == 0 {
+		return 0
+	}
+	return idx.points[i-1].offset
+}
+
+// Returns the path of the index file of the given log segment.
+func indexPath(dir *walDir, segmentID int) string {
+	return segmentPath(dir, segmentID) + indexSuffix
+}
+
+// loadSegmentIndex reads the index of the given log segment from its index
+// file, rebuilding (and persisting, unless the WAL is read-only) it if the file
+// is missing or invalid.
+func loadSegmentIndex(dir *walDir, segmentID int) (*segmentIndex, error) {
+	idx, err := readSegmentIndex(dir, segmentID)
+	if err == nil {
+		return idx, nil
+	}
+
+	scan, err := scanSegment(dir, segmentID)
+	if err != nil {
+		return nil, err
+	}
+
+	if dir.readOnly {
+		return scan.index, nil
+	}
+
+	return scan.index, writeSegmentIndex(dir, segmentID, scan.index)
+}
+
+// readSegmentIndex reads the index file of the given log segment.
+func readSegmentIndex(dir *walDir, segmentID int) (*segmentIndex, error) {
+	data, err := readFile(dir.fs, indexPath(dir, segmentID))
+	if err != nil {
+		return nil, err
+	}
+	if len(data)%indexPointSize != 0 {
+		return nil, fmt.Errorf("invalid index file size for segment %d: %d", segmentID, len(data))
+	}
+
+	idx := &segmentIndex{points: make([]indexPoint, 0, len(data)/indexPointSize)}
+	for ; len(data) > 0; data = data[indexPointSize:] {
+		idx.points = append(idx.points, indexPoint{
+			sequenceNo: binary.LittleEndian.Uint64(data),
+			offset:     int64(binary.LittleEndian.Uint64(data[8:])),
+		})
+	}
+
+	return idx, nil
+}
+
+// writeSegmentIndex atomically writes the index file of the given log segment.
+// The directory is not synced: an index file lost by a crash is rebuilt.
+func writeSegmentIndex(dir *walDir, segmentID int, idx *segmentIndex) error {
+	data := make([]byte, 0, len(idx.points)*indexPointSize)
+	for _, point := range idx.points {
+		data = binary.LittleEndian.AppendUint64(data, point.sequenceNo)
+		data = binary.LittleEndian.AppendUint64(data, uint64(point.offset))
+	}
+
+	tempFilePath := fmt.Sprintf("%s.tmp", indexPath(dir, segmentID))
+	if err := writeFile(dir.fs, tempFilePath, data, dir.filePerm, dir.fsync); err != nil {
+		return err
+	}
+
+	return dir.fs.Rename(tempFilePath, indexPath(dir, segmentID))
+}
+
+// removeSegmentIndex removes the index file of the given log segment, if any.
+func removeSegmentIndex(dir *walDir, segmentID int) error {
+	if err := dir.fs.Remove(indexPath(dir, segmentID)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// segmentScan is the result of scanning a log segment with scanSegment.
+type segmentScan struct {
+	index     *segmentIndex
+	lastEntry *WAL_Entry // Nil if the segment has no entries.
+	// Offset of the end of the last record, which is smaller than the size of
+	// the file for preallocated segments.
+	end int64
+}
+
+// scanSegment reads all the entries of the given log segment and returns its
+// index, along with the last entry of the segment. Entries belonging to a batch
+// that was torn by a crash are ignored.
+func scanSegment(dir *walDir, segmentID int) (*segmentScan, error) {
+	file, err := dir.fs.OpenFile(segmentPath(dir, segmentID), os.O_RDONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	reader, err := newSegmentReader(file, segmentID)
+	if err != nil {
+		return nil, err
+	}
+
+	scan := &segmentScan{index: &segmentIndex{}}
+	var batch batchAssembler
+
+	for {
+		offset := reader.offset
+		entry, err := reader.next()
+		if err != nil {
+			if err == io.EOF || dir.tornTail(err) {
+				scan.end = reader.offset
+				return scan, nil
+			}
+			return nil, err
+		}
+
+		// Readers can only start at entries that are not in the middle of a
+		// batch.
+		if !batch.incomplete() {
+			scan.index.add(entry.GetLogSequenceNumber(), offset)
+		}
+
+		if complete := batch.add(entry); len(complete) > 0 {
+			scan.lastEntry = complete[len(complete)-1]
+		}
+	}
+}
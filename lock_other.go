@@ -0,0 +1,58 @@
+//go:build !(darwin || dragonfly || freebsd || linux || netbsd || openbsd)
+
+package wal
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+var (
+	lockedFilesLock sync.Mutex
+	lockedFiles     = make(map[string]bool)
+)
+
+// lockFile locks the given file within this process only, since flock is not
+// available on this platform.
+func lockFile(name string, perm os.FileMode) (io.Closer, error) {
+	path, err := filepath.Abs(name)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.OpenFile(name, os.O_CREATE|os.O_RDWR, perm)
+	if err != nil {
+		return nil, err
+	}
+
+	lockedFilesLock.Lock()
+	defer lockedFilesLock.Unlock()
+
+	if lockedFiles[path] {
+		file.Close()
+		return nil, &os.PathError{Op: "lock", Path: name, Err: ErrLocked}
+	}
+	lockedFiles[path] = true
+
+	return &processLock{file: file, path: path}, nil
+}
+
+// processLock is a lock taken with lockFile.
+type processLock struct {
+	file *os.File
+	path string
+}
+
+func (l *processLock) Close() error {
+	lockedFilesLock.Lock()
+	defer lockedFilesLock.Unlock()
+
+	if err := l.file.Close(); err != nil {
+		return err
+	}
+	delete(lockedFiles, l.path)
+
+	return nil
+}
@@ -0,0 +1,395 @@
+package wal
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MemFS is an FS keeping its files in memory, to run the WAL in tests without
+// touching the disk. It is safe for concurrent use.
+type MemFS struct {
+	lock  sync.Mutex
+	files map[string]*memInode
+	dirs  map[string]time.Time // Directories and their modification time.
+	locks map[string]bool      // Files locked with Lock.
+}
+
+// memInode holds the contents of a file of a MemFS. Renaming or removing the
+// file does not affect the handles opened on it.
+type memInode struct {
+	data    []byte
+	perm    os.FileMode
+	modTime time.Time
+}
+
+// NewMemFS returns an empty MemFS.
+func NewMemFS() *MemFS {
+	return &MemFS{
+		files: make(map[string]*memInode),
+		locks: make(map[string]bool),
+		dirs:  map[string]time.Time{".": time.Now(), "/": time.Now()},
+	}
+}
+
+func (m *MemFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	name = filepath.Clean(name)
+	if _, ok := m.dirs[filepath.Dir(name)]; !ok {
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	}
+	if _, ok := m.dirs[name]; ok {
+		return nil, &os.PathError{Op: "open", Path: name, Err: errors.New("is a directory")}
+	}
+
+	inode, ok := m.files[name]
+	switch {
+	case ok && flag&(os.O_CREATE|os.O_EXCL) == os.O_CREATE|os.O_EXCL:
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrExist}
+	case !ok && flag&os.O_CREATE == 0:
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	case !ok:
+		inode = &memInode{perm: perm.Perm(), modTime: time.Now()}
+		m.files[name] = inode
+	}
+
+	file := &memFile{fs: m, name: name, inode: inode, flag: flag}
+	if flag&os.O_TRUNC != 0 && file.writable() {
+		inode.data = nil
+		inode.modTime = time.Now()
+	}
+
+	return file, nil
+}
+
+func (m *MemFS) Rename(oldpath, newpath string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	oldpath, newpath = filepath.Clean(oldpath), filepath.Clean(newpath)
+	inode, ok := m.files[oldpath]
+	if !ok {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: os.ErrNotExist}
+	}
+	if _, ok := m.dirs[filepath.Dir(newpath)]; !ok {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: os.ErrNotExist}
+	}
+
+	delete(m.files, oldpath)
+	m.files[newpath] = inode
+
+	return nil
+}
+
+func (m *MemFS) Remove(name string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	name = filepath.Clean(name)
+	if _, ok := m.files[name]; ok {
+		delete(m.files, name)
+		return nil
+	}
+
+	if _, ok := m.dirs[name]; !ok {
+		return &os.PathError{Op: "remove", Path: name, Err: os.ErrNotExist}
+	}
+	if len(m.list(name)) > 0 {
+		return &os.PathError{Op: "remove", Path: name, Err: errors.New("directory not empty")}
+	}
+	delete(m.dirs, name)
+
+	return nil
+}
+
+func (m *MemFS) Stat(name string) (os.FileInfo, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	name = filepath.Clean(name)
+	if inode, ok := m.files[name]; ok {
+		return inode.info(name), nil
+	}
+	if modTime, ok := m.dirs[name]; ok {
+		return &memFileInfo{name: filepath.Base(name), mode: os.ModeDir | 0755, modTime: modTime}, nil
+	}
+
+	return nil, &os.PathError{Op: "stat", Path: name, Err: os.ErrNotExist}
+}
+
+func (m *MemFS) ReadDir(name string) ([]string, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	name = filepath.Clean(name)
+	if _, ok := m.dirs[name]; !ok {
+		return nil, &os.PathError{Op: "readdir", Path: name, Err: os.ErrNotExist}
+	}
+
+	return m.list(name), nil
+}
+
+// list returns the sorted names of the entries of the given directory. Must be
+// called with the lock held.
+func (m *MemFS) list(dir string) []string {
+	var names []string
+	for name := range m.files {
+		if filepath.Dir(name) == dir {
+			names = append(names, filepath.Base(name))
+		}
+	}
+	for name := range m.dirs {
+		if name != dir && filepath.Dir(name) == dir {
+			names = append(names, filepath.Base(name))
+		}
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+func (m *MemFS) MkdirAll(path string, perm os.FileMode) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	for dir := filepath.Clean(path); ; dir = filepath.Dir(dir) {
+		if _, ok := m.files[dir]; ok {
+			return &os.PathError{Op: "mkdir", Path: dir, Err: errors.New("not a directory")}
+		}
+		if _, ok := m.dirs[dir]; ok {
+			return nil
+		}
+		m.dirs[dir] = time.Now()
+	}
+}
+
+// SyncDir only checks that the directory exists, since the entries of a MemFS
+// directory are never lost.
+func (m *MemFS) SyncDir(name string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if _, ok := m.dirs[filepath.Clean(name)]; !ok {
+		return &os.PathError{Op: "sync", Path: name, Err: os.ErrNotExist}
+	}
+
+	return nil
+}
+
+func (m *MemFS) Lock(name string, perm os.FileMode) (io.Closer, error) {
+	file, err := m.OpenFile(name, os.O_CREATE|os.O_RDWR, perm)
+	if err != nil {
+		return nil, err
+	}
+	if err := file.Close(); err != nil {
+		return nil, err
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	name = filepath.Clean(name)
+	if m.locks[name] {
+		return nil, &os.PathError{Op: "lock", Path: name, Err: ErrLocked}
+	}
+	m.locks[name] = true
+
+	return &memLock{fs: m, name: name}, nil
+}
+
+// memLock is a lock taken with MemFS.Lock.
+type memLock struct {
+	fs       *MemFS
+	name     string
+	released bool
+}
+
+func (l *memLock) Close() error {
+	l.fs.lock.Lock()
+	defer l.fs.lock.Unlock()
+
+	if l.released {
+		return &os.PathError{Op: "unlock", Path: l.name, Err: os.ErrClosed}
+	}
+	l.released = true
+	delete(l.fs.locks, l.name)
+
+	return nil
+}
+
+func (inode *memInode) info(name string) os.FileInfo {
+	return &memFileInfo{
+		name:    filepath.Base(name),
+		size:    int64(len(inode.data)),
+		mode:    inode.perm,
+		modTime: inode.modTime,
+	}
+}
+
+// memFile is a handle on a file of a MemFS.
+type memFile struct {
+	fs     *MemFS
+	name   string
+	inode  *memInode
+	flag   int
+	offset int64
+	closed bool
+}
+
+func (f *memFile) readable() bool {
+	return f.flag&(os.O_WRONLY|os.O_RDWR) != os.O_WRONLY
+}
+
+func (f *memFile) writable() bool {
+	return f.flag&(os.O_WRONLY|os.O_RDWR) != 0
+}
+
+// check returns an error if the file is closed, or does not allow the
+// operation. Must be called with the lock of the FS held.
+func (f *memFile) check(op string, allowed bool) error {
+	if f.closed {
+		return &os.PathError{Op: op, Path: f.name, Err: os.ErrClosed}
+	}
+	if !allowed {
+		return &os.PathError{Op: op, Path: f.name, Err: os.ErrPermission}
+	}
+	return nil
+}
+
+func (f *memFile) Read(p []byte) (int, error) {
+	f.fs.lock.Lock()
+	defer f.fs.lock.Unlock()
+
+	if err := f.check("read", f.readable()); err != nil {
+		return 0, err
+	}
+	if f.offset >= int64(len(f.inode.data)) {
+		return 0, io.EOF
+	}
+
+	n := copy(p, f.inode.data[f.offset:])
+	f.offset += int64(n)
+
+	return n, nil
+}
+
+func (f *memFile) Write(p []byte) (int, error) {
+	f.fs.lock.Lock()
+	defer f.fs.lock.Unlock()
+
+	if err := f.check("write", f.writable()); err != nil {
+		return 0, err
+	}
+	if f.flag&os.O_APPEND != 0 {
+		f.offset = int64(len(f.inode.data))
+	}
+
+	end := f.offset + int64(len(p))
+	if end > int64(len(f.inode.data)) {
+		f.inode.resize(end)
+	}
+	copy(f.inode.data[f.offset:], p)
+	f.offset = end
+	f.inode.modTime = time.Now()
+
+	return len(p), nil
+}
+
+func (f *memFile) Seek(offset int64, whence int) (int64, error) {
+	f.fs.lock.Lock()
+	defer f.fs.lock.Unlock()
+
+	if err := f.check("seek", true); err != nil {
+		return 0, err
+	}
+
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += int64(len(f.inode.data))
+	}
+	if offset < 0 {
+		return 0, &os.PathError{Op: "seek", Path: f.name, Err: errors.New("negative offset")}
+	}
+	f.offset = offset
+
+	return offset, nil
+}
+
+func (f *memFile) Close() error {
+	f.fs.lock.Lock()
+	defer f.fs.lock.Unlock()
+
+	if err := f.check("close", true); err != nil {
+		return err
+	}
+	f.closed = true
+
+	return nil
+}
+
+func (f *memFile) Sync() error {
+	f.fs.lock.Lock()
+	defer f.fs.lock.Unlock()
+
+	return f.check("sync", true)
+}
+
+func (f *memFile) Truncate(size int64) error {
+	f.fs.lock.Lock()
+	defer f.fs.lock.Unlock()
+
+	if err := f.check("truncate", f.writable()); err != nil {
+		return err
+	}
+	if size < 0 {
+		return &os.PathError{Op: "truncate", Path: f.name, Err: errors.New("negative size")}
+	}
+	f.inode.resize(size)
+	f.inode.modTime = time.Now()
+
+	return nil
+}
+
+func (f *memFile) Stat() (os.FileInfo, error) {
+	f.fs.lock.Lock()
+	defer f.fs.lock.Unlock()
+
+	if err := f.check("stat", true); err != nil {
+		return nil, err
+	}
+
+	return f.inode.info(f.name), nil
+}
+
+// resize grows (with zeros) or shrinks the contents of the file to the given
+// size.
+func (inode *memInode) resize(size int64) {
+	if size <= int64(len(inode.data)) {
+		inode.data = inode.data[:size]
+		return
+	}
+	inode.data = append(inode.data, make([]byte, size-int64(len(inode.data)))...)
+}
+
+// memFileInfo is the os.FileInfo of a file or directory of a MemFS.
+type memFileInfo struct {
+	name    string
+	size    int64
+	mode    os.FileMode
+	modTime time.Time
+}
+
+func (i *memFileInfo) Name() string       { return i.name }
+func (i *memFileInfo) Size() int64        { return i.size }
+func (i *memFileInfo) Mode() os.FileMode  { return i.mode }
+func (i *memFileInfo) ModTime() time.Time { return i.modTime }
+func (i *memFileInfo) IsDir() bool        { return i.mode.IsDir() }
+func (i *memFileInfo) Sys() any           { return nil }
@@ -0,0 +1,221 @@
+package wal
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// ErrInvalidOption is returned when opening the WAL with invalid options.
+var ErrInvalidOption = errors.New("invalid option")
+
+// Hooks are callbacks invoked on events of the WAL. They are called
+// synchronously, possibly while the WAL is locked, so they must be quick and
+// must not call back into the WAL.
+type Hooks struct {
+	// OnRotate is called after the WAL rotated to a new log segment, with the
+	// ID of the new segment.
+	OnRotate func(segmentID int)
+	// OnSegmentDeleted is called after a log segment was deleted, because of
+	// MaxSegments or RetentionPeriod, or by TruncateFront or TruncateBack.
+	OnSegmentDeleted func(segmentID int)
+	// OnSyncError is called when a periodic sync fails.
+	OnSyncError func(err error)
+}
+
+// Options configures a WAL opened with Open.
+type Options struct {
+	// EnableFsync enables fsync on the log segment file every time the log
+	// flushes. It also makes the creation, replacement and deletion of files
+	// durable, by fsyncing new files before renaming them into place and
+	// fsyncing the directory afterwards.
+	EnableFsync bool
+	// MaxFileSize is the maximum size of a log segment file in bytes.
+	MaxFileSize int64
+	// MaxSegments is the maximum number of log segment files to keep.
+	MaxSegments int
+	// SyncInterval is the interval at which buffered entries are flushed (and
+	// fsynced if enabled).
+	SyncInterval time.Duration
+	// BufferSize is the size of the in-memory buffer of the current segment.
+	BufferSize int
+	// FilePerm and DirPerm are the permissions of the files and of the
+	// directory created by the WAL.
+	FilePerm os.FileMode
+	DirPerm  os.FileMode
+	// SegmentPrefix is the prefix of the names of the log segment files, which
+	// are followed by the segment ID.
+	SegmentPrefix string
+	// Logger receives the messages logged by the WAL.
+	Logger *log.Logger
+	// Preallocate reserves the space of a log segment (MaxFileSize) on disk
+	// when it is created, instead of growing the file with every write.
+	Preallocate bool
+	// RetentionPeriod is the time for which sealed log segments are kept after
+	// their last write. Older segments are deleted on log rotation. Zero keeps
+	// segments until MaxSegments is reached.
+	RetentionPeriod time.Duration
+	// Hooks are the callbacks invoked on events of the WAL.
+	Hooks Hooks
+	// Recovery is the recovery performed when opening the WAL.
+	Recovery RecoveryPolicy
+	// FS is the file system the WAL stores its files in.
+	FS FS
+	// ReadOnly opens the WAL for reading only (see OpenReadOnly). The writer
+	// lock is not taken, so the WAL can be read while another process writes
+	// to it, nothing is created or recovered, and every write fails with
+	// ErrReadOnly.
+	ReadOnly bool
+}
+
+// Option configures the Options of a WAL opened with Open.
+type Option func(*Options)
+
+// DefaultOptions returns the options used by Open, before applying the given
+// Option values.
+func DefaultOptions() Options {
+	return Options{
+		EnableFsync:   true,
+		MaxFileSize:   64 * 1024 * 1024,
+		MaxSegments:   10,
+		SyncInterval:  syncInterval,
+		BufferSize:    4096,
+		FilePerm:      0644,
+		DirPerm:       0755,
+		SegmentPrefix: segmentPrefix,
+		Logger:        log.Default(),
+		Recovery:      RecoveryPolicy{Mode: RecoveryStrict},
+		FS:            OSFS(),
+	}
+}
+
+// WithFsync enables or disables fsync on every flush.
+func WithFsync(enableFsync bool) Option {
+	return func(o *Options) { o.EnableFsync = enableFsync }
+}
+
+// WithMaxFileSize sets the maximum size of a log segment file in bytes.
+func WithMaxFileSize(maxFileSize int64) Option {
+	return func(o *Options) { o.MaxFileSize = maxFileSize }
+}
+
+// WithMaxSegments sets the maximum number of log segment files to keep.
+func WithMaxSegments(maxSegments int) Option {
+	return func(o *Options) { o.MaxSegments = maxSegments }
+}
+
+// WithSyncInterval sets the interval at which buffered entries are flushed.
+func WithSyncInterval(interval time.Duration) Option {
+	return func(o *Options) { o.SyncInterval = interval }
+}
+
+// WithBufferSize sets the size of the in-memory buffer of the current segment.
+func WithBufferSize(size int) Option {
+	return func(o *Options) { o.BufferSize = size }
+}
+
+// WithPermissions sets the permissions of the files and of the directory
+// created by the WAL.
+func WithPermissions(filePerm, dirPerm os.FileMode) Option {
+	return func(o *Options) {
+		o.FilePerm = filePerm
+		o.DirPerm = dirPerm
+	}
+}
+
+// WithSegmentPrefix sets the prefix of the names of the log segment files.
+func WithSegmentPrefix(prefix string) Option {
+	return func(o *Options) { o.SegmentPrefix = prefix }
+}
+
+// WithLogger sets the logger receiving the messages logged by the WAL.
+func WithLogger(logger *log.Logger) Option {
+	return func(o *Options) { o.Logger = logger }
+}
+
+// WithPreallocation enables or disables the preallocation of log segments.
+func WithPreallocation(preallocate bool) Option {
+	return func(o *Options) { o.Preallocate = preallocate }
+}
+
+// WithRetentionPeriod sets the time for which sealed log segments are kept.
+func WithRetentionPeriod(period time.Duration) Option {
+	return func(o *Options) { o.RetentionPeriod = period }
+}
+
+// WithHooks sets the callbacks invoked on events of the WAL.
+func WithHooks(hooks Hooks) Option {
+	return func(o *Options) { o.Hooks = hooks }
+}
+
+// WithRecovery sets the recovery performed when opening the WAL.
+func WithRecovery(policy RecoveryPolicy) Option {
+	return func(o *Options) { o.Recovery = policy }
+}
+
+// WithFS sets the file system the WAL stores its files in, e.g. a MemFS or a
+// FaultFS in tests.
+func WithFS(fs FS) Option {
+	return func(o *Options) { o.FS = fs }
+}
+
+// validate returns an error wrapping ErrInvalidOption if the options are
+// invalid.
+func (o *Options) validate() error {
+	switch {
+	case o.MaxFileSize <= 0:
+		return fmt.Errorf("%w: MaxFileSize must be positive, got %d", ErrInvalidOption, o.MaxFileSize)
+	case o.MaxSegments <= 0:
+		return fmt.Errorf("%w: MaxSegments must be positive, got %d", ErrInvalidOption, o.MaxSegments)
+	case o.SyncInterval <= 0:
+		return fmt.Errorf("%w: SyncInterval must be positive, got %v", ErrInvalidOption, o.SyncInterval)
+	case o.BufferSize <= 0:
+		return fmt.Errorf("%w: BufferSize must be positive, got %d", ErrInvalidOption, o.BufferSize)
+	case o.FilePerm == 0 || o.FilePerm&^os.ModePerm != 0:
+		return fmt.Errorf("%w: invalid FilePerm %v", ErrInvalidOption, o.FilePerm)
+	case o.DirPerm == 0 || o.DirPerm&^os.ModePerm != 0:
+		return fmt.Errorf("%w: invalid DirPerm %v", ErrInvalidOption, o.DirPerm)
+	case o.SegmentPrefix == "" || strings.ContainsAny(o.SegmentPrefix, `/\`):
+		return fmt.Errorf("%w: invalid SegmentPrefix %q", ErrInvalidOption, o.SegmentPrefix)
+	case o.Logger == nil:
+		return fmt.Errorf("%w: Logger must not be nil", ErrInvalidOption)
+	case o.FS == nil:
+		return fmt.Errorf("%w: FS must not be nil", ErrInvalidOption)
+	case o.RetentionPeriod < 0:
+		return fmt.Errorf("%w: RetentionPeriod must not be negative, got %v", ErrInvalidOption, o.RetentionPeriod)
+	case o.Recovery.Mode < RecoveryStrict || o.Recovery.Mode > RecoveryPointInTime:
+		return fmt.Errorf("%w: %w: %d", ErrInvalidOption, ErrInvalidRecoveryMode, o.Recovery.Mode)
+	case o.ReadOnly && o.Recovery.Mode != RecoveryStrict:
+		return fmt.Errorf("%w: a read-only WAL cannot be recovered with mode %d", ErrInvalidOption, o.Recovery.Mode)
+	}
+
+	return nil
+}
+
+// WithReadOnly opens the WAL for reading only (see Options.ReadOnly).
+func WithReadOnly(readOnly bool) Option {
+	return func(o *Options) { o.ReadOnly = readOnly }
+}
+
+// preallocationSize returns the size of the files of preallocated log
+// segments, or zero if segments are not preallocated.
+func (o *Options) preallocationSize() int64 {
+	if !o.Preallocate {
+		return 0
+	}
+	return segmentHeaderSize + o.MaxFileSize
+}
+
+// buildOptions applies the given options on top of the default ones, and
+// validates the result.
+func buildOptions(opts []Option) (Options, error) {
+	options := DefaultOptions()
+	for _, opt := range opts {
+		opt(&options)
+	}
+
+	return options, options.validate()
+}
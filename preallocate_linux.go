@@ -0,0 +1,25 @@
+//go:build linux
+
+package wal
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// preallocate extends the given file to the given size, reserving the space on
+// disk. Falls back to a sparse file on file systems without fallocate support,
+// and for files that do not come from the OS file system.
+func preallocate(file File, size int64) error {
+	osFile, ok := file.(*os.File)
+	if !ok {
+		return file.Truncate(size)
+	}
+
+	err := syscall.Fallocate(int(osFile.Fd()), 0, 0, size)
+	if errors.Is(err, syscall.EOPNOTSUPP) || errors.Is(err, syscall.ENOSYS) {
+		return file.Truncate(size)
+	}
+	return err
+}
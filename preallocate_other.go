@@ -0,0 +1,9 @@
+//go:build !linux
+
+package wal
+
+// preallocate extends the given file to the given size. The file may be sparse
+// on platforms where reserving the space is not supported.
+func preallocate(file File, size int64) error {
+	return file.Truncate(size)
+}
@@ -0,0 +1,426 @@
+package wal
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Reader iterates over the entries of the WAL in sequence number order. Unlike
+// ReadAll, entries are read lazily from the log segments, one at a time, so
+// that arbitrarily large logs can be streamed with constant memory.
+//
+// A Reader runs concurrently with the writers, without blocking them: it
+// returns the entries up to the last one visible when it was created (see
+// VisibleSequenceNumber), and never the records still being written after it.
+// The set of segments to read is fixed when the Reader is created. A Reader is
+// not safe for concurrent use.
+type Reader struct {
+	dir            *walDir
+	segmentIDs     []int  // Segments left to read after the current one.
+	fromSequenceNo uint64 // Entries before this sequence number are skipped.
+	lastSequenceNo uint64 // Entries after this sequence number are not read.
+	sequenceNo     uint64 // Last entry read.
+	startOffset    int64  // Offset to start reading the first segment from.
+	file           File
+	segment        *segmentReader
+	batch          batchAssembler
+	ready          []*WAL_Entry // Entries read but not yet returned by Next.
+	err            error
+	// Set for the Readers of Followers: at the end of the last segment, Next
+	// returns io.EOF without closing the segment, so that it can resume from
+	// there once more entries are written.
+	follow bool
+}
+
+// NewReader returns a Reader over all the entries of the WAL, starting from the
+// oldest log segment.
+func (wal *WAL) NewReader() (*Reader, error) {
+	return wal.NewReaderFromOffset(-1)
+}
+
+// NewReaderFromOffset returns a Reader over the entries of the WAL, starting
+// from the log segment with the given offset (Segment Index), inclusive.
+func (wal *WAL) NewReaderFromOffset(offset int) (*Reader, error) {
+	// Take the snapshot first, so that the segments it covers are all listed.
+	visible := wal.snapshot()
+	segmentIDs, err := listSegmentIDs(wal.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	for len(segmentIDs) > 0 && segmentIDs[0] < offset {
+		segmentIDs = segmentIDs[1:]
+	}
+
+	// Skip the entries removed by TruncateFront.
+	reader := &Reader{
+		dir:            wal.dir,
+		segmentIDs:     segmentIDs,
+		fromSequenceNo: visible.firstSequenceNo,
+		lastSequenceNo: visible.sequenceNo,
+	}
+
+	return reader, nil
+}
+
+// NewReaderFrom returns a Reader over the entries of the WAL, starting from the
+// entry with the given sequence number, inclusive. Returns
+// ErrSequenceNumberRemoved if the entry has already been removed from the log
+// (e.g. because its segment was deleted).
+func (wal *WAL) NewReaderFrom(sequenceNo uint64) (*Reader, error) {
+	visible := wal.snapshot()
+	if sequenceNo < visible.firstSequenceNo {
+		// Removed by TruncateFront.
+		return nil, ErrSequenceNumberRemoved
+	}
+	segmentIDs, err := listSegmentIDs(wal.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	// Find the last segment starting at or before the sequence number.
+	start := -1
+	startOffset := int64(0)
+	oldestSequenceNo := uint64(0)
+	for i := len(segmentIDs) - 1; i >= 0 && start < 0; i-- {
+		idx, err := wal.segmentIndex(segmentIDs[i])
+		if err != nil {
+			return nil, err
+		}
+		firstSequenceNo := idx.firstSequenceNo()
+		if firstSequenceNo == 0 {
+			// Empty segment.
+			continue
+		}
+		if firstSequenceNo <= sequenceNo {
+			start = i
+			startOffset = idx.lookup(sequenceNo)
+		}
+		oldestSequenceNo = firstSequenceNo
+	}
+
+	if start < 0 {
+		// Entries before the oldest one in the log have been removed, unless the
+		// log starts at the first sequence number.
+		if oldestSequenceNo > 1 {
+			return nil, ErrSequenceNumberRemoved
+		}
+		start = 0
+	}
+	segmentIDs = segmentIDs[start:]
+
+	reader := &Reader{
+		dir:            wal.dir,
+		segmentIDs:     segmentIDs,
+		fromSequenceNo: sequenceNo,
+		lastSequenceNo: visible.sequenceNo,
+		startOffset:    startOffset,
+	}
+
+	return reader, nil
+}
+
+// segmentIndex returns the sparse index of the given log segment.
+func (wal *WAL) segmentIndex(segmentID int) (*segmentIndex, error) {
+	if wal.readOnly {
+		// The index of the current segment is not maintained, since another
+		// process writes to it.
+		return loadSegmentIndex(wal.dir, segmentID)
+	}
+
+	visible := wal.snapshot()
+	if segmentID == visible.segmentID {
+		return &visible.index, nil
+	}
+	if segmentID > visible.segmentID {
+		// Created by a log rotation in progress, none of its entries are
+		// visible yet.
+		return &segmentIndex{}, nil
+	}
+
+	return loadSegmentIndex(wal.dir, segmentID)
+}
+
+// Next returns the next entry of the WAL. It returns io.EOF once all the
+// entries have been read, and a *CorruptRecordError if a record cannot be read
+// back. Entries of a batch that was torn by a crash are skipped. Once Next has
+// returned an error, it keeps returning the same error.
+func (r *Reader) Next() (*WAL_Entry, error) {
+	for len(r.ready) == 0 {
+		if r.err != nil {
+			return nil, r.err
+		}
+
+		if r.sequenceNo >= r.lastSequenceNo || r.fromSequenceNo > r.lastSequenceNo {
+			// The following records may still be being written.
+			r.err = io.EOF
+			continue
+		}
+
+		if r.segment == nil {
+			if len(r.segmentIDs) == 0 {
+				r.err = io.EOF
+				continue
+			}
+			if err := r.openSegment(r.segmentIDs[0]); err != nil {
+				r.err = err
+				continue
+			}
+			r.segmentIDs = r.segmentIDs[1:]
+		}
+
+		offset := r.segment.offset
+		entry, err := r.segment.next()
+		if r.follow && len(r.segmentIDs) == 0 && (err == io.EOF || r.segment.unfinished(err)) {
+			// Either the writer is still appending to the segment, or it was
+			// sealed by a log rotation in the meantime, in which case it is
+			// read again up to its end before moving on to the next one.
+			caughtUp, err := r.rewind(offset)
+			if err != nil {
+				r.err = err
+				continue
+			}
+			if caughtUp {
+				return nil, io.EOF
+			}
+			continue
+		}
+		if len(r.segmentIDs) == 0 && r.dir.tornTail(err) {
+			// The writer is still appending the last record.
+			err = io.EOF
+		}
+		if err == io.EOF {
+			// Batches never span segments, so a batch still pending at the end
+			// of a segment was torn.
+			r.batch = batchAssembler{}
+			err = r.closeSegment()
+		}
+		if err != nil {
+			r.err = err
+			continue
+		}
+		if entry != nil {
+			r.ready = r.batch.add(entry)
+			if len(r.ready) > 0 {
+				r.sequenceNo = r.ready[len(r.ready)-1].GetLogSequenceNumber()
+			}
+			for len(r.ready) > 0 && r.ready[0].GetLogSequenceNumber() < r.fromSequenceNo {
+				r.ready = r.ready[1:]
+			}
+		}
+	}
+
+	entry := r.ready[0]
+	r.ready = r.ready[1:]
+
+	return entry, nil
+}
+
+// Close releases the resources held by the Reader. Subsequent calls to Next
+// return ErrReaderClosed.
+func (r *Reader) Close() error {
+	r.err = ErrReaderClosed
+	r.ready = nil
+
+	return r.closeSegment()
+}
+
+// rewind moves the reader of the last segment back to the record at the given
+// offset, and looks for the segments created since by log rotations. Returns
+// true if there are none, i.e. the reader caught up with the writer.
+func (r *Reader) rewind(offset int64) (bool, error) {
+	segmentIDs, err := listSegmentIDs(r.dir)
+	if err != nil {
+		return false, err
+	}
+	for _, segmentID := range segmentIDs {
+		if segmentID > r.segment.segmentID {
+			r.segmentIDs = append(r.segmentIDs, segmentID)
+		}
+	}
+
+	if _, err := r.file.Seek(offset, io.SeekStart); err != nil {
+		return false, err
+	}
+	r.segment.reader.Reset(r.file)
+	r.segment.offset = offset
+
+	return len(r.segmentIDs) == 0, nil
+}
+
+func (r *Reader) openSegment(segmentID int) error {
+	file, err := r.dir.fs.OpenFile(segmentPath(r.dir, segmentID), os.O_RDONLY, 0644)
+	if errors.Is(err, os.ErrNotExist) {
+		// The segment was deleted since the Reader was created.
+		return fmt.Errorf("segment %d: %w", segmentID, ErrSequenceNumberRemoved)
+	}
+	if err != nil {
+		return err
+	}
+
+	segment, err := seekSegmentReader(file, segmentID, r.startOffset)
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	r.file = file
+	r.segment = segment
+	r.startOffset = 0
+
+	return nil
+}
+
+func (r *Reader) closeSegment() error {
+	if r.file == nil {
+		return nil
+	}
+
+	err := r.file.Close()
+	r.file = nil
+	r.segment = nil
+
+	return err
+}
+
+// segmentReader reads the records of a single log segment in order, keeping
+// track of the offset of each record.
+type segmentReader struct {
+	segmentID int
+	header    *segmentHeader // Nil for segments without a header.
+	reader    *bufio.Reader
+	offset    int64 // Offset of the next record in the segment file.
+	// Sequence number expected for the next record, zero if unknown.
+	nextSequenceNo uint64
+}
+
+// newSegmentReader returns a segmentReader over the given segment file, which
+// must be positioned at its start. The segment header is read and validated
+// right away.
+func newSegmentReader(file io.Reader, segmentID int) (*segmentReader, error) {
+	reader := &segmentReader{segmentID: segmentID, reader: bufio.NewReader(file)}
+
+	header, err := readSegmentHeader(reader.reader, segmentID)
+	if err != nil {
+		return nil, err
+	}
+	if header != nil {
+		reader.header = header
+		reader.offset = segmentHeaderSize
+		reader.nextSequenceNo = header.baseSequenceNo
+	}
+
+	return reader, nil
+}
+
+// seekSegmentReader returns a segmentReader over the given segment file,
+// positioned at the record starting at the given offset.
+func seekSegmentReader(file File, segmentID int, offset int64) (*segmentReader, error) {
+	reader, err := newSegmentReader(file, segmentID)
+	if err != nil || offset <= reader.offset {
+		return reader, err
+	}
+
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return nil, err
+	}
+	reader.reader.Reset(file)
+	reader.offset = offset
+	reader.nextSequenceNo = 0
+
+	return reader, nil
+}
+
+// next reads the next record of the segment and verifies its CRC. It returns
+// io.EOF if the end of the segment was reached, and a *CorruptRecordError if
+// the record at the current offset is incomplete or corrupted. If the record
+// was read in full but cannot be decoded or fails its CRC, the reader moves
+// past it, so that the following records can still be read. In a preallocated
+// segment, a corrupted record only followed by zeroes is incomplete instead: it
+// was torn by a crash before being entirely written over the zeroes.
+func (s *segmentReader) next() (*WAL_Entry, error) {
+	var size int32
+	if err := binary.Read(s.reader, binary.LittleEndian, &size); err != nil {
+		if err == io.EOF {
+			return nil, io.EOF
+		}
+		return nil, s.corruptRecordError(err)
+	}
+	if size == 0 && s.header.preallocated() {
+		// Entries are never empty, this is the unused space at the end of a
+		// preallocated segment.
+		return nil, io.EOF
+	}
+
+	data, err := readRecordData(s.reader, size)
+	if err != nil {
+		return nil, s.corruptRecordError(err)
+	}
+
+	entry, err := unmarshalAndVerifyEntry(data, s.header.formatVersion())
+	if err != nil && s.header.preallocated() {
+		zeroes, readErr := onlyZeroes(s.reader)
+		if readErr != nil {
+			return nil, readErr
+		}
+		if zeroes {
+			return nil, s.corruptRecordError(io.ErrUnexpectedEOF)
+		}
+	}
+	if err != nil {
+		// The record was read in full, so reading can resume with the next one.
+		err = s.corruptRecordError(err)
+		s.offset += int64(binary.Size(size)) + int64(size)
+		return nil, err
+	}
+
+	s.offset += int64(binary.Size(size)) + int64(size)
+	s.nextSequenceNo = entry.GetLogSequenceNumber() + 1
+
+	return entry, nil
+}
+
+// onlyZeroes returns true if the rest of the given reader only holds zeroes.
+func onlyZeroes(reader io.Reader) (bool, error) {
+	buf := make([]byte, 4096)
+	for {
+		n, err := reader.Read(buf)
+		for _, b := range buf[:n] {
+			if b != 0 {
+				return false, nil
+			}
+		}
+		if err == io.EOF {
+			return true, nil
+		}
+		if err != nil {
+			return false, err
+		}
+	}
+}
+
+// unfinished returns true if the given error, returned by next, may only mean
+// that the writer is still appending the record at the end of the segment:
+// either the record is incomplete, or, in a preallocated segment, it has not
+// been entirely written over the zeroes yet.
+func (s *segmentReader) unfinished(err error) bool {
+	return errors.Is(err, io.ErrUnexpectedEOF) || (s.header.preallocated() && errors.Is(err, ErrCorruptRecord))
+}
+
+// corruptRecordError wraps an error encountered while reading the record at the
+// current offset. I/O errors other than unexpected EOFs (torn records) are
+// returned as is.
+func (s *segmentReader) corruptRecordError(err error) error {
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != io.ErrUnexpectedEOF && !errors.Is(err, errCRCMismatch) && !errors.Is(err, errMalformedRecord) {
+		return err
+	}
+
+	return &CorruptRecordError{Segment: s.segmentID, Offset: s.offset, SequenceNo: s.nextSequenceNo, Err: err}
+}
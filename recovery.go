@@ -0,0 +1,235 @@
+package wal
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// RecoveryMode defines how corrupted or unwanted entries found in the log are
+// handled when opening the WAL.
+type RecoveryMode int
+
+const (
+	// RecoveryStrict fails to open the WAL if any of its segments holds a
+	// corrupted record. Every segment is scanned when opening the WAL. This is
+	// the behavior of OpenWAL.
+	RecoveryStrict RecoveryMode = iota
+	// RecoveryTolerateTornTail truncates an incomplete record at the end of the
+	// log, as left behind by a crash while writing it. Any other corruption, in
+	// any segment, still fails the open.
+	RecoveryTolerateTornTail
+	// RecoverySkipCorrupted drops the corrupted records of every segment. If a
+	// record is so damaged that the following ones cannot be located anymore,
+	// the rest of its segment is dropped as well.
+	RecoverySkipCorrupted
+	// RecoveryPointInTime discards all the entries following
+	// RecoveryPolicy.StopSequenceNo, so that the log ends at that sequence
+	// number. Segments that only hold discarded entries are quarantined, like
+	// RepairAll does. A corrupted record before the stop sequence number fails
+	// the open.
+	RecoveryPointInTime
+)
+
+// RecoveryPolicy configures the recovery performed when opening the WAL.
+type RecoveryPolicy struct {
+	Mode RecoveryMode
+	// StopSequenceNo is the sequence number of the last entry kept by
+	// RecoveryPointInTime. If it falls in the middle of a batch, the whole batch
+	// is discarded.
+	StopSequenceNo uint64
+}
+
+// ErrInvalidRecoveryMode is returned when opening the WAL with an unknown
+// recovery mode.
+var ErrInvalidRecoveryMode = errors.New("invalid recovery mode")
+
+// recoverSegments applies the given recovery policy to the segments of the log
+// in the given directory, before the WAL is opened.
+func recoverSegments(dir *walDir, policy RecoveryPolicy) error {
+	segmentIDs, err := listSegmentIDs(dir)
+	if err != nil || len(segmentIDs) == 0 {
+		return err
+	}
+
+	switch policy.Mode {
+	case RecoveryStrict:
+		// The last segment is scanned when opening it.
+		return checkSegments(dir, segmentIDs[:len(segmentIDs)-1])
+	case RecoveryTolerateTornTail:
+		if err := checkSegments(dir, segmentIDs[:len(segmentIDs)-1]); err != nil {
+			return err
+		}
+		return truncateTornTail(dir, segmentIDs[len(segmentIDs)-1])
+	case RecoverySkipCorrupted:
+		for _, segmentID := range segmentIDs {
+			if err := skipCorruptedRecords(dir, segmentID); err != nil {
+				return err
+			}
+		}
+		return nil
+	case RecoveryPointInTime:
+		return stopAtSequenceNo(dir, segmentIDs, policy.StopSequenceNo)
+	default:
+		return fmt.Errorf("%w: %d", ErrInvalidRecoveryMode, policy.Mode)
+	}
+}
+
+// checkSegments returns an error wrapping ErrCorruptRecord if any of the given
+// segments holds a corrupted record.
+func checkSegments(dir *walDir, segmentIDs []int) error {
+	for _, segmentID := range segmentIDs {
+		if _, err := scanSegment(dir, segmentID); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// truncateTornTail truncates the given segment before its last record if that
+// record is incomplete.
+func truncateTornTail(dir *walDir, segmentID int) error {
+	_, err := scanSegment(dir, segmentID)
+
+	var corruptErr *CorruptRecordError
+	if !errors.As(err, &corruptErr) || !errors.Is(corruptErr.Err, io.ErrUnexpectedEOF) {
+		return err
+	}
+
+	dir.logger.Printf("Truncating torn record at the end of the log: %v", err)
+	if err := truncateSegmentFile(dir, segmentID, corruptErr.Offset); err != nil {
+		return err
+	}
+
+	return removeSegmentIndex(dir, segmentID)
+}
+
+// skipCorruptedRecords rewrites the given segment without its corrupted
+// records, if it has any.
+func skipCorruptedRecords(dir *walDir, segmentID int) error {
+	file, err := dir.fs.OpenFile(segmentPath(dir, segmentID), os.O_RDONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	reader, err := newSegmentReader(file, segmentID)
+	if err != nil {
+		return err
+	}
+
+	var entries []*WAL_Entry
+	skipped := false
+
+	for {
+		offset := reader.offset
+		entry, err := reader.next()
+		if err == io.EOF {
+			break
+		}
+		if errors.Is(err, ErrCorruptRecord) {
+			dir.logger.Printf("Skipping corrupted record: %v", err)
+			skipped = true
+			if reader.offset > offset {
+				continue
+			}
+			// The end of the record is unknown, drop the rest of the segment.
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		entries = append(entries, entry)
+	}
+
+	if !skipped {
+		return nil
+	}
+
+	if err := replaceSegmentFile(dir, segmentID, reader.header, entries); err != nil {
+		return err
+	}
+
+	return removeSegmentIndex(dir, segmentID)
+}
+
+// stopAtSequenceNo truncates the log right after the entry with the given
+// sequence number, and quarantines the segments following it. They are
+// quarantined newest first, and before the truncation, so that a crash midway
+// never leaves a log with a hole.
+func stopAtSequenceNo(dir *walDir, segmentIDs []int, stopSequenceNo uint64) error {
+	for i, segmentID := range segmentIDs {
+		truncateAt, err := findStopOffset(dir, segmentID, stopSequenceNo, i == 0)
+		if err != nil {
+			return err
+		}
+		if truncateAt < 0 {
+			continue
+		}
+
+		quarantineSuffix := newQuarantineSuffix()
+		for j := len(segmentIDs) - 1; j > i; j-- {
+			if _, err := quarantineSegment(dir, segmentIDs[j], quarantineSuffix); err != nil {
+				return err
+			}
+		}
+
+		// The index would point past the end of the truncated segment.
+		if err := removeSegmentIndex(dir, segmentID); err != nil {
+			return err
+		}
+		return truncateSegmentFile(dir, segmentID, truncateAt)
+	}
+
+	return nil
+}
+
+// findStopOffset returns the offset of the first unit (entry or batch) of the
+// given segment holding an entry after the given sequence number, or -1 if
+// there is none. Returns ErrSequenceNumberRemoved if the segment is the oldest
+// one of the log and starts after that sequence number.
+func findStopOffset(dir *walDir, segmentID int, stopSequenceNo uint64, oldest bool) (int64, error) {
+	file, err := dir.fs.OpenFile(segmentPath(dir, segmentID), os.O_RDONLY, 0644)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	reader, err := newSegmentReader(file, segmentID)
+	if err != nil {
+		return 0, err
+	}
+
+	var batch batchAssembler
+	var unitStart int64
+
+	for {
+		offset := reader.offset
+		entry, err := reader.next()
+		if err == io.EOF {
+			return -1, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+
+		if !batch.incomplete() {
+			unitStart = offset
+		}
+
+		complete := batch.add(entry)
+		if len(complete) == 0 || complete[len(complete)-1].GetLogSequenceNumber() <= stopSequenceNo {
+			continue
+		}
+
+		if oldest && unitStart == reader.header.size() &&
+			complete[0].GetLogSequenceNumber() > stopSequenceNo+1 {
+			return 0, ErrSequenceNumberRemoved
+		}
+
+		return unitStart, nil
+	}
+}
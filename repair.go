@@ -0,0 +1,274 @@
+package wal
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// RepairReport describes what RepairAll kept and discarded.
+type RepairReport struct {
+	// KeptSegments lists the segments that were kept, in order. The last one
+	// may have been truncated.
+	KeptSegments []int
+	// LastSequenceNo is the sequence number of the last entry kept.
+	LastSequenceNo uint64
+	// Corruption is the first corrupted record found, nil if there was none.
+	Corruption *CorruptRecordError
+	// TruncatedBytes is the number of bytes cut off the end of the kept
+	// segments, either because they were corrupted or because they held a batch
+	// torn by a crash.
+	TruncatedBytes int64
+	// QuarantinedSegments maps each segment following the corrupted one to the
+	// path it was moved to.
+	QuarantinedSegments map[int]string
+}
+
+// RepairAll repairs the WAL while it is open for writing (see
+// RepairDirectory). The buffered entries are written out first, so that they
+// are repaired too, and the following entries are appended right after the
+// last entry kept. Writers still waiting for the discarded entries to become
+// durable fail with ErrSequenceNumberRemoved, as do the subscriptions in
+// SubscribeWritten mode that already delivered some of them. Returns
+// ErrReadOnly if the WAL is read-only, and ErrClosed if it is closed.
+func (wal *WAL) RepairAll() (*RepairReport, error) {
+	if wal.readOnly {
+		return nil, ErrReadOnly
+	}
+
+	wal.lock.Lock()
+	defer wal.lock.Unlock()
+
+	if wal.isClosed() {
+		return nil, ErrClosed
+	}
+	if err := wal.flushBuffer(); err != nil {
+		return nil, err
+	}
+
+	lastSequenceNo := wal.lastSequenceNo
+	var report *RepairReport
+	wal.syncLock.Lock()
+	err := wal.currentSegment.Close()
+	wal.syncLock.Unlock()
+	if err == nil {
+		report, err = repairDirectory(wal.dir)
+	}
+	// Reopen the last segment kept even if the repair failed midway, so that
+	// the WAL remains usable.
+	if reopenErr := wal.reopenLastSegment(); err == nil {
+		err = reopenErr
+	}
+	wal.discardRemovedEntries(lastSequenceNo)
+
+	return report, err
+}
+
+// discardRemovedEntries fails the writers and the subscriptions waiting for the
+// entries after the last one left in the log, if the log used to end at the
+// given sequence number, e.g. once it has been repaired or truncated and
+// reopened. Must be called with the lock held.
+func (wal *WAL) discardRemovedEntries(lastSequenceNo uint64) {
+	if wal.lastSequenceNo >= lastSequenceNo {
+		return
+	}
+
+	wal.syncLock.Lock()
+	wal.discardDurability(wal.lastSequenceNo)
+	wal.syncLock.Unlock()
+	wal.truncateSubscribers(wal.lastSequenceNo)
+}
+
+// RepairDirectory repairs the WAL in the given directory, which must not be
+// open. Unlike Repair, which only looks at the last segment, it scans every
+// segment in order until it finds the first corrupted record. The segment
+// containing it is truncated right before that record, and all the following
+// segments are assumed to be corrupted as well: they are quarantined by
+// renaming them (they are never deleted), so that they can be inspected
+// manually. Batches torn by a crash at the end of a segment are cut off too.
+// The options must match the ones the WAL was opened with (e.g. its segment
+// prefix). Returns an error wrapping ErrLocked if the WAL is open for writing.
+func RepairDirectory(directory string, opts ...Option) (*RepairReport, error) {
+	options, err := buildOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+	if options.ReadOnly {
+		return nil, ErrReadOnly
+	}
+	dir := newWalDir(directory, &options)
+
+	dirLock, err := dir.fs.Lock(lockPath(dir), options.FilePerm)
+	if err != nil {
+		return nil, err
+	}
+	defer dirLock.Close()
+
+	return repairDirectory(dir)
+}
+
+func repairDirectory(dir *walDir) (*RepairReport, error) {
+	segmentIDs, err := listSegmentIDs(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &RepairReport{QuarantinedSegments: make(map[int]string)}
+
+	for i, segmentID := range segmentIDs {
+		truncateAt, size, err := scanSegmentForRepair(dir, segmentID, report)
+		if err != nil {
+			return report, err
+		}
+		report.KeptSegments = append(report.KeptSegments, segmentID)
+
+		// The following segments are quarantined newest first, and before the
+		// corrupted one is truncated, so that a crash midway never leaves a log
+		// with a hole, which the next repair would keep.
+		if report.Corruption != nil {
+			quarantineSuffix := newQuarantineSuffix()
+			for j := len(segmentIDs) - 1; j > i; j-- {
+				quarantinedPath, err := quarantineSegment(dir, segmentIDs[j], quarantineSuffix)
+				if err != nil {
+					return report, err
+				}
+				report.QuarantinedSegments[segmentIDs[j]] = quarantinedPath
+			}
+		}
+
+		if truncateAt >= 0 {
+			// The index would point past the end of the truncated segment.
+			if err := removeSegmentIndex(dir, segmentID); err != nil {
+				return report, err
+			}
+			if err := truncateSegmentFile(dir, segmentID, truncateAt); err != nil {
+				return report, err
+			}
+			report.TruncatedBytes += size - truncateAt
+		}
+
+		if report.Corruption != nil {
+			break
+		}
+	}
+
+	return report, nil
+}
+
+// scanSegmentForRepair scans the given segment and updates the report
+// accordingly. Returns the offset the segment must be truncated at, i.e. its
+// first corrupted record or torn batch, or -1 if it is intact, along with its
+// size.
+func scanSegmentForRepair(dir *walDir, segmentID int, report *RepairReport) (int64, int64, error) {
+	file, err := dir.fs.OpenFile(segmentPath(dir, segmentID), os.O_RDONLY, 0644)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer file.Close()
+
+	fileInfo, err := file.Stat()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var batch batchAssembler
+	var batchStart int64
+	truncateAt := int64(-1)
+
+	reader, err := newSegmentReader(file, segmentID)
+	for err == nil {
+		offset := reader.offset
+		var entry *WAL_Entry
+		if entry, err = reader.next(); err != nil {
+			break
+		}
+
+		if !batch.incomplete() {
+			batchStart = offset
+		}
+		for _, entry := range batch.add(entry) {
+			report.LastSequenceNo = entry.GetLogSequenceNumber()
+		}
+	}
+
+	var corruptErr *CorruptRecordError
+	switch {
+	case errors.As(err, &corruptErr):
+		report.Corruption = corruptErr
+		truncateAt = corruptErr.Offset
+		if batch.incomplete() {
+			truncateAt = batchStart
+		}
+	case err == io.EOF:
+		if batch.incomplete() {
+			truncateAt = batchStart
+		}
+	default:
+		return 0, 0, err
+	}
+
+	return truncateAt, fileInfo.Size(), nil
+}
+
+// newQuarantineSuffix returns the suffix appended to the names of the segments
+// quarantined by a single repair or recovery.
+func newQuarantineSuffix() string {
+	return fmt.Sprintf(".quarantined-%d", time.Now().UnixNano())
+}
+
+// quarantineSegment moves the given segment aside by appending the given suffix
+// to its name, so that it is no longer part of the log but can still be
+// inspected. Its index is removed. Returns the new path of the segment.
+func quarantineSegment(dir *walDir, segmentID int, suffix string) (string, error) {
+	quarantinedPath := segmentPath(dir, segmentID) + suffix
+	if err := dir.fs.Rename(segmentPath(dir, segmentID), quarantinedPath); err != nil {
+		return "", err
+	}
+
+	if err := removeSegmentIndex(dir, segmentID); err != nil {
+		return "", err
+	}
+
+	return quarantinedPath, dir.syncDir()
+}
+
+// truncateSegmentFile atomically truncates the given segment file to the given
+// size, by copying the part to keep to a temporary file and renaming it. The
+// copy and the directory are fsynced even if fsync is disabled.
+func truncateSegmentFile(dir *walDir, segmentID int, size int64) error {
+	filePath := segmentPath(dir, segmentID)
+	file, err := dir.fs.OpenFile(filePath, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	tempFilePath := fmt.Sprintf("%s.tmp", filePath)
+	tempFile, err := dir.fs.OpenFile(tempFilePath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, dir.filePerm)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.CopyN(tempFile, file, size); err != nil {
+		tempFile.Close()
+		return err
+	}
+	// The entries kept may have been made durable by WaitDurable, even if fsync
+	// is disabled, so the copy and its directory entry always are.
+	if err := tempFile.Sync(); err != nil {
+		tempFile.Close()
+		return err
+	}
+
+	if err := tempFile.Close(); err != nil {
+		return err
+	}
+
+	if err := dir.fs.Rename(tempFilePath, filePath); err != nil {
+		return err
+	}
+
+	return dir.fs.SyncDir(dir.path)
+}
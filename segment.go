@@ -0,0 +1,160 @@
+package wal
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"time"
+)
+
+// Segment files start with a fixed size header:
+//
+//	magic (4 bytes) | version (2) | flags (2) | base sequence number (8) |
+//	creation time (8) | reserved (4) | header CRC (4)
+//
+// followed by the length-prefixed records. All integers are little endian.
+// Segments written before the header was introduced (format version 0) start
+// directly with the first record, and are still readable.
+const (
+	segmentHeaderSize = 32
+
+	// Segments without a header.
+	formatVersionHeaderless = 0
+	// Segments with a header, using the original CRC rule (see computeCRC).
+	formatVersionHeader = 1
+	// Segments whose entries are checksummed with CRC32C (see computeCRC).
+	formatVersionCRC32C = 2
+
+	// Format version of the segments created by this version of the WAL.
+	segmentFormatVersion = formatVersionCRC32C
+
+	segmentFlagsNone = 0
+	// The segment file was extended up front (see Options.Preallocate): its
+	// records are followed by zeros.
+	segmentFlagPreallocated = 1 << 0
+	// Flags understood by this version of the WAL. No codec or compression
+	// flags are defined yet.
+	segmentFlagsKnown = segmentFlagPreallocated
+)
+
+var segmentMagic = [4]byte{'G', 'W', 'A', 'L'}
+
+// segmentHeader describes the format and contents of a log segment.
+type segmentHeader struct {
+	version        uint16
+	flags          uint16
+	baseSequenceNo uint64 // Sequence number of the first entry of the segment.
+	createdAt      time.Time
+}
+
+func newSegmentHeader(baseSequenceNo uint64) *segmentHeader {
+	return &segmentHeader{
+		version:        segmentFormatVersion,
+		flags:          segmentFlagsNone,
+		baseSequenceNo: baseSequenceNo,
+		createdAt:      time.Now(),
+	}
+}
+
+// formatVersion returns the format version of a segment given its header,
+// which is nil for segments written without one.
+func (h *segmentHeader) formatVersion() uint16 {
+	if h == nil {
+		return formatVersionHeaderless
+	}
+	return h.version
+}
+
+// preallocated returns true if the segment file was preallocated.
+func (h *segmentHeader) preallocated() bool {
+	return h != nil && h.flags&segmentFlagPreallocated != 0
+}
+
+// size returns the size of the header in the segment file.
+func (h *segmentHeader) size() int64 {
+	if h == nil {
+		return 0
+	}
+	return segmentHeaderSize
+}
+
+func (h *segmentHeader) encode() []byte {
+	buf := make([]byte, 0, segmentHeaderSize)
+	buf = append(buf, segmentMagic[:]...)
+	buf = binary.LittleEndian.AppendUint16(buf, h.version)
+	buf = binary.LittleEndian.AppendUint16(buf, h.flags)
+	buf = binary.LittleEndian.AppendUint64(buf, h.baseSequenceNo)
+	buf = binary.LittleEndian.AppendUint64(buf, uint64(h.createdAt.UnixNano()))
+	buf = binary.LittleEndian.AppendUint32(buf, 0) // Reserved.
+	buf = binary.LittleEndian.AppendUint32(buf, crc32.ChecksumIEEE(buf))
+
+	return buf
+}
+
+// writeSegmentHeader writes the header of a segment file. A nil header (format
+// version 0) writes nothing.
+func writeSegmentHeader(writer io.Writer, header *segmentHeader) error {
+	if header == nil {
+		return nil
+	}
+	_, err := writer.Write(header.encode())
+
+	return err
+}
+
+// readSegmentHeaderFromFile reads the header of the given log segment.
+func readSegmentHeaderFromFile(dir *walDir, segmentID int) (*segmentHeader, error) {
+	file, err := dir.fs.OpenFile(segmentPath(dir, segmentID), os.O_RDONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return readSegmentHeader(bufio.NewReader(file), segmentID)
+}
+
+// readSegmentHeader reads and validates the header at the start of a segment
+// file. It returns a nil header for segments without one (format version 0).
+func readSegmentHeader(reader *bufio.Reader, segmentID int) (*segmentHeader, error) {
+	magic, err := reader.Peek(len(segmentMagic))
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if !bytes.Equal(magic, segmentMagic[:]) {
+		// The segment starts directly with a record (or is empty).
+		return nil, nil
+	}
+
+	buf := make([]byte, segmentHeaderSize)
+	if _, err := io.ReadFull(reader, buf); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, &CorruptRecordError{Segment: segmentID, Err: fmt.Errorf("torn segment header: %w", err)}
+	}
+
+	if crc32.ChecksumIEEE(buf[:segmentHeaderSize-4]) != binary.LittleEndian.Uint32(buf[segmentHeaderSize-4:]) {
+		return nil, &CorruptRecordError{Segment: segmentID, Err: fmt.Errorf("invalid segment header: %w", errCRCMismatch)}
+	}
+
+	header := &segmentHeader{
+		version:        binary.LittleEndian.Uint16(buf[4:]),
+		flags:          binary.LittleEndian.Uint16(buf[6:]),
+		baseSequenceNo: binary.LittleEndian.Uint64(buf[8:]),
+		createdAt:      time.Unix(0, int64(binary.LittleEndian.Uint64(buf[16:]))),
+	}
+
+	if header.version == formatVersionHeaderless || header.version > segmentFormatVersion {
+		return nil, fmt.Errorf("%w: segment %d has format version %d, latest supported is %d",
+			ErrUnsupportedFormat, segmentID, header.version, segmentFormatVersion)
+	}
+	if header.flags&^segmentFlagsKnown != 0 {
+		return nil, fmt.Errorf("%w: segment %d has unknown flags %#x", ErrUnsupportedFormat, segmentID, header.flags)
+	}
+
+	return header, nil
+}
@@ -0,0 +1,485 @@
+package wal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync/atomic"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// SubscribeMode selects when the entries of the WAL are delivered to a
+// subscriber.
+type SubscribeMode int
+
+const (
+	// SubscribeWritten delivers the entries as soon as they are written, before
+	// they are flushed or fsynced, so they may still be lost by a crash.
+	SubscribeWritten SubscribeMode = iota
+	// SubscribeDurable delivers the entries once they have been fsynced (see
+	// WaitDurable). If fsync is disabled, entries only become durable once a
+	// writer waits for them.
+	SubscribeDurable
+)
+
+// SlowConsumerPolicy selects what happens when a subscriber in SubscribeWritten
+// mode does not keep up with the writers.
+type SlowConsumerPolicy int
+
+const (
+	// SlowConsumerResync stops buffering entries for the subscriber once its
+	// buffer is full. The subscriber then catches up by reading the entries it
+	// missed from the log, and goes back to receiving them as they are written.
+	// Writers are never slowed down.
+	SlowConsumerResync SlowConsumerPolicy = iota
+	// SlowConsumerBlock makes the writers wait for the subscriber once its
+	// buffer is full, slowing them down to its pace. They wait once they have
+	// released the lock of the WAL, so that the other operations (e.g. reads,
+	// Sync or Close) are not held up.
+	SlowConsumerBlock
+)
+
+// SubscribeOptions configures a subscription created with Subscribe.
+type SubscribeOptions struct {
+	// Mode selects when the entries are delivered.
+	Mode SubscribeMode
+	// BufferSize is the number of written entries buffered for a subscriber in
+	// SubscribeWritten mode.
+	BufferSize int
+	// SlowConsumer selects what happens when the buffer of a subscriber in
+	// SubscribeWritten mode is full.
+	SlowConsumer SlowConsumerPolicy
+	// OnError, if set, is called with the error that ended the subscription,
+	// right before its channel is closed: ErrClosed if the WAL was closed,
+	// ErrSequenceNumberRemoved if the entries to deliver were removed from the
+	// log, or the error that prevented reading them. It is not called when the
+	// subscription is cancelled.
+	OnError func(error)
+}
+
+// SubscribeOption configures the SubscribeOptions of a subscription.
+type SubscribeOption func(*SubscribeOptions)
+
+// WithSubscribeMode selects when the entries are delivered.
+func WithSubscribeMode(mode SubscribeMode) SubscribeOption {
+	return func(o *SubscribeOptions) { o.Mode = mode }
+}
+
+// WithSubscribeBufferSize sets the number of written entries buffered for the
+// subscriber.
+func WithSubscribeBufferSize(bufferSize int) SubscribeOption {
+	return func(o *SubscribeOptions) { o.BufferSize = bufferSize }
+}
+
+// WithSlowConsumerPolicy selects what happens when the buffer of the subscriber
+// is full.
+func WithSlowConsumerPolicy(policy SlowConsumerPolicy) SubscribeOption {
+	return func(o *SubscribeOptions) { o.SlowConsumer = policy }
+}
+
+// WithSubscribeErrorHandler sets the function called with the error that ended
+// the subscription.
+func WithSubscribeErrorHandler(onError func(error)) SubscribeOption {
+	return func(o *SubscribeOptions) { o.OnError = onError }
+}
+
+// validate returns an error wrapping ErrInvalidOption if the options are
+// invalid.
+func (o *SubscribeOptions) validate() error {
+	switch {
+	case o.Mode != SubscribeWritten && o.Mode != SubscribeDurable:
+		return fmt.Errorf("%w: invalid subscribe mode %d", ErrInvalidOption, o.Mode)
+	case o.BufferSize <= 0:
+		return fmt.Errorf("%w: BufferSize must be positive, got %d", ErrInvalidOption, o.BufferSize)
+	case o.SlowConsumer != SlowConsumerResync && o.SlowConsumer != SlowConsumerBlock:
+		return fmt.Errorf("%w: invalid slow consumer policy %d", ErrInvalidOption, o.SlowConsumer)
+	}
+
+	return nil
+}
+
+// Subscribe delivers the entries of the WAL on the returned channel, starting
+// from the entry with the given sequence number, inclusive, which may not have
+// been written yet. The entries already in the log are read from it first, then
+// the new ones are delivered as they are written (or once they are durable, see
+// SubscribeMode). Entries are delivered in order, exactly once, unless the
+// subscription ends.
+//
+// Calling the returned function cancels the subscription. The channel is closed
+// once the subscription ends, either because it was cancelled, or because of
+// the error passed to SubscribeOptions.OnError (e.g. ErrClosed once the WAL is
+// closed; the entries not received by then can be read from the log). Invalid
+// options are reported the same way, with an error wrapping ErrInvalidOption.
+//
+// Subscribers of a read-only WAL receive the entries written by the other
+// process as they are flushed, and cannot use SubscribeDurable.
+func (wal *WAL) Subscribe(fromSequenceNo uint64, opts ...SubscribeOption) (<-chan *WAL_Entry, func()) {
+	options := SubscribeOptions{Mode: SubscribeWritten, BufferSize: 256, SlowConsumer: SlowConsumerResync}
+	for _, opt := range opts {
+		opt(&options)
+	}
+
+	ctx, cancel := context.WithCancel(wal.ctx)
+	s := &subscriber{
+		wal:     wal,
+		options: options,
+		entries: make(chan *WAL_Entry),
+		ctx:     ctx,
+		cancel:  cancel,
+		next:    max(fromSequenceNo, 1),
+	}
+
+	err := options.validate()
+	if err == nil && options.Mode == SubscribeDurable && wal.readOnly {
+		err = fmt.Errorf("%w: cannot subscribe to durable entries", ErrReadOnly)
+	}
+	if err == nil && options.Mode == SubscribeWritten && !wal.readOnly {
+		s.queue = make(chan publishedEntry, options.BufferSize)
+		s.resync = make(chan struct{}, 1)
+
+		wal.lock.Lock()
+		// Entries already written are read from the log first.
+		s.lagging = true
+		wal.subscribers[s] = struct{}{}
+		wal.lock.Unlock()
+	}
+
+	go s.run(err)
+
+	return s.entries, func() {
+		s.cancelled.Store(true)
+		cancel()
+	}
+}
+
+// subscriber delivers the entries of the WAL to a subscription.
+type subscriber struct {
+	wal       *WAL
+	options   SubscribeOptions
+	entries   chan *WAL_Entry // Returned by Subscribe.
+	ctx       context.Context // Done once the subscription ends.
+	cancel    context.CancelFunc
+	cancelled atomic.Bool // Set if the subscription was cancelled.
+	next      uint64      // Sequence number of the next entry to deliver.
+
+	// Only set in SubscribeWritten mode, for WALs opened for writing.
+	queue   chan publishedEntry // Entries published by the writers.
+	resync  chan struct{}       // Signaled when the subscriber starts lagging.
+	lagging bool                // Entries are not published if set. Guarded by the WAL lock.
+	// First entry removed by TruncateBack since the last catch up, 0 if none.
+	// Guarded by the WAL lock.
+	removedFrom uint64
+	// Number of calls to TruncateBack since the subscription was created.
+	// Guarded by the WAL lock.
+	truncations uint64
+	// Value of truncations as of the last catch up. Only used by run.
+	caughtUpTruncations uint64
+}
+
+// publishedEntry is an entry published to a subscriber, along with the number
+// of calls to TruncateBack the subscriber had seen when it was written.
+type publishedEntry struct {
+	entry       *WAL_Entry
+	truncations uint64
+}
+
+// blockedPublish holds the entries that a subscriber with the SlowConsumerBlock
+// policy could not take yet when they were published.
+type blockedPublish struct {
+	subscriber  *subscriber
+	entries     []*WAL_Entry
+	truncations uint64
+}
+
+// run delivers the entries until the subscription ends, and then reports the
+// error that ended it, if any.
+func (s *subscriber) run(err error) {
+	defer close(s.entries)
+
+	if err == nil {
+		switch {
+		case s.options.Mode == SubscribeDurable:
+			err = s.deliverDurable()
+		case s.wal.readOnly:
+			err = s.deliverFlushed()
+		default:
+			err = s.deliverWritten()
+		}
+	}
+
+	// Also releases the writers blocked on the subscriber.
+	s.cancel()
+	if s.queue != nil {
+		s.wal.lock.Lock()
+		delete(s.wal.subscribers, s)
+		s.wal.lock.Unlock()
+	}
+
+	if s.cancelled.Load() {
+		return
+	}
+	if errors.Is(err, context.Canceled) {
+		// The context of the WAL is cancelled when it is closed.
+		err = ErrClosed
+	}
+	if s.options.OnError != nil {
+		s.options.OnError(err)
+	}
+}
+
+// send delivers the given entry.
+func (s *subscriber) send(entry *WAL_Entry) error {
+	select {
+	case s.entries <- entry:
+		s.next = entry.GetLogSequenceNumber() + 1
+		return nil
+	case <-s.ctx.Done():
+		return s.ctx.Err()
+	}
+}
+
+// deliverWritten delivers the entries as they are written, reading them from
+// the log whenever the subscriber lags behind.
+func (s *subscriber) deliverWritten() error {
+	for {
+		if err := s.catchUp(); err != nil {
+			return err
+		}
+		if err := s.deliverPublished(); err != nil {
+			return err
+		}
+	}
+}
+
+// catchUp delivers the entries written so far from the log, and stops the
+// subscriber from lagging so that the following ones are published to it.
+func (s *subscriber) catchUp() error {
+	wal := s.wal
+
+	wal.lock.Lock()
+	if wal.isClosed() {
+		wal.lock.Unlock()
+		return ErrClosed
+	}
+	if s.removedFrom > 0 {
+		if s.next > s.removedFrom {
+			wal.lock.Unlock()
+			return fmt.Errorf("entry %d: %w", s.removedFrom, ErrSequenceNumberRemoved)
+		}
+		// Drop the removed entries published before the truncation.
+		for len(s.queue) > 0 {
+			<-s.queue
+		}
+		s.removedFrom = 0
+	}
+	s.caughtUpTruncations = s.truncations
+	// Make the entries written so far readable from the log.
+	err := wal.flushBuffer()
+	lastSequenceNo := wal.lastSequenceNo
+	s.lagging = false
+	wal.lock.Unlock()
+
+	if err != nil || s.next > lastSequenceNo {
+		return err
+	}
+
+	reader, err := wal.NewReaderFrom(s.next)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	for s.next <= lastSequenceNo {
+		entry, err := reader.Next()
+		if err == io.EOF {
+			return fmt.Errorf("entry %d not found: %w", s.next, ErrSequenceNumberRemoved)
+		}
+		if err != nil {
+			return err
+		}
+		if err := s.send(entry); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// deliverPublished delivers the entries published by the writers, until the
+// subscriber lags behind.
+func (s *subscriber) deliverPublished() error {
+	for {
+		select {
+		case published := <-s.queue:
+			if published.truncations != s.caughtUpTruncations {
+				// Published before a truncation, the entry may have been
+				// removed since.
+				continue
+			}
+			entry := published.entry
+			sequenceNo := entry.GetLogSequenceNumber()
+			if sequenceNo < s.next {
+				// Already read from the log.
+				continue
+			}
+			if sequenceNo > s.next {
+				// Entries were missed, read them from the log.
+				return nil
+			}
+			if err := s.send(entry); err != nil {
+				return err
+			}
+
+		case <-s.resync:
+			return nil
+
+		case <-s.ctx.Done():
+			return s.ctx.Err()
+		}
+	}
+}
+
+// deliverDurable delivers the entries once they are durable, reading them from
+// the log.
+func (s *subscriber) deliverDurable() error {
+	follower, err := s.wal.Follow(s.next)
+	if err != nil {
+		return err
+	}
+	defer follower.Close()
+
+	for {
+		durable := s.wal.durable.wait()
+		durableSequenceNo := s.wal.durableSequenceNumber()
+
+		for s.next <= durableSequenceNo {
+			entry, err := follower.Next(s.ctx)
+			if err != nil {
+				return err
+			}
+			if err := s.send(entry); err != nil {
+				return err
+			}
+		}
+
+		select {
+		case <-durable:
+		case <-s.ctx.Done():
+			return s.ctx.Err()
+		}
+	}
+}
+
+// deliverFlushed delivers the entries of a read-only WAL once they are flushed
+// by the writer.
+func (s *subscriber) deliverFlushed() error {
+	follower, err := s.wal.Follow(s.next)
+	if err != nil {
+		return err
+	}
+	defer follower.Close()
+
+	for {
+		entry, err := follower.Next(s.ctx)
+		if err != nil {
+			return err
+		}
+		if err := s.send(entry); err != nil {
+			return err
+		}
+	}
+}
+
+// push hands the given entry to the subscriber if its buffer is not full.
+// Returns false otherwise. Must be called with the lock held.
+func (s *subscriber) push(entry *WAL_Entry) bool {
+	select {
+	case s.queue <- publishedEntry{entry: entry, truncations: s.truncations}:
+		return true
+	default:
+		return false
+	}
+}
+
+// truncateSubscribers makes the subscribers in SubscribeWritten mode catch up
+// with the log once the entries after the given sequence number are removed by
+// TruncateBack. Must be called with the lock held.
+func (wal *WAL) truncateSubscribers(sequenceNo uint64) {
+	for s := range wal.subscribers {
+		s.lagging = true
+		s.truncations++
+		if s.removedFrom == 0 || s.removedFrom > sequenceNo+1 {
+			s.removedFrom = sequenceNo + 1
+		}
+		select {
+		case s.resync <- struct{}{}:
+		default:
+			// Already signaled.
+		}
+	}
+}
+
+// publish hands the given entries, which were just written, to the subscribers
+// in SubscribeWritten mode. The entries that the subscribers with the
+// SlowConsumerBlock policy cannot take yet are returned, for the writer to hand
+// them over with waitForSubscribers once it has released the lock. Must be
+// called with the lock held.
+func (wal *WAL) publish(entries ...*WAL_Entry) []blockedPublish {
+	if len(wal.subscribers) == 0 {
+		return nil
+	}
+
+	// The callers may reuse their data once the entries are written.
+	published := make([]*WAL_Entry, len(entries))
+	for i, entry := range entries {
+		published[i] = proto.Clone(entry).(*WAL_Entry)
+	}
+
+	var blocked []blockedPublish
+	for s := range wal.subscribers {
+		if s.lagging {
+			continue
+		}
+
+		for i, entry := range published {
+			if s.push(entry) {
+				continue
+			}
+
+			if s.options.SlowConsumer == SlowConsumerBlock {
+				blocked = append(blocked, blockedPublish{
+					subscriber: s, entries: published[i:], truncations: s.truncations,
+				})
+				break
+			}
+			// The subscriber reads the entries it missed from the log.
+			s.lagging = true
+			select {
+			case s.resync <- struct{}{}:
+			default:
+				// Already signaled.
+			}
+			break
+		}
+	}
+
+	return blocked
+}
+
+// waitForSubscribers hands the given entries over to the subscribers that could
+// not take them when they were published, waiting for them to make room. Must
+// be called without the lock held, so that only the writer of the entries
+// waits. Entries handed over after others written later are read from the log
+// by the subscriber instead.
+func waitForSubscribers(blocked []blockedPublish) {
+	for _, b := range blocked {
+		for _, entry := range b.entries {
+			select {
+			case b.subscriber.queue <- publishedEntry{entry: entry, truncations: b.truncations}:
+			case <-b.subscriber.ctx.Done():
+			}
+		}
+	}
+}
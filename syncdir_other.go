@@ -0,0 +1,20 @@
+//go:build !windows
+
+package wal
+
+import "os"
+
+// syncDir fsyncs the given directory.
+func syncDir(name string) error {
+	dir, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+
+	if err := dir.Sync(); err != nil {
+		dir.Close()
+		return err
+	}
+
+	return dir.Close()
+}
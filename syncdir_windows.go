@@ -0,0 +1,9 @@
+//go:build windows
+
+package wal
+
+// syncDir is a no-op on Windows, where directories cannot be fsynced and
+// metadata changes are journaled by NTFS.
+func syncDir(name string) error {
+	return nil
+}
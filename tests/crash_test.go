@@ -0,0 +1,665 @@
+package tests
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/JyotinderSingh/go-wal"
+)
+
+// Crash-consistency tests: a workload runs on top of a crashRecorder, which
+// records every operation issued to the file system. Every prefix of the
+// recorded operations is then turned into the state the disk could be left in
+// by a power cut at that point, and the WAL must recover every acknowledged
+// entry from it.
+
+type crashOpKind int
+
+const (
+	crashOpMkdir crashOpKind = iota
+	crashOpCreate
+	crashOpWrite
+	crashOpTruncate
+	crashOpSync
+	crashOpRename
+	crashOpRemove
+	crashOpSyncDir
+)
+
+// crashOp is a file system operation recorded by a crashRecorder.
+type crashOp struct {
+	kind    crashOpKind
+	path    string // Path of the file or directory, source of a rename.
+	newPath string // Destination of a rename.
+	inode   int    // File the operation applies to.
+	offset  int64  // Offset of a write.
+	data    []byte // Data of a write.
+	size    int64  // Size of a truncation.
+}
+
+// crashRecorder is a wal.FS recording the operations issued to the underlying
+// MemFS. Files are identified by inodes, so that their history follows them
+// through renames.
+type crashRecorder struct {
+	fs        wal.FS
+	lock      sync.Mutex
+	ops       []crashOp
+	inodes    map[string]int
+	nextInode int
+}
+
+func newCrashRecorder() *crashRecorder {
+	return &crashRecorder{fs: wal.NewMemFS(), inodes: make(map[string]int)}
+}
+
+// count returns the number of operations recorded so far.
+func (r *crashRecorder) count() int {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return len(r.ops)
+}
+
+func (r *crashRecorder) OpenFile(name string, flag int, perm os.FileMode) (wal.File, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	name = filepath.Clean(name)
+	file, err := r.fs.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+
+	inode, ok := r.inodes[name]
+	writable := flag&(os.O_WRONLY|os.O_RDWR) != 0
+	switch {
+	case !ok:
+		inode = r.nextInode
+		r.nextInode++
+		r.inodes[name] = inode
+		r.ops = append(r.ops, crashOp{kind: crashOpCreate, path: name, inode: inode})
+	case flag&os.O_TRUNC != 0 && writable:
+		r.ops = append(r.ops, crashOp{kind: crashOpTruncate, inode: inode})
+	}
+
+	return &recordedFile{File: file, recorder: r, inode: inode, append: flag&os.O_APPEND != 0}, nil
+}
+
+func (r *crashRecorder) Rename(oldpath, newpath string) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	oldpath, newpath = filepath.Clean(oldpath), filepath.Clean(newpath)
+	if err := r.fs.Rename(oldpath, newpath); err != nil {
+		return err
+	}
+	r.inodes[newpath] = r.inodes[oldpath]
+	delete(r.inodes, oldpath)
+	r.ops = append(r.ops, crashOp{kind: crashOpRename, path: oldpath, newPath: newpath})
+
+	return nil
+}
+
+func (r *crashRecorder) Remove(name string) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	name = filepath.Clean(name)
+	if err := r.fs.Remove(name); err != nil {
+		return err
+	}
+	delete(r.inodes, name)
+	r.ops = append(r.ops, crashOp{kind: crashOpRemove, path: name})
+
+	return nil
+}
+
+func (r *crashRecorder) Stat(name string) (os.FileInfo, error) {
+	return r.fs.Stat(name)
+}
+
+func (r *crashRecorder) ReadDir(name string) ([]string, error) {
+	return r.fs.ReadDir(name)
+}
+
+func (r *crashRecorder) MkdirAll(path string, perm os.FileMode) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if err := r.fs.MkdirAll(path, perm); err != nil {
+		return err
+	}
+	r.ops = append(r.ops, crashOp{kind: crashOpMkdir, path: filepath.Clean(path)})
+
+	return nil
+}
+
+func (r *crashRecorder) SyncDir(name string) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	name = filepath.Clean(name)
+	if err := r.fs.SyncDir(name); err != nil {
+		return err
+	}
+	r.ops = append(r.ops, crashOp{kind: crashOpSyncDir, path: name})
+
+	return nil
+}
+
+// Lock is not recorded: locks do not survive a power cut.
+func (r *crashRecorder) Lock(name string, perm os.FileMode) (io.Closer, error) {
+	return r.fs.Lock(name, perm)
+}
+
+// recordedFile is a file opened from a crashRecorder.
+type recordedFile struct {
+	wal.File
+	recorder *crashRecorder
+	inode    int
+	append   bool
+}
+
+func (f *recordedFile) Write(p []byte) (int, error) {
+	f.recorder.lock.Lock()
+	defer f.recorder.lock.Unlock()
+
+	whence := io.SeekCurrent
+	if f.append {
+		whence = io.SeekEnd
+	}
+	offset, err := f.File.Seek(0, whence)
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := f.File.Write(p)
+	f.recorder.ops = append(f.recorder.ops, crashOp{
+		kind: crashOpWrite, inode: f.inode, offset: offset, data: bytes.Clone(p[:n]),
+	})
+
+	return n, err
+}
+
+func (f *recordedFile) Truncate(size int64) error {
+	f.recorder.lock.Lock()
+	defer f.recorder.lock.Unlock()
+
+	if err := f.File.Truncate(size); err != nil {
+		return err
+	}
+	f.recorder.ops = append(f.recorder.ops, crashOp{kind: crashOpTruncate, inode: f.inode, size: size})
+
+	return nil
+}
+
+func (f *recordedFile) Sync() error {
+	f.recorder.lock.Lock()
+	defer f.recorder.lock.Unlock()
+
+	if err := f.File.Sync(); err != nil {
+		return err
+	}
+	f.recorder.ops = append(f.recorder.ops, crashOp{kind: crashOpSync, inode: f.inode})
+
+	return nil
+}
+
+// crashVariant is the way a power cut treats the data written before it.
+type crashVariant int
+
+const (
+	// Only the data and directory entries fsynced before the power cut
+	// survive.
+	crashSynced crashVariant = iota
+	// All the directory entries survive, but only the data fsynced before the
+	// power cut does.
+	crashSyncedData
+	// All the data written before the power cut survives.
+	crashWritten
+	// All the data written before the power cut survives, except for the end
+	// of the last write.
+	crashTornWrite
+)
+
+func (v crashVariant) String() string {
+	return [...]string{"synced", "synced data", "written", "torn write"}[v]
+}
+
+// crashState returns the state the disk is left in by a power cut after the
+// first cut recorded operations, or nil if the variant does not apply.
+//
+// Directories are assumed to survive the power cut. Creations, renames and
+// removals of files only survive it if their directory was synced, except for
+// the variants where all the directory entries survive.
+func (r *crashRecorder) crashState(cut int, variant crashVariant) wal.FS {
+	r.lock.Lock()
+	ops := append([]crashOp(nil), r.ops[:cut]...)
+	r.lock.Unlock()
+
+	if variant == crashTornWrite {
+		if cut == 0 || ops[cut-1].kind != crashOpWrite || len(ops[cut-1].data) < 2 {
+			return nil
+		}
+		ops[cut-1].data = ops[cut-1].data[:len(ops[cut-1].data)/2]
+	}
+
+	var dirs []string
+	paths := make(map[string]int)
+	syncedPaths := make(map[string]int)
+	written := make(map[int][]byte)
+	synced := make(map[int][]byte)
+
+	for _, op := range ops {
+		switch op.kind {
+		case crashOpMkdir:
+			dirs = append(dirs, op.path)
+		case crashOpCreate:
+			paths[op.path] = op.inode
+			written[op.inode] = nil
+		case crashOpWrite:
+			data := written[op.inode]
+			if end := op.offset + int64(len(op.data)); end > int64(len(data)) {
+				data = append(data, make([]byte, end-int64(len(data)))...)
+			}
+			copy(data[op.offset:], op.data)
+			written[op.inode] = data
+		case crashOpTruncate:
+			data := written[op.inode]
+			if op.size <= int64(len(data)) {
+				written[op.inode] = data[:op.size]
+			} else {
+				written[op.inode] = append(data, make([]byte, op.size-int64(len(data)))...)
+			}
+		case crashOpSync:
+			synced[op.inode] = bytes.Clone(written[op.inode])
+		case crashOpRename:
+			inode := paths[op.path]
+			delete(paths, op.path)
+			paths[op.newPath] = inode
+		case crashOpRemove:
+			delete(paths, op.path)
+		case crashOpSyncDir:
+			for path := range syncedPaths {
+				if filepath.Dir(path) == op.path {
+					delete(syncedPaths, path)
+				}
+			}
+			for path, inode := range paths {
+				if filepath.Dir(path) == op.path {
+					syncedPaths[path] = inode
+				}
+			}
+		}
+	}
+
+	if variant == crashSynced {
+		paths = syncedPaths
+	}
+
+	fs := wal.NewMemFS()
+	for _, dir := range dirs {
+		if err := fs.MkdirAll(dir, 0755); err != nil {
+			panic(err)
+		}
+	}
+	for path, inode := range paths {
+		data := written[inode]
+		if variant == crashSynced || variant == crashSyncedData {
+			data = synced[inode]
+		}
+
+		file, err := fs.OpenFile(path, os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			panic(err)
+		}
+		if _, err := file.Write(data); err != nil {
+			panic(err)
+		}
+		file.Close()
+	}
+
+	return fs
+}
+
+// crashAck records that the entries up to the given sequence number of the
+// given history (or a later one) were acknowledged as durable once the given
+// number of operations were recorded, and that the entries before the given
+// low-water mark were removed for good by then. Once sealed segments expire,
+// or while TruncateFront removes them, the acknowledged entries may all have
+// been deleted.
+type crashAck struct {
+	op         int
+	sequenceNo uint64
+	history    int
+	front      uint64
+	expiring   bool
+	removing   bool
+}
+
+// crashWorkload writes entries to a WAL in the given directory of the
+// recorder, with the given configuration, including batches, non-durable entries,
+// log rotations, restarts, truncations at both ends, the repair of a torn
+// record and the deletion of expired segments. It returns the successive
+// histories of the log (the data of every entry, indexed by sequence number
+// minus one), each TruncateBack starting a new one, along with the
+// acknowledgements of the durable entries.
+func crashWorkload(t *testing.T, recorder *crashRecorder, dirPath string, config crashConfig) ([][][]byte, []crashAck) {
+	histories := [][][]byte{nil}
+	var acks []crashAck
+	var front uint64
+	var expiring, removing bool
+	ack := func(sequenceNo uint64) {
+		acks = append(acks, crashAck{
+			op: recorder.count(), sequenceNo: sequenceNo, history: len(histories) - 1, front: front,
+			expiring: expiring, removing: removing,
+		})
+	}
+	restart := func(walog *wal.WAL, opts ...wal.Option) *wal.WAL {
+		if err := walog.Close(); err != nil {
+			t.Fatalf("Failed to close WAL: %v", err)
+		}
+		// Closing the WAL only fsyncs the entries if fsync is enabled.
+		if config.fsync {
+			ack(uint64(len(histories[len(histories)-1])))
+		}
+		walog, err := wal.Open(dirPath, append(crashOptions(recorder, config), opts...)...)
+		if err != nil {
+			t.Fatalf("Failed to reopen WAL: %v", err)
+		}
+		return walog
+	}
+
+	walog, err := wal.Open(dirPath, crashOptions(recorder, config)...)
+	if err != nil {
+		t.Fatalf("Failed to create WAL: %v", err)
+	}
+
+	for i := 0; i < 40; i++ {
+		written := histories[len(histories)-1]
+		data := []byte(fmt.Sprintf("entry%02d", i))
+		var sequenceNo uint64
+
+		switch {
+		case i == 10:
+			// Remove the batch written just before. A crash midway may leave
+			// some of its entries, but never loses the ones kept.
+			sequenceNo = uint64(len(written)) - 3
+			ack(sequenceNo)
+			if err := walog.TruncateBack(sequenceNo); err != nil {
+				t.Fatalf("Failed to truncate WAL back: %v", err)
+			}
+			histories = append(histories, written[:sequenceNo:sequenceNo])
+			ack(sequenceNo)
+			continue
+		case i == 15:
+			walog = restart(walog)
+			continue
+		case i == 20:
+			// Remove every entry, including one which is not durable yet: its
+			// sequence number must not be assigned again after a crash.
+			if _, err := walog.Append(data); err != nil {
+				t.Fatalf("Failed to append entry: %v", err)
+			}
+			written = append(written, data)
+			histories[len(histories)-1] = written
+			sequenceNo = uint64(len(written))
+			removing = true
+			ack(sequenceNo - 1)
+			if err := walog.TruncateFront(sequenceNo + 1); err != nil {
+				t.Fatalf("Failed to truncate WAL front: %v", err)
+			}
+			front, removing = sequenceNo+1, false
+			ack(sequenceNo)
+			continue
+		case i == 22:
+			// Tear a record at the end of the current segment, as a crash
+			// would, and repair it.
+			if err := walog.Sync(); err != nil {
+				t.Fatalf("Failed to sync WAL: %v", err)
+			}
+			appendTornRecord(t, recorder, dirPath)
+			report, err := walog.RepairAll()
+			if err != nil {
+				t.Fatalf("Failed to repair WAL: %v", err)
+			}
+			if report.TruncatedBytes == 0 {
+				t.Fatalf("Torn record was not repaired")
+			}
+			if report.LastSequenceNo != uint64(len(written)) {
+				t.Fatalf("Repair discarded entries: last entry %d, expected %d", report.LastSequenceNo, len(written))
+			}
+			ack(uint64(len(written)))
+			continue
+		case i == 25:
+			// Delete the sealed segments on the next rotations.
+			walog = restart(walog, wal.WithRetentionPeriod(time.Nanosecond))
+			expiring = true
+			continue
+		case i%7 == 3:
+			// Not acknowledged.
+			if _, err := walog.Append(data); err != nil {
+				t.Fatalf("Failed to append entry: %v", err)
+			}
+			histories[len(histories)-1] = append(written, data)
+			continue
+		case i%5 == 4:
+			batch := [][]byte{data, []byte(fmt.Sprintf("entry%02d-2", i)), []byte(fmt.Sprintf("entry%02d-3", i))}
+			firstSequenceNo, err := walog.AppendBatchWithDurability(batch, wal.DurabilityFsynced)
+			if err != nil {
+				t.Fatalf("Failed to append batch: %v", err)
+			}
+			written = append(written, batch...)
+			sequenceNo = firstSequenceNo + uint64(len(batch)) - 1
+		default:
+			if sequenceNo, err = walog.AppendWithDurability(data, wal.DurabilityFsynced); err != nil {
+				t.Fatalf("Failed to append entry: %v", err)
+			}
+			written = append(written, data)
+		}
+
+		if sequenceNo != uint64(len(written)) {
+			t.Fatalf("Unexpected sequence number %d, expected %d", sequenceNo, len(written))
+		}
+		histories[len(histories)-1] = written
+		ack(sequenceNo)
+	}
+
+	if err := walog.Close(); err != nil {
+		t.Fatalf("Failed to close WAL: %v", err)
+	}
+	if segmentIDs := segmentIDsOf(t, recorder, dirPath); segmentIDs[0] == 1 {
+		t.Fatalf("No expired segment was deleted: %v", segmentIDs)
+	}
+
+	return histories, acks
+}
+
+// appendTornRecord writes the beginning of a record right after the last
+// record of the last segment of the WAL in the given directory of the recorder,
+// over the zeroes of a preallocated segment.
+func appendTornRecord(t *testing.T, recorder *crashRecorder, dirPath string) {
+	segmentIDs := segmentIDsOf(t, recorder, dirPath)
+	segmentPath := segmentFilePath(dirPath, segmentIDs[len(segmentIDs)-1])
+	data := readTestFile(t, recorder, segmentPath)
+	end := segmentHeaderSize
+	for end+4 <= len(data) && binary.LittleEndian.Uint32(data[end:]) != 0 {
+		end += 4 + int(binary.LittleEndian.Uint32(data[end:]))
+	}
+
+	file, err := recorder.OpenFile(segmentPath, os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatalf("Failed to open segment: %v", err)
+	}
+	defer file.Close()
+	if _, err := file.Seek(int64(end), io.SeekStart); err != nil {
+		t.Fatalf("Failed to seek segment: %v", err)
+	}
+
+	record := binary.LittleEndian.AppendUint32(nil, 100)
+	if _, err := file.Write(append(record, "torn"...)); err != nil {
+		t.Fatalf("Failed to write torn record: %v", err)
+	}
+	if err := file.Sync(); err != nil {
+		t.Fatalf("Failed to sync segment: %v", err)
+	}
+}
+
+// crashConfig is the configuration of the WAL a crash-consistency test runs
+// with.
+type crashConfig struct {
+	fsync       bool
+	preallocate bool
+}
+
+func (c crashConfig) String() string {
+	return fmt.Sprintf("fsync=%v,preallocate=%v", c.fsync, c.preallocate)
+}
+
+func crashOptions(fs wal.FS, config crashConfig) []wal.Option {
+	return []wal.Option{
+		wal.WithFS(fs),
+		wal.WithFsync(config.fsync),
+		wal.WithPreallocation(config.preallocate),
+		wal.WithMaxFileSize(150),
+		wal.WithMaxSegments(1000),
+		// Only sync when asked to, so that the operations are deterministic.
+		wal.WithSyncInterval(time.Hour),
+	}
+}
+
+// Replays every power cut of the workload, and verifies that recovering the WAL
+// yields a range of the entries of one history of the log containing every
+// acknowledged one, and that sequence numbers are not reused. With fsync
+// disabled, the entries are only acknowledged by WaitDurable.
+func TestCrash_PowerCut(t *testing.T) {
+	t.Parallel()
+	for _, fsync := range []bool{true, false} {
+		for _, preallocate := range []bool{false, true} {
+			config := crashConfig{fsync: fsync, preallocate: preallocate}
+			t.Run(config.String(), func(t *testing.T) {
+				t.Parallel()
+				testPowerCut(t, config)
+			})
+		}
+	}
+}
+
+func testPowerCut(t *testing.T, config crashConfig) {
+	dirPath := "TestCrash_PowerCut"
+	recorder := newCrashRecorder()
+	histories, acks := crashWorkload(t, recorder, dirPath, config)
+
+	for cut := 0; cut <= recorder.count(); cut++ {
+		var acknowledged crashAck
+		for _, ack := range acks {
+			if ack.op <= cut {
+				acknowledged = ack
+			}
+		}
+
+		for _, variant := range []crashVariant{crashSynced, crashSyncedData, crashWritten, crashTornWrite} {
+			fs := recorder.crashState(cut, variant)
+			if fs == nil {
+				continue
+			}
+			if err := verifyCrashRecovery(fs, dirPath, config, histories, acknowledged); err != nil {
+				t.Fatalf("Power cut after operation %d (%v): %v", cut, variant, err)
+			}
+		}
+	}
+}
+
+// verifyCrashRecovery opens the WAL left by a power cut and verifies its
+// entries.
+func verifyCrashRecovery(fs wal.FS, dirPath string, config crashConfig, histories [][][]byte, acknowledged crashAck) error {
+	opts := append(crashOptions(fs, config), wal.WithRecovery(wal.RecoveryPolicy{Mode: wal.RecoveryTolerateTornTail}))
+	walog, err := wal.Open(dirPath, opts...)
+	if err != nil {
+		return fmt.Errorf("failed to open WAL: %w", err)
+	}
+	defer walog.Close()
+
+	reader, err := walog.NewReader()
+	if err != nil {
+		return fmt.Errorf("failed to create reader: %w", err)
+	}
+	defer reader.Close()
+
+	var recovered []*wal.WAL_Entry
+	for {
+		entry, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read entry %d: %w", len(recovered)+1, err)
+		}
+
+		if len(recovered) > 0 && entry.GetLogSequenceNumber() != recovered[len(recovered)-1].GetLogSequenceNumber()+1 {
+			return fmt.Errorf("unexpected sequence number %d after %d", entry.GetLogSequenceNumber(),
+				recovered[len(recovered)-1].GetLogSequenceNumber())
+		}
+		recovered = append(recovered, entry)
+	}
+
+	var first, last uint64
+	if len(recovered) > 0 {
+		first = recovered[0].GetLogSequenceNumber()
+		last = recovered[len(recovered)-1].GetLogSequenceNumber()
+		if !crashHistoryContains(histories[acknowledged.history:], recovered) {
+			return fmt.Errorf("entries %d to %d were never written together", first, last)
+		}
+	}
+
+	// The acknowledged entries may all have been removed by TruncateFront.
+	removed := acknowledged.expiring || acknowledged.removing || acknowledged.sequenceNo < acknowledged.front
+	if last < acknowledged.sequenceNo && !(removed && len(recovered) == 0) {
+		return fmt.Errorf("lost acknowledged entries: recovered up to %d, acknowledged %d", last,
+			acknowledged.sequenceNo)
+	}
+	if len(recovered) > 0 && first < acknowledged.front {
+		return fmt.Errorf("removed entry %d came back, the log starts at %d", first, acknowledged.front)
+	}
+
+	sequenceNo, err := walog.Append([]byte("after crash"))
+	if err != nil {
+		return fmt.Errorf("failed to append entry: %w", err)
+	}
+	if sequenceNo <= acknowledged.sequenceNo || sequenceNo < acknowledged.front ||
+		(len(recovered) > 0 && sequenceNo != last+1) {
+		return fmt.Errorf("sequence number %d reused or skipped after entry %d", sequenceNo, last)
+	}
+
+	return nil
+}
+
+// crashHistoryContains returns whether one of the given histories holds all the
+// given entries.
+func crashHistoryContains(histories [][][]byte, entries []*wal.WAL_Entry) bool {
+	first := entries[0].GetLogSequenceNumber()
+	last := entries[len(entries)-1].GetLogSequenceNumber()
+	for _, history := range histories {
+		if first == 0 || last > uint64(len(history)) {
+			continue
+		}
+		matches := true
+		for i, entry := range entries {
+			if !bytes.Equal(entry.GetData(), history[first-1+uint64(i)]) {
+				matches = false
+				break
+			}
+		}
+		if matches {
+			return true
+		}
+	}
+
+	return false
+}
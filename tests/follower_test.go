@@ -0,0 +1,137 @@
+package tests
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/JyotinderSingh/go-wal"
+	"github.com/stretchr/testify/assert"
+)
+
+// A Follower returns the entries as they are written, across log rotations,
+// until the WAL is closed.
+func TestFollower_FollowsAppends(t *testing.T) {
+	t.Parallel()
+	for _, preallocate := range []bool{false, true} {
+		preallocate := preallocate
+		t.Run(fmt.Sprintf("preallocate=%v", preallocate), func(t *testing.T) {
+			t.Parallel()
+			dirPath := "TestFollower_FollowsAppends"
+			walog, err := wal.Open(dirPath, wal.WithFS(wal.NewMemFS()), wal.WithMaxFileSize(100),
+				wal.WithMaxSegments(100), wal.WithPreallocation(preallocate), wal.WithSyncInterval(time.Millisecond))
+			assert.NoError(t, err, "Failed to create WAL")
+			assert.NoError(t, walog.WriteEntry([]byte("entry00")), "Failed to write entry")
+
+			follower, err := walog.Follow(1)
+			assert.NoError(t, err, "Failed to create follower")
+			defer follower.Close()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			followed := make(chan uint64, 50)
+			go func() {
+				defer walog.Close()
+				for i := 1; i < 50; i++ {
+					if i%10 == 0 {
+						walog.WriteBatch([][]byte{[]byte(fmt.Sprintf("entry%02d", i))})
+					} else {
+						walog.WriteEntry([]byte(fmt.Sprintf("entry%02d", i)))
+					}
+					if i%7 != 0 {
+						continue
+					}
+					// Let the follower reach the end of the log before writing on.
+					walog.WaitDurable(uint64(i + 1))
+					for sequenceNo := uint64(0); sequenceNo < uint64(i+1); {
+						select {
+						case sequenceNo = <-followed:
+						case <-ctx.Done():
+							return
+						}
+					}
+				}
+			}()
+
+			for i := 0; i < 50; i++ {
+				entry, err := follower.Next(ctx)
+				if !assert.NoError(t, err, "Failed to follow entry %d", i) {
+					return
+				}
+				assert.Equal(t, uint64(i+1), entry.GetLogSequenceNumber())
+				assert.Equal(t, fmt.Sprintf("entry%02d", i), string(entry.GetData()))
+				followed <- entry.GetLogSequenceNumber()
+			}
+
+			_, err = follower.Next(ctx)
+			assert.ErrorIs(t, err, wal.ErrClosed)
+		})
+	}
+}
+
+// Next returns when its context is done, and can be called again to keep
+// following the log.
+func TestFollower_ContextCancellation(t *testing.T) {
+	t.Parallel()
+	walog, err := wal.Open("TestFollower_ContextCancellation", wal.WithFS(wal.NewMemFS()),
+		wal.WithSyncInterval(time.Hour))
+	assert.NoError(t, err, "Failed to create WAL")
+	defer walog.Close()
+
+	follower, err := walog.Follow(1)
+	assert.NoError(t, err, "Failed to create follower")
+	defer follower.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err = follower.Next(ctx)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	// Entries are only visible once flushed.
+	assert.NoError(t, walog.WriteEntry([]byte("entry1")), "Failed to write entry")
+	ctx, cancel = context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err = follower.Next(ctx)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	assert.NoError(t, walog.Sync(), "Failed to sync WAL")
+	entry, err := follower.Next(context.Background())
+	assert.NoError(t, err, "Failed to follow entry")
+	assert.Equal(t, "entry1", string(entry.GetData()))
+}
+
+// A Follower of a read-only WAL follows the entries written by another writer.
+func TestFollower_ReadOnly(t *testing.T) {
+	t.Parallel()
+	dirPath := "TestFollower_ReadOnly"
+	fs := wal.NewMemFS()
+
+	writer, err := wal.Open(dirPath, wal.WithFS(fs), wal.WithMaxFileSize(100), wal.WithMaxSegments(100),
+		wal.WithSyncInterval(time.Millisecond))
+	assert.NoError(t, err, "Failed to create WAL")
+	defer writer.Close()
+
+	walog, err := wal.OpenReadOnly(dirPath, wal.WithFS(fs), wal.WithSyncInterval(time.Millisecond))
+	assert.NoError(t, err, "Failed to open read-only WAL")
+	defer walog.Close()
+	follower, err := walog.Follow(1)
+	assert.NoError(t, err, "Failed to create follower")
+	defer follower.Close()
+
+	go func() {
+		for i := 0; i < 30; i++ {
+			writer.WriteEntry([]byte(fmt.Sprintf("entry%02d", i)))
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	for i := 0; i < 30; i++ {
+		entry, err := follower.Next(ctx)
+		if !assert.NoError(t, err, "Failed to follow entry %d", i) {
+			return
+		}
+		assert.Equal(t, fmt.Sprintf("entry%02d", i), string(entry.GetData()))
+	}
+}
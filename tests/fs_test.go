@@ -0,0 +1,290 @@
+package tests
+
+import (
+	"fmt"
+	"os"
+	"sync/atomic"
+	"testing"
+
+	"github.com/JyotinderSingh/go-wal"
+	"github.com/stretchr/testify/assert"
+)
+
+// The WAL runs entirely in memory on top of a MemFS.
+func TestFS_MemFS(t *testing.T) {
+	t.Parallel()
+	dirPath := "TestFS_MemFS"
+	fs := wal.NewMemFS()
+	opts := []wal.Option{wal.WithFS(fs), wal.WithMaxFileSize(100), wal.WithMaxSegments(100)}
+
+	walog, err := wal.Open(dirPath, opts...)
+	assert.NoError(t, err, "Failed to create WAL")
+	for i := 0; i < 20; i++ {
+		assert.NoError(t, walog.WriteEntry([]byte(fmt.Sprintf("entry%02d", i))), "Failed to write entry")
+	}
+	assert.NoError(t, walog.Close(), "Failed to close WAL")
+
+	_, err = os.Stat(dirPath)
+	assert.True(t, os.IsNotExist(err), "Nothing should be written to disk")
+
+	names, err := fs.ReadDir(dirPath)
+	assert.NoError(t, err)
+	assert.Contains(t, names, "segment-0")
+	assert.Contains(t, names, "segment-0.index")
+
+	walog, err = wal.Open(dirPath, opts...)
+	assert.NoError(t, err, "Failed to reopen WAL")
+	lsn, err := walog.Append([]byte("entry20"))
+	assert.NoError(t, err, "Failed to append entry")
+	assert.Equal(t, uint64(21), lsn)
+	assert.NoError(t, walog.Sync(), "Failed to sync WAL")
+
+	entries, err := walog.ReadFrom(5)
+	assert.NoError(t, err, "Failed to read entries")
+	assert.Equal(t, 17, len(entries), "Number of entries do not match")
+	for i, entry := range entries {
+		assert.Equal(t, fmt.Sprintf("entry%02d", i+4), string(entry.GetData()))
+	}
+	assert.NoError(t, walog.Close(), "Failed to close WAL")
+}
+
+// Failed writes and fsyncs are reported to the writers.
+func TestFS_FaultFSFailsOperations(t *testing.T) {
+	t.Parallel()
+	fs := wal.NewFaultFS(wal.NewMemFS())
+
+	walog, err := wal.Open("TestFS_FaultFSFailsOperations", wal.WithFS(fs))
+	assert.NoError(t, err, "Failed to create WAL")
+
+	fs.Inject(wal.Fault{Op: wal.FaultSync})
+	_, err = walog.AppendWithDurability([]byte("entry1"), wal.DurabilityFsynced)
+	assert.ErrorIs(t, err, wal.ErrInjectedFault)
+
+	fs.Inject(wal.Fault{Op: wal.FaultWrite, N: 1})
+	_, err = walog.AppendWithDurability([]byte("entry2"), wal.DurabilityFlushed)
+	assert.ErrorIs(t, err, wal.ErrInjectedFault)
+}
+
+// A write torn by a crash leaves an incomplete record behind, which is
+// truncated when tolerating torn tails.
+func TestFS_FaultFSTornWrite(t *testing.T) {
+	t.Parallel()
+	dirPath := "TestFS_FaultFSTornWrite"
+	memFS := wal.NewMemFS()
+	fs := wal.NewFaultFS(memFS)
+
+	walog, err := wal.Open(dirPath, wal.WithFS(fs))
+	assert.NoError(t, err, "Failed to create WAL")
+	_, err = walog.AppendWithDurability([]byte("entry1"), wal.DurabilityFsynced)
+	assert.NoError(t, err, "Failed to append entry")
+
+	fs.Inject(wal.Fault{Op: wal.FaultWrite, TornBytes: 10, Crash: true})
+	_, err = walog.AppendWithDurability([]byte("entry2"), wal.DurabilityFsynced)
+	assert.ErrorIs(t, err, wal.ErrInjectedFault)
+	assert.True(t, fs.Crashed())
+
+	// Every operation fails after the crash.
+	_, err = walog.AppendWithDurability([]byte("entry3"), wal.DurabilityFsynced)
+	assert.ErrorIs(t, err, wal.ErrInjectedFault)
+	walog.Close()
+
+	_, err = wal.Open(dirPath, wal.WithFS(memFS))
+	assert.ErrorIs(t, err, wal.ErrCorruptRecord, "The torn write should be detected")
+
+	walog, err = wal.Open(dirPath, wal.WithFS(memFS),
+		wal.WithRecovery(wal.RecoveryPolicy{Mode: wal.RecoveryTolerateTornTail}))
+	assert.NoError(t, err, "Failed to open WAL")
+	lsn, err := walog.Append([]byte("entry2"))
+	assert.NoError(t, err, "Failed to append entry")
+	assert.Equal(t, uint64(2), lsn)
+	assert.NoError(t, walog.Close(), "Failed to close WAL")
+}
+
+// A failed rename during a log rotation is reported to the writer.
+func TestFS_FaultFSRename(t *testing.T) {
+	t.Parallel()
+	fs := wal.NewFaultFS(wal.NewMemFS())
+
+	walog, err := wal.Open("TestFS_FaultFSRename", wal.WithFS(fs), wal.WithMaxFileSize(10))
+	assert.NoError(t, err, "Failed to create WAL")
+	assert.NoError(t, walog.WriteEntry([]byte("entry1")), "Failed to write entry")
+
+	// The next write rotates the log: the index and then the segment are
+	// renamed into place.
+	fs.Inject(wal.Fault{Op: wal.FaultRename, N: 2})
+	renames := fs.Count(wal.FaultRename)
+	assert.ErrorIs(t, walog.WriteEntry([]byte("entry2")), wal.ErrInjectedFault)
+	assert.Equal(t, renames+2, fs.Count(wal.FaultRename))
+}
+
+// With fsync enabled, creating and deleting segments syncs the directory, and
+// failing to do so is reported to the writer.
+func TestFS_SyncDir(t *testing.T) {
+	t.Parallel()
+	dirPath := "TestFS_SyncDir"
+	fs := wal.NewFaultFS(wal.NewMemFS())
+
+	walog, err := wal.Open(dirPath+"/create", wal.WithFS(fs), wal.WithMaxFileSize(10))
+	assert.NoError(t, err, "Failed to create WAL")
+	assert.NoError(t, walog.WriteEntry([]byte("entry1")), "Failed to write entry")
+
+	// The next write rotates the log, creating a segment.
+	fs.Inject(wal.Fault{Op: wal.FaultSyncDir})
+	syncs := fs.Count(wal.FaultSyncDir)
+	assert.ErrorIs(t, walog.WriteEntry([]byte("entry2")), wal.ErrInjectedFault)
+	assert.Equal(t, syncs+1, fs.Count(wal.FaultSyncDir))
+
+	deleted := 0
+	hooks := wal.Hooks{OnSegmentDeleted: func(int) { deleted++ }}
+	walog, err = wal.Open(dirPath+"/delete", wal.WithFS(fs), wal.WithMaxFileSize(10), wal.WithMaxSegments(2),
+		wal.WithHooks(hooks))
+	assert.NoError(t, err, "Failed to create WAL")
+	for i := 0; i < 4; i++ {
+		assert.NoError(t, walog.WriteEntry([]byte(fmt.Sprintf("entry%d", i))), "Failed to write entry")
+	}
+	assert.NotZero(t, deleted, "Segments should have been deleted")
+
+	// The next write rotates the log, creating a segment and then deleting the
+	// oldest one.
+	deletedBefore := deleted
+	fs.Inject(wal.Fault{Op: wal.FaultSyncDir, N: 2})
+	assert.ErrorIs(t, walog.WriteEntry([]byte("entry4")), wal.ErrInjectedFault)
+	assert.Equal(t, deletedBefore, deleted, "The deletion is not complete until the directory is synced")
+}
+
+// With fsync disabled, the directory is only synced when a segment is created,
+// so that its header is durable, and never when one is deleted.
+func TestFS_SyncDirWithoutFsync(t *testing.T) {
+	t.Parallel()
+	fs := wal.NewFaultFS(wal.NewMemFS())
+
+	rotations := 0
+	hooks := wal.Hooks{OnRotate: func(int) { rotations++ }}
+	walog, err := wal.Open("TestFS_SyncDirWithoutFsync", wal.WithFS(fs), wal.WithFsync(false),
+		wal.WithMaxFileSize(10), wal.WithMaxSegments(2), wal.WithHooks(hooks))
+	assert.NoError(t, err, "Failed to create WAL")
+	for i := 0; i < 5; i++ {
+		assert.NoError(t, walog.WriteEntry([]byte(fmt.Sprintf("entry%d", i))), "Failed to write entry")
+	}
+	assert.NoError(t, walog.Close(), "Failed to close WAL")
+
+	assert.NotZero(t, rotations)
+	assert.Equal(t, 1+rotations, fs.Count(wal.FaultSyncDir))
+}
+
+// A repair fsyncs the repaired segment before renaming it into place, and then
+// syncs the directory.
+func TestFS_RepairSyncsBeforeRename(t *testing.T) {
+	t.Parallel()
+	dirPath := "TestFS_RepairSyncsBeforeRename"
+	memFS := wal.NewMemFS()
+	fs := wal.NewFaultFS(memFS)
+
+	walog, err := wal.Open(dirPath, wal.WithFS(fs))
+	assert.NoError(t, err, "Failed to create WAL")
+	assert.NoError(t, walog.WriteEntry([]byte("entry1")), "Failed to write entry")
+	assert.NoError(t, walog.Close(), "Failed to close WAL")
+
+	// Tear the tail of the segment.
+	file, err := memFS.OpenFile(dirPath+"/segment-0", os.O_APPEND|os.O_WRONLY, 0644)
+	assert.NoError(t, err)
+	_, err = file.Write([]byte{16, 0, 0, 0, 'x'})
+	assert.NoError(t, err)
+	assert.NoError(t, file.Close())
+	info, err := memFS.Stat(dirPath + "/segment-0")
+	assert.NoError(t, err)
+
+	// The segment is left untouched if the repaired file cannot be synced.
+	fs.Inject(wal.Fault{Op: wal.FaultSync})
+	renames := fs.Count(wal.FaultRename)
+	_, err = wal.RepairDirectory(dirPath, wal.WithFS(fs))
+	assert.ErrorIs(t, err, wal.ErrInjectedFault)
+	assert.Equal(t, renames, fs.Count(wal.FaultRename), "Nothing should be renamed")
+	repairedInfo, err := memFS.Stat(dirPath + "/segment-0")
+	assert.NoError(t, err)
+	assert.Equal(t, info.Size(), repairedInfo.Size())
+
+	syncs := fs.Count(wal.FaultSyncDir)
+	report, err := wal.RepairDirectory(dirPath, wal.WithFS(fs))
+	assert.NoError(t, err, "Failed to repair WAL")
+	assert.Equal(t, int64(5), report.TruncatedBytes)
+	assert.Greater(t, fs.Count(wal.FaultSyncDir), syncs, "The directory should be synced")
+}
+
+// openFilesFS is a wal.FS which counts the files left open.
+type openFilesFS struct {
+	wal.FS
+	open atomic.Int64
+}
+
+func (fs *openFilesFS) OpenFile(name string, flag int, perm os.FileMode) (wal.File, error) {
+	file, err := fs.FS.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	fs.open.Add(1)
+	return &openFilesFile{File: file, fs: fs}, nil
+}
+
+type openFilesFile struct {
+	wal.File
+	fs     *openFilesFS
+	closed bool
+}
+
+func (f *openFilesFile) Close() error {
+	if !f.closed {
+		f.closed = true
+		f.fs.open.Add(-1)
+	}
+	return f.File.Close()
+}
+
+// A failed Open leaves no file open and releases the lock.
+func TestFS_OpenFailureReleasesResources(t *testing.T) {
+	t.Parallel()
+	dirPath := "TestFS_OpenFailureReleasesResources"
+	memFS := wal.NewMemFS()
+	openFiles := &openFilesFS{FS: memFS}
+	fs := wal.NewFaultFS(openFiles)
+	opts := []wal.Option{wal.WithFS(fs), wal.WithMaxFileSize(50)}
+
+	walog, err := wal.Open(dirPath, opts...)
+	assert.NoError(t, err, "Failed to create WAL")
+	for i := 0; i < 5; i++ {
+		assert.NoError(t, walog.WriteEntry([]byte(fmt.Sprintf("entry%d", i))), "Failed to write entry")
+	}
+	assert.NoError(t, walog.Close(), "Failed to close WAL")
+	assert.Zero(t, openFiles.open.Load())
+
+	// Open fails while rebuilding the missing index of a sealed segment, once the
+	// current segment is open.
+	assert.NoError(t, memFS.Remove(dirPath+"/segment-0.index"))
+	fs.Inject(wal.Fault{Op: wal.FaultWrite})
+	_, err = wal.Open(dirPath, opts...)
+	assert.ErrorIs(t, err, wal.ErrInjectedFault)
+	assert.Zero(t, openFiles.open.Load(), "Files left open")
+
+	walog, err = wal.Open(dirPath, opts...)
+	assert.NoError(t, err, "Failed to reopen WAL")
+	assert.NoError(t, walog.Close(), "Failed to close WAL")
+}
+
+// A failed Close still closes the current segment and releases the lock.
+func TestFS_CloseFailureReleasesResources(t *testing.T) {
+	t.Parallel()
+	dirPath := "TestFS_CloseFailureReleasesResources"
+	openFiles := &openFilesFS{FS: wal.NewMemFS()}
+	fs := wal.NewFaultFS(openFiles)
+
+	walog, err := wal.Open(dirPath, wal.WithFS(fs))
+	assert.NoError(t, err, "Failed to create WAL")
+	assert.NoError(t, walog.WriteEntry([]byte("entry1")), "Failed to write entry")
+	fs.Inject(wal.Fault{Op: wal.FaultSync})
+	assert.ErrorIs(t, walog.Close(), wal.ErrInjectedFault)
+	assert.Zero(t, openFiles.open.Load(), "Files left open")
+
+	walog, err = wal.Open(dirPath, wal.WithFS(fs))
+	assert.NoError(t, err, "Failed to reopen WAL")
+	assert.NoError(t, walog.Close(), "Failed to close WAL")
+}
@@ -0,0 +1,112 @@
+package tests
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/JyotinderSingh/go-wal"
+	"github.com/stretchr/testify/assert"
+)
+
+// Feeds arbitrary segment contents to every read path. None of them may panic,
+// and they may only fail with a corruption or format error.
+func FuzzSegment(f *testing.F) {
+	seedDir := f.TempDir()
+	walog, err := wal.OpenWAL(seedDir, false, maxFileSize, maxSegments)
+	assert.NoError(f, err, "Failed to create WAL")
+	assert.NoError(f, walog.WriteEntry([]byte("entry1")), "Failed to write entry")
+	assert.NoError(f, walog.WriteBatch([][]byte{[]byte("batch1"), []byte("batch2")}), "Failed to write batch")
+	assert.NoError(f, walog.CreateCheckpoint([]byte("checkpoint")), "Failed to create checkpoint")
+	assert.NoError(f, walog.WriteEntry([]byte("entry2")), "Failed to write entry")
+	assert.NoError(f, walog.Close(), "Failed to close WAL")
+
+	segment, err := os.ReadFile(filepath.Join(seedDir, "segment-0"))
+	assert.NoError(f, err)
+
+	f.Add(segment)
+	f.Add(segment[:len(segment)-3])
+	f.Add(segment[segmentHeaderSize:])
+	f.Add(segment[:segmentHeaderSize/2])
+	f.Add([]byte{})
+	f.Add([]byte{0xff, 0xff, 0xff, 0xff, 0x00})
+	f.Add([]byte("random data"))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		dirPath := t.TempDir()
+		walog, err := wal.OpenWAL(dirPath, false, maxFileSize, maxSegments)
+		if err != nil {
+			t.Fatalf("Failed to create WAL: %v", err)
+		}
+		if err := walog.Close(); err != nil {
+			t.Fatalf("Failed to close WAL: %v", err)
+		}
+
+		segmentPath := filepath.Join(dirPath, "segment-0")
+		if err := os.WriteFile(segmentPath, data, 0644); err != nil {
+			t.Fatalf("Failed to write segment: %v", err)
+		}
+
+		_, err = walog.ReadAll(false)
+		assertReadError(t, err)
+		_, err = walog.ReadAll(true)
+		assertReadError(t, err)
+		_, err = walog.ReadAllFromOffset(-1, false)
+		assertReadError(t, err)
+		if _, err = walog.ReadFrom(1); !errors.Is(err, wal.ErrSequenceNumberRemoved) {
+			assertReadError(t, err)
+		}
+
+		reader, err := walog.NewReader()
+		if err != nil {
+			t.Fatalf("Failed to create reader: %v", err)
+		}
+		for err == nil {
+			_, err = reader.Next()
+		}
+		if err != io.EOF {
+			assertReadError(t, err)
+		}
+		reader.Close()
+
+		// Opening the WAL reads the segment back too.
+		if reopened, err := wal.OpenWAL(dirPath, false, maxFileSize, maxSegments); err == nil {
+			reopened.Close()
+		} else {
+			assertReadError(t, err)
+		}
+
+		// Once repaired, the log must be readable.
+		report, err := wal.RepairDirectory(dirPath)
+		assertReadError(t, err)
+		if err != nil {
+			return
+		}
+
+		reopened, err := wal.OpenWAL(dirPath, false, maxFileSize, maxSegments)
+		if err != nil {
+			t.Fatalf("Failed to open repaired WAL: %v", err)
+		}
+		defer reopened.Close()
+
+		entries, err := reopened.ReadAllFromOffset(-1, false)
+		if err != nil {
+			t.Fatalf("Failed to read repaired WAL: %v", err)
+		}
+		if len(entries) > 0 && entries[len(entries)-1].GetLogSequenceNumber() != report.LastSequenceNo {
+			t.Fatalf("Last sequence number %d does not match the report (%d)",
+				entries[len(entries)-1].GetLogSequenceNumber(), report.LastSequenceNo)
+		}
+	})
+}
+
+// assertReadError fails the test unless err is nil, a corruption error or a
+// format error.
+func assertReadError(t *testing.T, err error) {
+	t.Helper()
+	if err != nil && !errors.Is(err, wal.ErrCorruptRecord) && !errors.Is(err, wal.ErrUnsupportedFormat) {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+}
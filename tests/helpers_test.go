@@ -0,0 +1,144 @@
+package tests
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/JyotinderSingh/go-wal"
+	"github.com/stretchr/testify/assert"
+)
+
+// Helpers shared by the tests of the WAL. The ones taking a wal.FS work on any
+// file system: pass wal.OSFS() for the WALs stored on disk.
+
+// segmentFilePath returns the path of the log segment with the given ID in the
+// given directory.
+func segmentFilePath(dirPath string, segmentID int) string {
+	return filepath.Join(dirPath, fmt.Sprintf("segment-%d", segmentID))
+}
+
+// segmentIDsOf returns the IDs of the log segments of the given directory, in
+// increasing order. Index files, and temporary or quarantined segments, are
+// left out.
+func segmentIDsOf(t *testing.T, fs wal.FS, dirPath string) []int {
+	names, err := fs.ReadDir(dirPath)
+	assert.NoError(t, err, "Failed to read directory")
+
+	var segmentIDs []int
+	for _, name := range names {
+		var segmentID int
+		if _, err := fmt.Sscanf(name, "segment-%d", &segmentID); err == nil &&
+			name == fmt.Sprintf("segment-%d", segmentID) {
+			segmentIDs = append(segmentIDs, segmentID)
+		}
+	}
+	sort.Ints(segmentIDs)
+
+	return segmentIDs
+}
+
+// readTestFile returns the contents of the given file.
+func readTestFile(t *testing.T, fs wal.FS, path string) []byte {
+	file, err := fs.OpenFile(path, os.O_RDONLY, 0)
+	assert.NoError(t, err, "Failed to open %s", path)
+	defer file.Close()
+
+	var data bytes.Buffer
+	_, err = data.ReadFrom(file)
+	assert.NoError(t, err, "Failed to read %s", path)
+
+	return data.Bytes()
+}
+
+// writeTestFile replaces the contents of the given file.
+func writeTestFile(t *testing.T, fs wal.FS, path string, data []byte) {
+	file, err := fs.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	assert.NoError(t, err, "Failed to open %s", path)
+	_, err = file.Write(data)
+	assert.NoError(t, err, "Failed to write %s", path)
+	assert.NoError(t, file.Close())
+}
+
+// readDirFiles returns the contents of the files of the given directory.
+func readDirFiles(t *testing.T, fs wal.FS, dirPath string) map[string][]byte {
+	names, err := fs.ReadDir(dirPath)
+	assert.NoError(t, err, "Failed to read directory")
+
+	files := make(map[string][]byte)
+	for _, name := range names {
+		files[name] = readTestFile(t, fs, filepath.Join(dirPath, name))
+	}
+
+	return files
+}
+
+// corruptSegment flips the case of the first byte of the given data in the
+// given segment file.
+func corruptSegment(t *testing.T, fs wal.FS, segmentPath string, data string) {
+	contents := readTestFile(t, fs, segmentPath)
+	index := bytes.Index(contents, []byte(data))
+	if !assert.GreaterOrEqual(t, index, 0, "Data not found in segment") {
+		return
+	}
+	contents[index] ^= 0x20
+	writeTestFile(t, fs, segmentPath, contents)
+}
+
+// entryOffsets returns the offsets at which each of the entries of the given
+// segment file start.
+func entryOffsets(t *testing.T, segmentPath string) []int64 {
+	data, err := os.ReadFile(segmentPath)
+	assert.NoError(t, err, "Failed to read segment")
+
+	// Skip the segment header.
+	start := 0
+	if strings.HasPrefix(string(data), "GWAL") {
+		start = segmentHeaderSize
+	}
+
+	var offsets []int64
+	for offset := start; offset+4 <= len(data); {
+		offsets = append(offsets, int64(offset))
+		offset += 4 + int(binary.LittleEndian.Uint32(data[offset:]))
+	}
+
+	return offsets
+}
+
+// writeTestEntries writes and syncs the entries with the given sequence
+// numbers, with the sequence number in their data.
+func writeTestEntries(t *testing.T, walog *wal.WAL, first, last uint64) {
+	for sequenceNo := first; sequenceNo <= last; sequenceNo++ {
+		assert.NoError(t, walog.WriteEntry([]byte(fmt.Sprintf("entry%02d", sequenceNo))), "Failed to write entry")
+	}
+	assert.NoError(t, walog.Sync(), "Failed to sync WAL")
+}
+
+// assertEntriesFrom checks that the given entries are the ones written by
+// writeTestEntries, from the given sequence number to the given one.
+func assertEntriesFrom(t *testing.T, entries []*wal.WAL_Entry, first, last uint64) {
+	t.Helper()
+	if !assert.Equal(t, int(last-first+1), len(entries), "Number of entries do not match") {
+		return
+	}
+	for i, entry := range entries {
+		sequenceNo := first + uint64(i)
+		assert.Equal(t, sequenceNo, entry.GetLogSequenceNumber())
+		assert.Equal(t, fmt.Sprintf("entry%02d", sequenceNo), string(entry.GetData()))
+	}
+}
+
+// entryData returns the data of the given entries.
+func entryData(entries []*wal.WAL_Entry) []string {
+	var data []string
+	for _, entry := range entries {
+		data = append(data, string(entry.GetData()))
+	}
+	return data
+}
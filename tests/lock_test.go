@@ -0,0 +1,84 @@
+package tests
+
+import (
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/JyotinderSingh/go-wal"
+	"github.com/stretchr/testify/assert"
+)
+
+// A WAL can only be opened by one writer at a time.
+func TestLock_SingleWriter(t *testing.T) {
+	t.Parallel()
+	dirPath := "TestLock_SingleWriter"
+	defer os.RemoveAll(dirPath)
+
+	walog, err := wal.OpenWAL(dirPath, true, maxFileSize, maxSegments)
+	assert.NoError(t, err, "Failed to create WAL")
+
+	_, err = wal.OpenWAL(dirPath, true, maxFileSize, maxSegments)
+	assert.ErrorIs(t, err, wal.ErrLocked)
+	_, err = wal.RepairDirectory(dirPath)
+	assert.ErrorIs(t, err, wal.ErrLocked)
+
+	// Closing the WAL releases the lock.
+	assert.NoError(t, walog.Close(), "Failed to close WAL")
+	walog, err = wal.OpenWAL(dirPath, true, maxFileSize, maxSegments)
+	assert.NoError(t, err, "Failed to reopen WAL")
+	assert.NoError(t, walog.Close(), "Failed to close WAL")
+}
+
+// The lock is released when opening the WAL fails after taking it.
+func TestLock_ReleasedOnFailedOpen(t *testing.T) {
+	t.Parallel()
+	dirPath := "TestLock_ReleasedOnFailedOpen"
+	fs := wal.NewFaultFS(wal.NewMemFS())
+
+	// Taking the lock is the first open, creating the first segment the second.
+	fs.Inject(wal.Fault{Op: wal.FaultOpen, N: 2})
+	_, err := wal.Open(dirPath, wal.WithFS(fs))
+	assert.ErrorIs(t, err, wal.ErrInjectedFault)
+
+	walog, err := wal.Open(dirPath, wal.WithFS(fs))
+	assert.NoError(t, err, "Failed to create WAL")
+	assert.NoError(t, walog.Close(), "Failed to close WAL")
+}
+
+// Read-only WALs do not take the lock, and cannot be written to.
+func TestLock_ReadOnly(t *testing.T) {
+	t.Parallel()
+	dirPath := "TestLock_ReadOnly"
+	fs := wal.NewMemFS()
+
+	_, err := wal.Open(dirPath, wal.WithFS(fs), wal.WithReadOnly(true))
+	assert.ErrorIs(t, err, os.ErrNotExist, "Nothing should be created")
+	_, err = fs.Stat(dirPath)
+	assert.ErrorIs(t, err, os.ErrNotExist)
+
+	writer, err := wal.Open(dirPath, wal.WithFS(fs))
+	assert.NoError(t, err, "Failed to create WAL")
+	defer writer.Close()
+	for i := 0; i < 5; i++ {
+		assert.NoError(t, writer.WriteEntry([]byte(fmt.Sprintf("entry%d", i))), "Failed to write entry")
+	}
+	assert.NoError(t, writer.Sync(), "Failed to sync WAL")
+
+	reader, err := wal.Open(dirPath, wal.WithFS(fs), wal.WithReadOnly(true))
+	assert.NoError(t, err, "Failed to open read-only WAL")
+	entries, err := reader.ReadFrom(1)
+	assert.NoError(t, err, "Failed to read entries")
+	assert.Equal(t, 5, len(entries), "Number of entries do not match")
+
+	_, err = reader.Append([]byte("entry5"))
+	assert.ErrorIs(t, err, wal.ErrReadOnly)
+	assert.ErrorIs(t, reader.WriteBatch([][]byte{[]byte("entry5")}), wal.ErrReadOnly)
+	_, err = reader.Repair()
+	assert.ErrorIs(t, err, wal.ErrReadOnly)
+	assert.NoError(t, reader.Close(), "Failed to close read-only WAL")
+
+	_, err = wal.Open(dirPath, wal.WithFS(fs), wal.WithReadOnly(true),
+		wal.WithRecovery(wal.RecoveryPolicy{Mode: wal.RecoveryTolerateTornTail}))
+	assert.ErrorIs(t, err, wal.ErrInvalidOption)
+}
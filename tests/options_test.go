@@ -0,0 +1,201 @@
+package tests
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/JyotinderSingh/go-wal"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOptions_Validation(t *testing.T) {
+	t.Parallel()
+	dirPath := "TestOptions_Validation"
+	defer os.RemoveAll(dirPath)
+
+	_, err := wal.OpenWAL(dirPath, true, maxFileSize, 0)
+	assert.ErrorIs(t, err, wal.ErrInvalidOption)
+
+	invalidOptions := []wal.Option{
+		wal.WithMaxSegments(-1),
+		wal.WithMaxFileSize(0),
+		wal.WithSyncInterval(0),
+		wal.WithBufferSize(0),
+		wal.WithPermissions(0, 0755),
+		wal.WithSegmentPrefix(""),
+		wal.WithSegmentPrefix("logs/segment-"),
+		wal.WithLogger(nil),
+		wal.WithRetentionPeriod(-time.Second),
+	}
+	for _, option := range invalidOptions {
+		_, err := wal.Open(dirPath, option)
+		assert.ErrorIs(t, err, wal.ErrInvalidOption)
+	}
+
+	_, err = wal.RepairDirectory(dirPath, wal.WithSegmentPrefix(""))
+	assert.ErrorIs(t, err, wal.ErrInvalidOption)
+}
+
+// Segment files are named after the configured prefix, and created with the
+// configured permissions.
+func TestOptions_SegmentPrefixAndPermissions(t *testing.T) {
+	t.Parallel()
+	dirPath := "TestOptions_SegmentPrefixAndPermissions"
+	defer os.RemoveAll(dirPath)
+
+	opts := []wal.Option{wal.WithSegmentPrefix("log-"), wal.WithPermissions(0600, 0700)}
+	walog, err := wal.Open(dirPath, opts...)
+	assert.NoError(t, err, "Failed to create WAL")
+	assert.NoError(t, walog.WriteEntry([]byte("entry1")), "Failed to write entry")
+	assert.NoError(t, walog.Close(), "Failed to close WAL")
+
+	dirInfo, err := os.Stat(dirPath)
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0700), dirInfo.Mode().Perm())
+
+	fileInfo, err := os.Stat(filepath.Join(dirPath, "log-0"))
+	assert.NoError(t, err, "Segment should be named after the prefix")
+	assert.Equal(t, os.FileMode(0600), fileInfo.Mode().Perm())
+
+	walog, err = wal.Open(dirPath, opts...)
+	assert.NoError(t, err, "Failed to reopen WAL")
+	lsn, err := walog.Append([]byte("entry2"))
+	assert.NoError(t, err, "Failed to append entry")
+	assert.Equal(t, uint64(2), lsn)
+	assert.NoError(t, walog.Close(), "Failed to close WAL")
+
+	report, err := wal.RepairDirectory(dirPath, opts...)
+	assert.NoError(t, err, "Failed to repair WAL")
+	assert.Equal(t, []int{0}, report.KeptSegments)
+	assert.Equal(t, uint64(2), report.LastSequenceNo)
+}
+
+// Preallocated segments are extended up front, and their unused space is
+// ignored when reading and reopening them.
+func TestOptions_Preallocation(t *testing.T) {
+	t.Parallel()
+	dirPath := "TestOptions_Preallocation"
+	defer os.RemoveAll(dirPath)
+
+	const segmentSize = 4096
+	opts := []wal.Option{wal.WithPreallocation(true), wal.WithMaxFileSize(segmentSize)}
+	walog, err := wal.Open(dirPath, opts...)
+	assert.NoError(t, err, "Failed to create WAL")
+	for i := 0; i < 10; i++ {
+		assert.NoError(t, walog.WriteEntry([]byte(fmt.Sprintf("entry%d", i))), "Failed to write entry")
+	}
+	assert.NoError(t, walog.Close(), "Failed to close WAL")
+
+	segmentPath := filepath.Join(dirPath, "segment-0")
+	info, err := os.Stat(segmentPath)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(segmentHeaderSize+segmentSize), info.Size(), "Segment should be preallocated")
+
+	walog, err = wal.Open(dirPath, opts...)
+	assert.NoError(t, err, "Failed to reopen WAL")
+	lsn, err := walog.Append([]byte("entry10"))
+	assert.NoError(t, err, "Failed to append entry")
+	assert.Equal(t, uint64(11), lsn)
+
+	// Fill the segment, so that it gets sealed.
+	payload := bytes.Repeat([]byte("x"), 512)
+	for i := 0; i < 10; i++ {
+		assert.NoError(t, walog.WriteEntry(payload), "Failed to write entry")
+	}
+	assert.NoError(t, walog.Close(), "Failed to close WAL")
+
+	// The unused space of the sealed segment is given back.
+	data, err := os.ReadFile(segmentPath)
+	assert.NoError(t, err)
+	for _, offset := range entryOffsets(t, segmentPath) {
+		assert.NotZero(t, binary.LittleEndian.Uint32(data[offset:]), "Sealed segment should be truncated")
+	}
+
+	entries, err := walog.ReadAllFromOffset(-1, false)
+	assert.NoError(t, err, "Failed to read entries")
+	assert.Equal(t, 21, len(entries), "Number of entries do not match")
+	for i, entry := range entries {
+		assert.Equal(t, uint64(i+1), entry.GetLogSequenceNumber())
+	}
+}
+
+// Sealed segments older than the retention period are deleted on rotation, and
+// hooks are notified of rotations and deletions.
+func TestOptions_RetentionAndHooks(t *testing.T) {
+	t.Parallel()
+	dirPath := "TestOptions_RetentionAndHooks"
+	defer os.RemoveAll(dirPath)
+
+	var lock sync.Mutex
+	var rotated, deleted []int
+	hooks := wal.Hooks{
+		OnRotate: func(segmentID int) {
+			lock.Lock()
+			defer lock.Unlock()
+			rotated = append(rotated, segmentID)
+			// Every segment but the one just sealed has expired by now.
+			if segmentID >= 2 {
+				expired := time.Now().Add(-2 * time.Hour)
+				assert.NoError(t, os.Chtimes(segmentFilePath(dirPath, segmentID-2), expired, expired))
+			}
+		},
+		OnSegmentDeleted: func(segmentID int) {
+			lock.Lock()
+			defer lock.Unlock()
+			deleted = append(deleted, segmentID)
+		},
+	}
+
+	walog, err := wal.Open(dirPath, wal.WithMaxFileSize(100), wal.WithMaxSegments(100),
+		wal.WithRetentionPeriod(time.Hour), wal.WithHooks(hooks))
+	assert.NoError(t, err, "Failed to create WAL")
+	for i := 0; i < 20; i++ {
+		assert.NoError(t, walog.WriteEntry([]byte(fmt.Sprintf("entry%02d", i))), "Failed to write entry")
+	}
+	assert.NoError(t, walog.Close(), "Failed to close WAL")
+
+	lock.Lock()
+	defer lock.Unlock()
+	assert.NotEmpty(t, rotated, "Expected rotations")
+	for i, segmentID := range rotated {
+		assert.Equal(t, i+1, segmentID)
+	}
+
+	// Every sealed segment has expired, except the one sealed by the last
+	// rotation.
+	segmentIDs := segmentIDsOf(t, wal.OSFS(), dirPath)
+	assert.Len(t, segmentIDs, 2)
+	assert.Equal(t, rotated[len(rotated)-1], segmentIDs[len(segmentIDs)-1])
+	assert.Equal(t, segmentIDs[0], len(deleted), "Deleted segments should be the oldest ones")
+}
+
+// Messages are logged to the configured logger.
+func TestOptions_Logger(t *testing.T) {
+	t.Parallel()
+	dirPath := "TestOptions_Logger"
+	defer os.RemoveAll(dirPath)
+
+	walog, err := wal.Open(dirPath)
+	assert.NoError(t, err, "Failed to create WAL")
+	assert.NoError(t, walog.WriteEntry([]byte("entry1")), "Failed to write entry")
+	assert.NoError(t, walog.Close(), "Failed to close WAL")
+
+	segmentPath := filepath.Join(dirPath, "segment-0")
+	info, err := os.Stat(segmentPath)
+	assert.NoError(t, err)
+	assert.NoError(t, os.Truncate(segmentPath, info.Size()-2))
+
+	var output bytes.Buffer
+	walog, err = wal.Open(dirPath, wal.WithLogger(log.New(&output, "", 0)),
+		wal.WithRecovery(wal.RecoveryPolicy{Mode: wal.RecoveryTolerateTornTail}))
+	assert.NoError(t, err, "Failed to open WAL")
+	assert.NoError(t, walog.Close(), "Failed to close WAL")
+	assert.Contains(t, output.String(), "Truncating torn record")
+}
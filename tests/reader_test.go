@@ -0,0 +1,346 @@
+package tests
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/JyotinderSingh/go-wal"
+	"github.com/stretchr/testify/assert"
+)
+
+// Streams entries spread over several segments with a Reader.
+func TestReader_ReadsAllSegmentsInOrder(t *testing.T) {
+	t.Parallel()
+	dirPath := "TestReader_ReadsAllSegmentsInOrder"
+	defer os.RemoveAll(dirPath)
+
+	// Tiny segments, so that every entry goes into its own segment.
+	walog, err := wal.OpenWAL(dirPath, true, 16, 100)
+	assert.NoError(t, err, "Failed to create WAL")
+
+	const numEntries = 25
+	for i := 0; i < numEntries; i++ {
+		assert.NoError(t, walog.WriteEntry([]byte(fmt.Sprintf("entry%d", i))), "Failed to write entry")
+	}
+	assert.NoError(t, walog.Close(), "Failed to close WAL")
+
+	reader, err := walog.NewReader()
+	assert.NoError(t, err, "Failed to create reader")
+	defer reader.Close()
+
+	for i := 0; i < numEntries; i++ {
+		entry, err := reader.Next()
+		assert.NoError(t, err, "Failed to read entry")
+		assert.Equal(t, uint64(i+1), entry.GetLogSequenceNumber())
+		assert.Equal(t, fmt.Sprintf("entry%d", i), string(entry.GetData()))
+	}
+
+	_, err = reader.Next()
+	assert.Equal(t, io.EOF, err)
+
+	assert.NoError(t, reader.Close())
+	_, err = reader.Next()
+	assert.Equal(t, wal.ErrReaderClosed, err)
+}
+
+// Corrupts an entry in the middle of the log and checks that the Reader reports
+// its exact position.
+func TestReader_ReportsCorruption(t *testing.T) {
+	t.Parallel()
+	dirPath := "TestReader_ReportsCorruption"
+	defer os.RemoveAll(dirPath)
+
+	walog, err := wal.OpenWAL(dirPath, true, maxFileSize, maxSegments)
+	assert.NoError(t, err, "Failed to create WAL")
+
+	for i := 0; i < 5; i++ {
+		assert.NoError(t, walog.WriteEntry([]byte(fmt.Sprintf("entry%d", i))), "Failed to write entry")
+	}
+	assert.NoError(t, walog.Close(), "Failed to close WAL")
+
+	// Corrupt the data of the third entry.
+	segmentPath := filepath.Join(dirPath, "segment-0")
+	offsets := entryOffsets(t, segmentPath)
+	data, err := os.ReadFile(segmentPath)
+	assert.NoError(t, err)
+	data[bytes.Index(data, []byte("entry2"))] = 'E'
+	assert.NoError(t, os.WriteFile(segmentPath, data, 0644))
+
+	reader, err := walog.NewReaderFromOffset(0)
+	assert.NoError(t, err, "Failed to create reader")
+	defer reader.Close()
+
+	for i := 0; i < 2; i++ {
+		_, err := reader.Next()
+		assert.NoError(t, err, "Failed to read entry")
+	}
+
+	_, err = reader.Next()
+	var corruptErr *wal.CorruptRecordError
+	assert.True(t, errors.As(err, &corruptErr), "Expected a CorruptRecordError, got %v", err)
+	assert.Equal(t, 0, corruptErr.Segment)
+	assert.Equal(t, offsets[2], corruptErr.Offset)
+}
+
+// Reads from arbitrary sequence numbers of a log spread over several segments,
+// some of which have been deleted.
+func TestReader_ReadFromSequenceNumber(t *testing.T) {
+	t.Parallel()
+	dirPath := "TestReader_ReadFromSequenceNumber"
+	defer os.RemoveAll(dirPath)
+
+	// Tiny segments, so that every entry goes into its own segment, and only
+	// the last few segments are kept.
+	walog, err := wal.OpenWAL(dirPath, true, 16, 5)
+	assert.NoError(t, err, "Failed to create WAL")
+
+	const numEntries = 20
+	for i := 1; i <= numEntries; i++ {
+		assert.NoError(t, walog.WriteEntry([]byte(fmt.Sprintf("entry%d", i))), "Failed to write entry")
+	}
+	assert.NoError(t, walog.Close(), "Failed to close WAL")
+
+	entries, err := walog.ReadFrom(18)
+	assert.NoError(t, err, "Failed to read entries")
+	assert.Equal(t, 3, len(entries), "Number of entries do not match")
+	for i, entry := range entries {
+		assert.Equal(t, uint64(18+i), entry.GetLogSequenceNumber())
+		assert.Equal(t, fmt.Sprintf("entry%d", 18+i), string(entry.GetData()))
+	}
+
+	// Resuming past the end of the log returns nothing.
+	reader, err := walog.NewReaderFrom(numEntries + 1)
+	assert.NoError(t, err, "Failed to create reader")
+	_, err = reader.Next()
+	assert.Equal(t, io.EOF, err)
+	assert.NoError(t, reader.Close())
+
+	// The first entries were deleted along with their segments.
+	_, err = walog.ReadFrom(1)
+	assert.Equal(t, wal.ErrSequenceNumberRemoved, err)
+}
+
+// Reads from many sequence numbers of a log large enough for its segments to
+// have several index points, before and after deleting the index files.
+func TestReader_ReadFromWithSegmentIndex(t *testing.T) {
+	t.Parallel()
+	dirPath := "TestReader_ReadFromWithSegmentIndex"
+	defer os.RemoveAll(dirPath)
+
+	walog, err := wal.OpenWAL(dirPath, false, 1024*1024, 100)
+	assert.NoError(t, err, "Failed to create WAL")
+
+	const numEntries = 5000
+	payload := bytes.Repeat([]byte("x"), 1000)
+	for i := 1; i <= numEntries; i++ {
+		data := append([]byte(fmt.Sprintf("entry%d-", i)), payload...)
+		assert.NoError(t, walog.WriteEntry(data), "Failed to write entry")
+	}
+	assert.NoError(t, walog.Close(), "Failed to close WAL")
+
+	indexFiles, err := filepath.Glob(filepath.Join(dirPath, "segment-*.index"))
+	assert.NoError(t, err)
+	assert.NotEmpty(t, indexFiles, "Sealed segments should have an index")
+
+	assertReadFrom := func(walog *wal.WAL) {
+		for _, lsn := range []uint64{1, 2, 777, 1049, 1050, 2500, 4999, 5000} {
+			reader, err := walog.NewReaderFrom(lsn)
+			assert.NoError(t, err, "Failed to create reader")
+
+			entry, err := reader.Next()
+			assert.NoError(t, err, "Failed to read entry")
+			assert.Equal(t, lsn, entry.GetLogSequenceNumber())
+			assert.True(t, bytes.HasPrefix(entry.GetData(), []byte(fmt.Sprintf("entry%d-", lsn))))
+			assert.NoError(t, reader.Close())
+		}
+	}
+	assertReadFrom(walog)
+
+	// Indexes are rebuilt when reopening the WAL.
+	for _, indexFile := range indexFiles {
+		assert.NoError(t, os.Remove(indexFile))
+	}
+	walog, err = wal.OpenWAL(dirPath, false, 1024*1024, 100)
+	assert.NoError(t, err, "Failed to reopen WAL")
+	defer walog.Close()
+
+	for _, indexFile := range indexFiles {
+		assert.FileExists(t, indexFile)
+	}
+	assertReadFrom(walog)
+}
+
+// Records that cannot be decoded are reported as corrupted instead of causing a
+// panic, along with the sequence number expected at that point.
+func TestReader_ReportsMalformedRecord(t *testing.T) {
+	t.Parallel()
+	dirPath := "TestReader_ReportsMalformedRecord"
+	defer os.RemoveAll(dirPath)
+
+	walog, err := wal.OpenWAL(dirPath, true, maxFileSize, maxSegments)
+	assert.NoError(t, err, "Failed to create WAL")
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, walog.WriteEntry([]byte(fmt.Sprintf("entry%d", i))), "Failed to write entry")
+	}
+	assert.NoError(t, walog.Close(), "Failed to close WAL")
+
+	// Break the varint encoding of the CRC of the last entry.
+	segmentPath := filepath.Join(dirPath, "segment-0")
+	offsets := entryOffsets(t, segmentPath)
+	data, err := os.ReadFile(segmentPath)
+	assert.NoError(t, err)
+	data[len(data)-1] |= 0x80
+	assert.NoError(t, os.WriteFile(segmentPath, data, 0644))
+
+	_, err = walog.ReadAll(false)
+	assert.ErrorIs(t, err, wal.ErrCorruptRecord)
+
+	_, err = wal.OpenWAL(dirPath, true, maxFileSize, maxSegments)
+	assert.ErrorIs(t, err, wal.ErrCorruptRecord)
+
+	var corruptErr *wal.CorruptRecordError
+	assert.True(t, errors.As(err, &corruptErr), "Expected a CorruptRecordError, got %v", err)
+	assert.Equal(t, 0, corruptErr.Segment)
+	assert.Equal(t, offsets[2], corruptErr.Offset)
+	assert.Equal(t, uint64(3), corruptErr.SequenceNo)
+}
+
+// Readers run concurrently with the writers, and see every entry up to the
+// visible sequence number when they were created, never a half-written record.
+func TestReader_ConcurrentWithWriters(t *testing.T) {
+	t.Parallel()
+	// A tiny buffer, so that records are often partially written out.
+	walog, err := wal.Open("TestReader_ConcurrentWithWriters", wal.WithFS(wal.NewMemFS()),
+		wal.WithMaxFileSize(500), wal.WithMaxSegments(1000), wal.WithBufferSize(16),
+		wal.WithSyncInterval(time.Millisecond))
+	assert.NoError(t, err, "Failed to create WAL")
+	defer walog.Close()
+
+	var writers sync.WaitGroup
+	defer writers.Wait()
+	for w := 0; w < 4; w++ {
+		writers.Add(1)
+		go func(w int) {
+			defer writers.Done()
+			for i := 0; i < 1000; i++ {
+				data := []byte(fmt.Sprintf("writer%d-entry%03d", w, i))
+				if i%10 == 0 {
+					assert.NoError(t, walog.WriteBatch([][]byte{data, data}), "Failed to write batch")
+				} else {
+					assert.NoError(t, walog.WriteEntry(data), "Failed to write entry")
+				}
+			}
+		}(w)
+	}
+
+	// checkEntries checks that the entries are contiguous, from the first one
+	// to at least the given visible sequence number.
+	checkEntries := func(entries []*wal.WAL_Entry, visible uint64) bool {
+		for i, entry := range entries {
+			if !assert.Equal(t, uint64(i+1), entry.GetLogSequenceNumber(), "Entries are not contiguous") {
+				return false
+			}
+		}
+		return assert.GreaterOrEqual(t, uint64(len(entries)), visible, "Visible entries are missing")
+	}
+
+	done := make(chan struct{})
+	go func() {
+		writers.Wait()
+		close(done)
+	}()
+	for reads := 0; ; reads++ {
+		select {
+		case <-done:
+			if reads > 0 {
+				return
+			}
+		default:
+		}
+
+		visible := walog.VisibleSequenceNumber()
+		entries, err := walog.ReadAllFromOffset(-1, false)
+		if !assert.NoError(t, err, "Failed to read entries") || !checkEntries(entries, visible) {
+			return
+		}
+
+		visible = walog.VisibleSequenceNumber()
+		entries, err = walog.ReadFrom(1)
+		if !assert.NoError(t, err, "Failed to read entries") || !checkEntries(entries, visible) {
+			return
+		}
+	}
+}
+
+// Readers do not wait for the writers, and only see the entries written out
+// before they were created.
+func TestReader_DoesNotBlockOnWriters(t *testing.T) {
+	t.Parallel()
+	walog, err := wal.Open("TestReader_DoesNotBlockOnWriters", wal.WithFS(wal.NewMemFS()),
+		wal.WithSyncInterval(time.Hour))
+	assert.NoError(t, err, "Failed to create WAL")
+	defer walog.Close()
+
+	// A subscriber that never receives its entries blocks the writers once its
+	// buffer is full.
+	entries, cancel := walog.Subscribe(1, wal.WithSubscribeBufferSize(1),
+		wal.WithSlowConsumerPolicy(wal.SlowConsumerBlock))
+	assert.NoError(t, walog.WriteEntry([]byte("entry1")), "Failed to write entry")
+	<-entries
+	assert.NoError(t, walog.Sync(), "Failed to sync WAL")
+
+	blocked := make(chan struct{})
+	go func() {
+		defer close(blocked)
+		for i := 2; i <= 4; i++ {
+			walog.WriteEntry([]byte(fmt.Sprintf("entry%d", i)))
+		}
+	}()
+
+	// Once the buffer of the subscriber is full, the following writer gets stuck
+	// on it.
+	for len(entries) < cap(entries) {
+		runtime.Gosched()
+	}
+
+	read := make(chan struct{})
+	go func() {
+		defer close(read)
+		assert.Equal(t, uint64(1), walog.VisibleSequenceNumber())
+
+		all, err := walog.ReadAll(false)
+		assert.NoError(t, err, "Failed to read entries")
+		assert.Len(t, all, 1)
+
+		reader, err := walog.NewReaderFrom(1)
+		assert.NoError(t, err, "Failed to create reader")
+		entry, err := reader.Next()
+		assert.NoError(t, err, "Failed to read entry")
+		assert.Equal(t, "entry1", string(entry.GetData()))
+		_, err = reader.Next()
+		assert.Equal(t, io.EOF, err)
+		reader.Close()
+	}()
+
+	select {
+	case <-read:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Readers were blocked by the writers")
+	}
+
+	select {
+	case <-blocked:
+		t.Fatal("Writers were not blocked by the subscriber")
+	default:
+	}
+	cancel()
+	<-blocked
+}
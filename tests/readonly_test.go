@@ -0,0 +1,115 @@
+package tests
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/JyotinderSingh/go-wal"
+	"github.com/stretchr/testify/assert"
+)
+
+// Opening and reading a read-only WAL never modifies its directory, not even to
+// rebuild missing indexes.
+func TestReadOnly_NeverModifiesDirectory(t *testing.T) {
+	t.Parallel()
+	dirPath := "TestReadOnly_NeverModifiesDirectory"
+	memFS := wal.NewMemFS()
+
+	writer, err := wal.Open(dirPath, wal.WithFS(memFS), wal.WithMaxFileSize(100))
+	assert.NoError(t, err, "Failed to create WAL")
+	for i := 0; i < 20; i++ {
+		assert.NoError(t, writer.WriteEntry([]byte(fmt.Sprintf("entry%02d", i))), "Failed to write entry")
+	}
+	assert.NoError(t, writer.Close(), "Failed to close WAL")
+	assert.NoError(t, memFS.Remove(filepath.Join(dirPath, "segment-0.index")))
+	before := readDirFiles(t, memFS, dirPath)
+
+	fs := wal.NewFaultFS(memFS)
+	walog, err := wal.OpenReadOnly(dirPath, wal.WithFS(fs))
+	assert.NoError(t, err, "Failed to open read-only WAL")
+
+	entries, err := walog.ReadFrom(5)
+	assert.NoError(t, err, "Failed to read entries")
+	assert.Equal(t, 16, len(entries), "Number of entries do not match")
+	entries, err = walog.ReadAllFromOffset(-1, false)
+	assert.NoError(t, err, "Failed to read entries")
+	assert.Equal(t, 20, len(entries), "Number of entries do not match")
+	_, err = walog.ReadAll(false)
+	assert.NoError(t, err, "Failed to read entries")
+	assert.ErrorIs(t, walog.WaitDurable(1), wal.ErrReadOnly)
+	assert.NoError(t, walog.Close(), "Failed to close read-only WAL")
+
+	for _, op := range []wal.FaultOp{wal.FaultWrite, wal.FaultSync, wal.FaultRename, wal.FaultRemove,
+		wal.FaultTruncate, wal.FaultSyncDir} {
+		assert.Zero(t, fs.Count(op), "Unexpected operation %v", op)
+	}
+	assert.Equal(t, before, readDirFiles(t, memFS, dirPath), "The directory should be unchanged")
+}
+
+// A read-only WAL sees the entries flushed by the writer, including the ones
+// written after it was opened, and skips the record being written.
+func TestReadOnly_WhileWriting(t *testing.T) {
+	t.Parallel()
+	dirPath := "TestReadOnly_WhileWriting"
+	fs := wal.NewMemFS()
+
+	// A buffer smaller than the records, so that flushes split them: only the
+	// first 16 bytes of the second record reach the segment.
+	writer, err := wal.Open(dirPath, wal.WithFS(fs), wal.WithMaxFileSize(200), wal.WithBufferSize(16),
+		wal.WithSyncInterval(time.Hour))
+	assert.NoError(t, err, "Failed to create WAL")
+	defer writer.Close()
+	assert.NoError(t, writer.WriteEntry([]byte("entry00")), "Failed to write entry")
+	assert.NoError(t, writer.Sync(), "Failed to sync WAL")
+	assert.NoError(t, writer.WriteEntry([]byte("entry01")), "Failed to write entry")
+
+	walog, err := wal.OpenReadOnly(dirPath, wal.WithFS(fs))
+	assert.NoError(t, err, "Failed to open read-only WAL while a record is being written")
+	defer walog.Close()
+
+	entries, err := walog.ReadFrom(1)
+	assert.NoError(t, err, "Failed to read entries")
+	assert.Equal(t, 1, len(entries), "The record being written should be skipped")
+
+	// Write enough entries to rotate the log several times.
+	assert.NoError(t, writer.Sync(), "Failed to sync WAL")
+	for i := 2; i < 30; i++ {
+		assert.NoError(t, writer.WriteEntry([]byte(fmt.Sprintf("entry%02d", i))), "Failed to write entry")
+	}
+	assert.NoError(t, writer.Sync(), "Failed to sync WAL")
+
+	reader, err := walog.NewReaderFrom(10)
+	assert.NoError(t, err, "Failed to create reader")
+	defer reader.Close()
+	for i := 10; i <= 30; i++ {
+		entry, err := reader.Next()
+		assert.NoError(t, err, "Failed to read entry")
+		assert.Equal(t, uint64(i), entry.GetLogSequenceNumber())
+	}
+	_, err = reader.Next()
+	assert.Equal(t, io.EOF, err)
+
+	// ReadAll reads the segment currently written to.
+	entries, err = walog.ReadAll(false)
+	assert.NoError(t, err, "Failed to read entries")
+	assert.NotEmpty(t, entries)
+	assert.Equal(t, uint64(30), entries[len(entries)-1].GetLogSequenceNumber())
+}
+
+// A read-only WAL cannot be opened before the writer created it.
+func TestReadOnly_MissingWAL(t *testing.T) {
+	t.Parallel()
+	fs := wal.NewMemFS()
+	assert.NoError(t, fs.MkdirAll("TestReadOnly_MissingWAL", 0755))
+
+	_, err := wal.OpenReadOnly("TestReadOnly_MissingWAL", wal.WithFS(fs))
+	assert.ErrorIs(t, err, os.ErrNotExist)
+
+	names, err := fs.ReadDir("TestReadOnly_MissingWAL")
+	assert.NoError(t, err)
+	assert.Empty(t, names, "Nothing should be created")
+}
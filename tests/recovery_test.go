@@ -0,0 +1,248 @@
+package tests
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/JyotinderSingh/go-wal"
+	"github.com/stretchr/testify/assert"
+)
+
+// An incomplete record at the end of the log, as left by a crash, is truncated
+// when tolerating torn tails, while other corruptions still fail the open.
+func TestRecovery_TolerateTornTail(t *testing.T) {
+	t.Parallel()
+	dirPath := "TestRecovery_TolerateTornTail"
+	defer os.RemoveAll(dirPath)
+
+	walog, err := wal.OpenWAL(dirPath, true, maxFileSize, maxSegments)
+	assert.NoError(t, err, "Failed to create WAL")
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, walog.WriteEntry([]byte(fmt.Sprintf("entry%d", i))), "Failed to write entry")
+	}
+	assert.NoError(t, walog.Close(), "Failed to close WAL")
+
+	// Cut the last record in half.
+	segmentPath := filepath.Join(dirPath, "segment-0")
+	info, err := os.Stat(segmentPath)
+	assert.NoError(t, err)
+	assert.NoError(t, os.Truncate(segmentPath, info.Size()-5))
+
+	_, err = wal.OpenWAL(dirPath, true, maxFileSize, maxSegments)
+	assert.ErrorIs(t, err, wal.ErrCorruptRecord, "Strict recovery should fail")
+
+	policy := wal.RecoveryPolicy{Mode: wal.RecoveryTolerateTornTail}
+	walog, err = wal.OpenWALWithRecovery(dirPath, true, maxFileSize, maxSegments, policy)
+	assert.NoError(t, err, "Failed to open WAL")
+
+	lsn, err := walog.Append([]byte("entry3"))
+	assert.NoError(t, err, "Failed to append entry")
+	assert.Equal(t, uint64(3), lsn)
+	assert.NoError(t, walog.Close(), "Failed to close WAL")
+
+	entries, err := walog.ReadAll(false)
+	assert.NoError(t, err, "Failed to read entries")
+	assert.Equal(t, []string{"entry0", "entry1", "entry3"}, entryData(entries))
+
+	// A corrupted record that is complete is not a torn tail.
+	corruptSegment(t, wal.OSFS(), segmentPath, "entry1")
+	_, err = wal.OpenWALWithRecovery(dirPath, true, maxFileSize, maxSegments, policy)
+	assert.ErrorIs(t, err, wal.ErrCorruptRecord)
+}
+
+// Strict recovery fails on a corrupted record in a sealed segment too, even if
+// its index was persisted.
+func TestRecovery_StrictSealedSegment(t *testing.T) {
+	t.Parallel()
+	dirPath := "TestRecovery_StrictSealedSegment"
+	defer os.RemoveAll(dirPath)
+
+	walog, err := wal.OpenWAL(dirPath, true, 100, 10)
+	assert.NoError(t, err, "Failed to create WAL")
+	for i := 0; i < 20; i++ {
+		assert.NoError(t, walog.WriteEntry([]byte(fmt.Sprintf("entry%02d", i))), "Failed to write entry")
+	}
+	assert.NoError(t, walog.Close(), "Failed to close WAL")
+
+	corruptSegment(t, wal.OSFS(), segmentFilePath(dirPath, 1), "entry06")
+	_, err = wal.OpenWAL(dirPath, true, 100, 10)
+	assert.ErrorIs(t, err, wal.ErrCorruptRecord, "Strict recovery should fail")
+	policy := wal.RecoveryPolicy{Mode: wal.RecoveryTolerateTornTail}
+	_, err = wal.OpenWALWithRecovery(dirPath, true, 100, 10, policy)
+	assert.ErrorIs(t, err, wal.ErrCorruptRecord, "Tolerating torn tails should fail")
+}
+
+// Corrupted records are dropped from every segment when skipping them.
+func TestRecovery_SkipCorrupted(t *testing.T) {
+	t.Parallel()
+	dirPath := "TestRecovery_SkipCorrupted"
+	defer os.RemoveAll(dirPath)
+
+	walog, err := wal.OpenWAL(dirPath, true, 100, 10)
+	assert.NoError(t, err, "Failed to create WAL")
+	for i := 0; i < 12; i++ {
+		assert.NoError(t, walog.WriteEntry([]byte(fmt.Sprintf("entry%02d", i))), "Failed to write entry")
+	}
+	assert.NoError(t, walog.Close(), "Failed to close WAL")
+
+	// Corrupt one entry in the first segment, and one in the last.
+	segmentIDs := segmentIDsOf(t, wal.OSFS(), dirPath)
+	corruptSegment(t, wal.OSFS(), segmentFilePath(dirPath, segmentIDs[0]), "entry01")
+	corruptSegment(t, wal.OSFS(), segmentFilePath(dirPath, segmentIDs[len(segmentIDs)-1]), "entry11")
+
+	policy := wal.RecoveryPolicy{Mode: wal.RecoverySkipCorrupted}
+	walog, err = wal.OpenWALWithRecovery(dirPath, true, 100, 10, policy)
+	assert.NoError(t, err, "Failed to open WAL")
+
+	lsn, err := walog.Append([]byte("entry12"))
+	assert.NoError(t, err, "Failed to append entry")
+	assert.Equal(t, uint64(12), lsn, "Sequence numbers should resume after the last valid entry")
+	assert.NoError(t, walog.Close(), "Failed to close WAL")
+
+	entries, err := walog.ReadAllFromOffset(-1, false)
+	assert.NoError(t, err, "Failed to read entries")
+	var expected []string
+	for i := 0; i <= 12; i++ {
+		if i != 1 && i != 11 {
+			expected = append(expected, fmt.Sprintf("entry%02d", i))
+		}
+	}
+	assert.Equal(t, expected, entryData(entries))
+}
+
+// Opening the log at a point in time discards the entries following it, along
+// with the segments holding them.
+func TestRecovery_PointInTime(t *testing.T) {
+	t.Parallel()
+	dirPath := "TestRecovery_PointInTime"
+	defer os.RemoveAll(dirPath)
+
+	walog, err := wal.OpenWAL(dirPath, true, 100, 10)
+	assert.NoError(t, err, "Failed to create WAL")
+	for i := 0; i < 20; i++ {
+		assert.NoError(t, walog.WriteEntry([]byte(fmt.Sprintf("entry%02d", i))), "Failed to write entry")
+	}
+	assert.NoError(t, walog.Close(), "Failed to close WAL")
+	segmentCount := len(segmentIDsOf(t, wal.OSFS(), dirPath))
+
+	policy := wal.RecoveryPolicy{Mode: wal.RecoveryPointInTime, StopSequenceNo: 7}
+	walog, err = wal.OpenWALWithRecovery(dirPath, true, 100, 10, policy)
+	assert.NoError(t, err, "Failed to open WAL")
+
+	lsn, err := walog.Append([]byte("next"))
+	assert.NoError(t, err, "Failed to append entry")
+	assert.Equal(t, uint64(8), lsn)
+	assert.NoError(t, walog.Close(), "Failed to close WAL")
+
+	entries, err := walog.ReadAllFromOffset(-1, false)
+	assert.NoError(t, err, "Failed to read entries")
+	assert.Equal(t, 8, len(entries), "Number of entries do not match")
+	for i, entry := range entries[:7] {
+		assert.Equal(t, fmt.Sprintf("entry%02d", i), string(entry.GetData()))
+	}
+
+	// The discarded segments are quarantined, not deleted.
+	dirEntries, err := os.ReadDir(dirPath)
+	assert.NoError(t, err)
+	quarantined := 0
+	for _, dirEntry := range dirEntries {
+		if strings.Contains(dirEntry.Name(), ".quarantined-") {
+			quarantined++
+		}
+	}
+	assert.Equal(t, segmentCount-len(segmentIDsOf(t, wal.OSFS(), dirPath)), quarantined)
+	assert.Greater(t, quarantined, 0)
+}
+
+// A crash while opening the log at a point in time leaves a log without holes,
+// holding the entries up to that point and possibly some of the following ones.
+func TestRecovery_PointInTimeCrash(t *testing.T) {
+	t.Parallel()
+	for _, op := range []wal.FaultOp{wal.FaultRename, wal.FaultRemove, wal.FaultSyncDir} {
+		for n := 1; ; n++ {
+			dirPath := fmt.Sprintf("TestRecovery_PointInTimeCrash-%v-%d", op, n)
+			memFS := wal.NewMemFS()
+			fs := wal.NewFaultFS(memFS)
+			opts := []wal.Option{wal.WithMaxFileSize(100), wal.WithMaxSegments(100)}
+
+			// Five entries per segment.
+			walog, err := wal.Open(dirPath, append(opts, wal.WithFS(memFS))...)
+			assert.NoError(t, err, "Failed to create WAL")
+			writeTestEntries(t, walog, 1, 20)
+			assert.NoError(t, walog.Close(), "Failed to close WAL")
+
+			fs.Inject(wal.Fault{Op: op, N: n, Crash: true})
+			policy := wal.RecoveryPolicy{Mode: wal.RecoveryPointInTime, StopSequenceNo: 7}
+			walog, err = wal.Open(dirPath, append(opts, wal.WithFS(fs), wal.WithRecovery(policy))...)
+			crashed := fs.Crashed()
+			if err == nil {
+				walog.Close()
+			}
+
+			walog, err = wal.Open(dirPath, append(opts, wal.WithFS(memFS))...)
+			if !assert.NoError(t, err, "Failed to reopen WAL after %v %d", op, n) {
+				return
+			}
+			entries, err := walog.ReadAllFromOffset(-1, false)
+			assert.NoError(t, err, "Failed to read entries")
+			assert.GreaterOrEqual(t, len(entries), 7, "Entries to keep are missing after %v %d", op, n)
+			assertEntriesFrom(t, entries, 1, uint64(len(entries)))
+			assert.NoError(t, walog.Close(), "Failed to close WAL")
+
+			if !crashed {
+				assert.Len(t, entries, 7)
+				break
+			}
+		}
+	}
+}
+
+// Batches are discarded as a whole when the stop sequence number falls in the
+// middle of them.
+func TestRecovery_PointInTimeBatch(t *testing.T) {
+	t.Parallel()
+	dirPath := "TestRecovery_PointInTimeBatch"
+	defer os.RemoveAll(dirPath)
+
+	walog, err := wal.OpenWAL(dirPath, true, maxFileSize, maxSegments)
+	assert.NoError(t, err, "Failed to create WAL")
+	assert.NoError(t, walog.WriteEntry([]byte("entry1")), "Failed to write entry")
+	assert.NoError(t, walog.WriteBatch([][]byte{[]byte("batch1"), []byte("batch2"), []byte("batch3")}),
+		"Failed to write batch")
+	assert.NoError(t, walog.WriteEntry([]byte("entry2")), "Failed to write entry")
+	assert.NoError(t, walog.Close(), "Failed to close WAL")
+
+	policy := wal.RecoveryPolicy{Mode: wal.RecoveryPointInTime, StopSequenceNo: 3}
+	walog, err = wal.OpenWALWithRecovery(dirPath, true, maxFileSize, maxSegments, policy)
+	assert.NoError(t, err, "Failed to open WAL")
+
+	lsn, err := walog.Append([]byte("entry3"))
+	assert.NoError(t, err, "Failed to append entry")
+	assert.Equal(t, uint64(2), lsn)
+	assert.NoError(t, walog.Close(), "Failed to close WAL")
+
+	entries, err := walog.ReadAll(false)
+	assert.NoError(t, err, "Failed to read entries")
+	assert.Equal(t, []string{"entry1", "entry3"}, entryData(entries))
+}
+
+func TestRecovery_InvalidMode(t *testing.T) {
+	t.Parallel()
+	dirPath := "TestRecovery_InvalidMode"
+	defer os.RemoveAll(dirPath)
+
+	walog, err := wal.OpenWAL(dirPath, true, maxFileSize, maxSegments)
+	assert.NoError(t, err, "Failed to create WAL")
+	assert.NoError(t, walog.Close(), "Failed to close WAL")
+
+	_, err = wal.OpenWALWithRecovery(dirPath, true, maxFileSize, maxSegments, wal.RecoveryPolicy{Mode: 42})
+	assert.ErrorIs(t, err, wal.ErrInvalidRecoveryMode)
+
+	// Even if there is nothing to recover.
+	_, err = wal.Open(dirPath+"-empty", wal.WithFS(wal.NewMemFS()), wal.WithRecovery(wal.RecoveryPolicy{Mode: 42}))
+	assert.ErrorIs(t, err, wal.ErrInvalidRecoveryMode)
+	assert.ErrorIs(t, err, wal.ErrInvalidOption)
+}
@@ -0,0 +1,147 @@
+package tests
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/JyotinderSingh/go-wal"
+	"github.com/stretchr/testify/assert"
+)
+
+// Repairs a log whose corruption is in a segment other than the last one, while
+// it is open: the corrupted segment is truncated, the following ones are
+// quarantined, and the next entries are appended after the last one kept.
+func TestRepair_RepairAll(t *testing.T) {
+	t.Parallel()
+	dirPath := "TestRepair_RepairAll"
+	defer os.RemoveAll(dirPath)
+
+	// Small segments, so that the entries are spread over several of them.
+	walog, err := wal.OpenWAL(dirPath, true, 100, 10)
+	assert.NoError(t, err, "Failed to create WAL")
+	for i := 0; i < 20; i++ {
+		assert.NoError(t, walog.WriteEntry([]byte(fmt.Sprintf("entry%02d", i))), "Failed to write entry")
+	}
+	assert.NoError(t, walog.Sync(), "Failed to sync WAL")
+
+	segments := segmentIDsOf(t, wal.OSFS(), dirPath)
+	assert.Greater(t, len(segments), 3, "Expected several segments")
+
+	// Corrupt the second entry of segment 1.
+	segmentPath := filepath.Join(dirPath, "segment-1")
+	offsets := entryOffsets(t, segmentPath)
+	data, err := os.ReadFile(segmentPath)
+	assert.NoError(t, err)
+	corrupted := data[offsets[1]+4:]
+	entryIndex := bytes.Index(corrupted, []byte("entry"))
+	corrupted[entryIndex] = 'E'
+	assert.NoError(t, os.WriteFile(segmentPath, data, 0644))
+
+	report, err := walog.RepairAll()
+	assert.NoError(t, err, "Failed to repair WAL")
+	assert.Equal(t, []int{0, 1}, report.KeptSegments)
+	assert.NotNil(t, report.Corruption, "Expected the corruption to be reported")
+	assert.Equal(t, 1, report.Corruption.Segment)
+	assert.Equal(t, offsets[1], report.Corruption.Offset)
+	assert.Equal(t, int64(len(data))-offsets[1], report.TruncatedBytes)
+	assert.Equal(t, len(segments)-2, len(report.QuarantinedSegments))
+
+	// Quarantined segments are moved aside, not deleted.
+	for segmentID := 2; segmentID < len(segments); segmentID++ {
+		quarantinedPath, ok := report.QuarantinedSegments[segmentID]
+		assert.True(t, ok, "Segment %d should have been quarantined", segmentID)
+		_, err := os.Stat(quarantinedPath)
+		assert.NoError(t, err, "Quarantined segment should exist")
+		_, err = os.Stat(filepath.Join(dirPath, fmt.Sprintf("segment-%d", segmentID)))
+		assert.True(t, os.IsNotExist(err), "Segment %d should have been moved", segmentID)
+	}
+
+	// The log now ends right before the corrupted entry, and goes on from there.
+	lsn, err := walog.Append([]byte("next"))
+	assert.NoError(t, err, "Failed to append entry")
+	assert.Equal(t, report.LastSequenceNo+1, lsn)
+	assert.NoError(t, walog.Close(), "Failed to close WAL")
+	_, err = walog.RepairAll()
+	assert.ErrorIs(t, err, wal.ErrClosed)
+
+	walog, err = wal.OpenWAL(dirPath, true, 100, 10)
+	assert.NoError(t, err, "Failed to reopen WAL")
+	entries, err := walog.ReadFrom(1)
+	assert.NoError(t, err, "Failed to read entries")
+	assert.Equal(t, int(lsn), len(entries), "Number of entries do not match")
+	for i, entry := range entries[:lsn-1] {
+		assert.Equal(t, fmt.Sprintf("entry%02d", i), string(entry.GetData()))
+	}
+	assert.Equal(t, "next", string(entries[lsn-1].GetData()))
+	assert.NoError(t, walog.Close(), "Failed to close WAL")
+}
+
+// Repairing an intact log leaves it untouched.
+func TestRepair_RepairAllIntactLog(t *testing.T) {
+	t.Parallel()
+	dirPath := "TestRepair_RepairAllIntactLog"
+	defer os.RemoveAll(dirPath)
+
+	walog, err := wal.OpenWAL(dirPath, true, 100, 10)
+	assert.NoError(t, err, "Failed to create WAL")
+	for i := 0; i < 10; i++ {
+		assert.NoError(t, walog.WriteEntry([]byte(fmt.Sprintf("entry%02d", i))), "Failed to write entry")
+	}
+	assert.NoError(t, walog.Close(), "Failed to close WAL")
+
+	segments := segmentIDsOf(t, wal.OSFS(), dirPath)
+
+	report, err := wal.RepairDirectory(dirPath)
+	assert.NoError(t, err, "Failed to repair WAL")
+	assert.Nil(t, report.Corruption)
+	assert.Equal(t, len(segments), len(report.KeptSegments))
+	assert.Equal(t, uint64(10), report.LastSequenceNo)
+	assert.Equal(t, int64(0), report.TruncatedBytes)
+	assert.Empty(t, report.QuarantinedSegments)
+}
+
+// A crash during a repair leaves a log that the next repair fixes, without
+// keeping the entries after a hole.
+func TestRepair_RepairAllCrash(t *testing.T) {
+	t.Parallel()
+	for _, op := range []wal.FaultOp{wal.FaultRename, wal.FaultRemove, wal.FaultSyncDir} {
+		for n := 1; ; n++ {
+			dirPath := fmt.Sprintf("TestRepair_RepairAllCrash-%v-%d", op, n)
+			memFS := wal.NewMemFS()
+			fs := wal.NewFaultFS(memFS)
+			opts := []wal.Option{wal.WithFS(memFS), wal.WithMaxFileSize(100), wal.WithMaxSegments(100)}
+
+			// Five entries per segment, the third segment is corrupted.
+			walog, err := wal.Open(dirPath, opts...)
+			assert.NoError(t, err, "Failed to create WAL")
+			writeTestEntries(t, walog, 1, 20)
+			assert.NoError(t, walog.Close(), "Failed to close WAL")
+			corruptSegment(t, memFS, segmentFilePath(dirPath, 2), "entry13")
+
+			fs.Inject(wal.Fault{Op: op, N: n, Crash: true})
+			_, err = wal.RepairDirectory(dirPath, wal.WithFS(fs), wal.WithMaxFileSize(100))
+			crashed := fs.Crashed()
+			if !crashed {
+				assert.NoError(t, err, "Failed to repair WAL")
+			}
+
+			_, err = wal.RepairDirectory(dirPath, opts...)
+			assert.NoError(t, err, "Failed to repair WAL after %v %d", op, n)
+			walog, err = wal.Open(dirPath, opts...)
+			if !assert.NoError(t, err, "Failed to reopen WAL after %v %d", op, n) {
+				return
+			}
+			entries, err := walog.ReadAllFromOffset(-1, false)
+			assert.NoError(t, err, "Failed to read entries")
+			assertEntriesFrom(t, entries, 1, 12)
+			assert.NoError(t, walog.Close(), "Failed to close WAL")
+
+			if !crashed {
+				break
+			}
+		}
+	}
+}
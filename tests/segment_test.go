@@ -0,0 +1,172 @@
+package tests
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/JyotinderSingh/go-wal"
+	"github.com/stretchr/testify/assert"
+)
+
+// Segments are created with a header starting with the magic bytes.
+func TestSegment_Header(t *testing.T) {
+	t.Parallel()
+	dirPath := "TestSegment_Header"
+	defer os.RemoveAll(dirPath)
+
+	walog, err := wal.OpenWAL(dirPath, true, maxFileSize, maxSegments)
+	assert.NoError(t, err, "Failed to create WAL")
+	assert.NoError(t, walog.WriteEntry([]byte("entry1")), "Failed to write entry")
+	assert.NoError(t, walog.Close(), "Failed to close WAL")
+
+	data, err := os.ReadFile(filepath.Join(dirPath, "segment-0"))
+	assert.NoError(t, err)
+	assert.True(t, bytes.HasPrefix(data, []byte("GWAL")), "Missing segment header")
+	assert.Equal(t, uint64(1), binary.LittleEndian.Uint64(data[8:]), "Unexpected base sequence number")
+}
+
+// Segments written before headers were introduced are still readable, and can
+// be appended to.
+func TestSegment_HeaderlessSegment(t *testing.T) {
+	t.Parallel()
+	dirPath := "TestSegment_HeaderlessSegment"
+	defer os.RemoveAll(dirPath)
+
+	// Write a segment the way older versions did.
+	assert.NoError(t, os.MkdirAll(dirPath, 0755))
+	writeLegacySegment(t, filepath.Join(dirPath, "segment-0"), nil, []string{"entry1", "entry2"})
+
+	walog, err := wal.OpenWAL(dirPath, true, maxFileSize, maxSegments)
+	assert.NoError(t, err, "Failed to open WAL")
+
+	lsn, err := walog.Append([]byte("entry3"))
+	assert.NoError(t, err, "Failed to append entry")
+	assert.Equal(t, uint64(3), lsn)
+	assert.NoError(t, walog.Close(), "Failed to close WAL")
+
+	entries, err := walog.ReadAll(false)
+	assert.NoError(t, err, "Failed to recover entries")
+	assert.Equal(t, 3, len(entries), "Number of entries do not match")
+	for i, entry := range entries {
+		assert.Equal(t, uint64(i+1), entry.GetLogSequenceNumber())
+	}
+}
+
+// Segments written in an unknown format version are rejected with a clear
+// error.
+func TestSegment_UnsupportedVersion(t *testing.T) {
+	t.Parallel()
+	dirPath := "TestSegment_UnsupportedVersion"
+	defer os.RemoveAll(dirPath)
+
+	walog, err := wal.OpenWAL(dirPath, true, maxFileSize, maxSegments)
+	assert.NoError(t, err, "Failed to create WAL")
+	assert.NoError(t, walog.WriteEntry([]byte("entry1")), "Failed to write entry")
+	assert.NoError(t, walog.Close(), "Failed to close WAL")
+
+	// Bump the format version, and fix up the header CRC.
+	segmentPath := filepath.Join(dirPath, "segment-0")
+	data, err := os.ReadFile(segmentPath)
+	assert.NoError(t, err)
+	binary.LittleEndian.PutUint16(data[4:], 99)
+	binary.LittleEndian.PutUint32(data[segmentHeaderSize-4:], crc32.ChecksumIEEE(data[:segmentHeaderSize-4]))
+	assert.NoError(t, os.WriteFile(segmentPath, data, 0644))
+
+	_, err = wal.OpenWAL(dirPath, true, maxFileSize, maxSegments)
+	assert.ErrorIs(t, err, wal.ErrUnsupportedFormat)
+}
+
+// Segments with the first version of the header use the original CRC rule, and
+// are still readable and appendable.
+func TestSegment_Version1Segment(t *testing.T) {
+	t.Parallel()
+	dirPath := "TestSegment_Version1Segment"
+	defer os.RemoveAll(dirPath)
+
+	assert.NoError(t, os.MkdirAll(dirPath, 0755))
+	writeLegacySegment(t, filepath.Join(dirPath, "segment-0"), encodeSegmentHeader(1, 1), []string{"entry1", "entry2"})
+
+	walog, err := wal.OpenWAL(dirPath, true, maxFileSize, maxSegments)
+	assert.NoError(t, err, "Failed to open WAL")
+
+	lsn, err := walog.Append([]byte("entry3"))
+	assert.NoError(t, err, "Failed to append entry")
+	assert.Equal(t, uint64(3), lsn)
+	assert.NoError(t, walog.Close(), "Failed to close WAL")
+
+	entries, err := walog.ReadAll(false)
+	assert.NoError(t, err, "Failed to recover entries")
+	assert.Equal(t, 3, len(entries), "Number of entries do not match")
+}
+
+// The CRC of new segments covers the full sequence number, which the original
+// CRC rule only covered the low byte of.
+func TestSegment_CRCCoversSequenceNumber(t *testing.T) {
+	t.Parallel()
+	dirPath := "TestSegment_CRCCoversSequenceNumber"
+	defer os.RemoveAll(dirPath)
+
+	walog, err := wal.OpenWAL(dirPath, true, maxFileSize, maxSegments)
+	assert.NoError(t, err, "Failed to create WAL")
+	assert.NoError(t, walog.WriteEntry([]byte("entry1")), "Failed to write entry")
+	assert.NoError(t, walog.WriteEntry([]byte("entry2")), "Failed to write entry")
+	assert.NoError(t, walog.Close(), "Failed to close WAL")
+
+	entries, err := walog.ReadAll(false)
+	assert.NoError(t, err, "Failed to recover entries")
+
+	// Rewrite the segment with the second entry moved 256 sequence numbers
+	// ahead, keeping its CRC.
+	segmentPath := filepath.Join(dirPath, "segment-0")
+	data, err := os.ReadFile(segmentPath)
+	assert.NoError(t, err)
+
+	var segment bytes.Buffer
+	segment.Write(data[:segmentHeaderSize])
+	entries[1].LogSequenceNumber += 256
+	for _, entry := range entries {
+		marshaledEntry := wal.MustMarshal(entry)
+		assert.NoError(t, binary.Write(&segment, binary.LittleEndian, int32(len(marshaledEntry))))
+		segment.Write(marshaledEntry)
+	}
+	assert.NoError(t, os.WriteFile(segmentPath, segment.Bytes(), 0644))
+
+	_, err = walog.ReadAll(false)
+	var corruptErr *wal.CorruptRecordError
+	assert.ErrorAs(t, err, &corruptErr)
+}
+
+// encodeSegmentHeader encodes a segment header with the given format version
+// and base sequence number.
+func encodeSegmentHeader(version uint16, baseSequenceNo uint64) []byte {
+	header := []byte("GWAL")
+	header = binary.LittleEndian.AppendUint16(header, version)
+	header = binary.LittleEndian.AppendUint16(header, 0)
+	header = binary.LittleEndian.AppendUint64(header, baseSequenceNo)
+	header = binary.LittleEndian.AppendUint64(header, 0)
+	header = binary.LittleEndian.AppendUint32(header, 0)
+	return binary.LittleEndian.AppendUint32(header, crc32.ChecksumIEEE(header))
+}
+
+// writeLegacySegment writes a segment file with the given header (nil for no
+// header), whose entries are checksummed with the original CRC rule.
+func writeLegacySegment(t *testing.T, segmentPath string, header []byte, entries []string) {
+	segment := bytes.NewBuffer(header)
+	for i, data := range entries {
+		lsn := uint64(i + 1)
+		entry := &wal.WAL_Entry{
+			LogSequenceNumber: lsn,
+			Data:              []byte(data),
+			CRC:               crc32.ChecksumIEEE(append([]byte(data), byte(lsn))),
+		}
+		marshaledEntry := wal.MustMarshal(entry)
+		assert.NoError(t, binary.Write(segment, binary.LittleEndian, int32(len(marshaledEntry))))
+		segment.Write(marshaledEntry)
+	}
+
+	assert.NoError(t, os.WriteFile(segmentPath, segment.Bytes(), 0644))
+}
@@ -0,0 +1,266 @@
+package tests
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/JyotinderSingh/go-wal"
+	"github.com/stretchr/testify/assert"
+)
+
+// receiveEntries receives count entries from the subscription, and checks that
+// they are the ones starting at the given sequence number.
+func receiveEntries(t *testing.T, entries <-chan *wal.WAL_Entry, sequenceNo uint64, count int) {
+	t.Helper()
+	timeout := time.After(10 * time.Second)
+	for i := 0; i < count; i++ {
+		select {
+		case entry, ok := <-entries:
+			if !assert.True(t, ok, "Subscription ended before entry %d", sequenceNo) {
+				return
+			}
+			assert.Equal(t, sequenceNo, entry.GetLogSequenceNumber())
+			assert.Equal(t, fmt.Sprintf("entry%02d", sequenceNo), string(entry.GetData()))
+			sequenceNo++
+		case <-timeout:
+			t.Fatalf("Timed out waiting for entry %d", sequenceNo)
+		}
+	}
+}
+
+// A subscriber receives the entries already in the log, then the new ones as
+// they are written, without waiting for a sync.
+func TestSubscription_Written(t *testing.T) {
+	t.Parallel()
+	walog, err := wal.Open("TestSubscription_Written", wal.WithFS(wal.NewMemFS()), wal.WithMaxFileSize(100),
+		wal.WithMaxSegments(100), wal.WithSyncInterval(time.Hour))
+	assert.NoError(t, err, "Failed to create WAL")
+	defer walog.Close()
+
+	for i := 1; i <= 5; i++ {
+		assert.NoError(t, walog.WriteEntry([]byte(fmt.Sprintf("entry%02d", i))), "Failed to write entry")
+	}
+
+	entries, cancel := walog.Subscribe(3)
+	defer cancel()
+	receiveEntries(t, entries, 3, 3)
+
+	for i := 6; i <= 20; i++ {
+		if i%5 == 0 {
+			assert.NoError(t, walog.WriteBatch([][]byte{[]byte(fmt.Sprintf("entry%02d", i))}))
+		} else {
+			assert.NoError(t, walog.WriteEntry([]byte(fmt.Sprintf("entry%02d", i))), "Failed to write entry")
+		}
+	}
+	receiveEntries(t, entries, 6, 15)
+
+	// The entries are delivered without being flushed.
+	assert.NoError(t, walog.WriteEntry([]byte("entry21")), "Failed to write entry")
+	receiveEntries(t, entries, 21, 1)
+}
+
+// A durable subscriber only receives the entries once they are fsynced.
+func TestSubscription_Durable(t *testing.T) {
+	t.Parallel()
+	walog, err := wal.Open("TestSubscription_Durable", wal.WithFS(wal.NewMemFS()),
+		wal.WithSyncInterval(time.Hour))
+	assert.NoError(t, err, "Failed to create WAL")
+	defer walog.Close()
+
+	entries, cancel := walog.Subscribe(1, wal.WithSubscribeMode(wal.SubscribeDurable))
+	defer cancel()
+
+	for i := 1; i <= 3; i++ {
+		assert.NoError(t, walog.WriteEntry([]byte(fmt.Sprintf("entry%02d", i))), "Failed to write entry")
+	}
+	select {
+	case entry := <-entries:
+		t.Fatalf("Received entry %d before it was durable", entry.GetLogSequenceNumber())
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	assert.NoError(t, walog.WaitDurable(2), "Failed to wait for durability")
+	receiveEntries(t, entries, 1, 3)
+
+	sequenceNo, err := walog.AppendWithDurability([]byte("entry04"), wal.DurabilityFsynced)
+	assert.NoError(t, err, "Failed to append entry")
+	assert.Equal(t, uint64(4), sequenceNo)
+	receiveEntries(t, entries, 4, 1)
+}
+
+// A slow subscriber with the resync policy does not slow down the writers, and
+// still receives every entry in order by reading the ones it missed from the
+// log.
+func TestSubscription_SlowConsumerResync(t *testing.T) {
+	t.Parallel()
+	walog, err := wal.Open("TestSubscription_SlowConsumerResync", wal.WithFS(wal.NewMemFS()),
+		wal.WithMaxFileSize(200), wal.WithMaxSegments(1000), wal.WithSyncInterval(time.Hour))
+	assert.NoError(t, err, "Failed to create WAL")
+	defer walog.Close()
+
+	entries, cancel := walog.Subscribe(1, wal.WithSubscribeBufferSize(2))
+	defer cancel()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 1; i <= 99; i++ {
+			walog.WriteEntry([]byte(fmt.Sprintf("entry%02d", i)))
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Writers were blocked by the subscriber")
+	}
+
+	receiveEntries(t, entries, 1, 99)
+}
+
+// A slow subscriber with the block policy makes the writers wait once its
+// buffer is full.
+func TestSubscription_SlowConsumerBlock(t *testing.T) {
+	t.Parallel()
+	walog, err := wal.Open("TestSubscription_SlowConsumerBlock", wal.WithFS(wal.NewMemFS()),
+		wal.WithSyncInterval(time.Hour))
+	assert.NoError(t, err, "Failed to create WAL")
+	defer walog.Close()
+
+	entries, cancel := walog.Subscribe(1, wal.WithSubscribeBufferSize(2),
+		wal.WithSlowConsumerPolicy(wal.SlowConsumerBlock))
+	defer cancel()
+
+	// Wait for the subscriber to catch up with the (empty) log.
+	assert.NoError(t, walog.WriteEntry([]byte("entry01")), "Failed to write entry")
+	receiveEntries(t, entries, 1, 1)
+
+	written := make(chan int, 10)
+	go func() {
+		for i := 2; i <= 10; i++ {
+			walog.WriteEntry([]byte(fmt.Sprintf("entry%02d", i)))
+			written <- i
+		}
+		close(written)
+	}()
+
+	// Once the entry handed to the subscriber and the buffered ones are written,
+	// the writer of the next one waits for the subscriber.
+	for walog.WaitDurable(5) != nil {
+	}
+	for i := 2; i <= 4; i++ {
+		assert.Equal(t, i, <-written)
+	}
+	select {
+	case i := <-written:
+		t.Errorf("Entry %d written while the buffer of the subscriber is full", i)
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	receiveEntries(t, entries, 2, 9)
+	for range written {
+	}
+}
+
+// A writer waiting for a slow subscriber with the block policy does not hold up
+// the other operations of the WAL.
+func TestSubscription_SlowConsumerBlockOnlyWriters(t *testing.T) {
+	t.Parallel()
+	walog, err := wal.Open("TestSubscription_SlowConsumerBlockOnlyWriters", wal.WithFS(wal.NewMemFS()),
+		wal.WithSyncInterval(time.Hour))
+	assert.NoError(t, err, "Failed to create WAL")
+
+	entries, cancel := walog.Subscribe(1, wal.WithSubscribeBufferSize(1),
+		wal.WithSlowConsumerPolicy(wal.SlowConsumerBlock))
+	defer cancel()
+
+	// Wait for the subscriber to catch up with the (empty) log.
+	assert.NoError(t, walog.WriteEntry([]byte("entry01")), "Failed to write entry")
+	receiveEntries(t, entries, 1, 1)
+
+	written := make(chan struct{})
+	go func() {
+		defer close(written)
+		for i := 2; i <= 10; i++ {
+			walog.WriteEntry([]byte(fmt.Sprintf("entry%02d", i)))
+		}
+	}()
+
+	// The entry handed to the subscriber, the buffered one and the one the
+	// writer waits with are all written, and can be made durable and read
+	// meanwhile.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for walog.WaitDurable(4) != nil {
+		}
+		logged, err := walog.ReadFrom(1)
+		assert.NoError(t, err, "Failed to read entries")
+		assert.GreaterOrEqual(t, len(logged), 4)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Timed out waiting for the entries to become durable")
+	}
+
+	// Closing the WAL releases the writer.
+	assert.NoError(t, walog.Close(), "Failed to close WAL")
+	select {
+	case <-written:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Timed out waiting for the writer")
+	}
+	for range entries {
+	}
+}
+
+// Cancelling a subscription closes its channel, without reporting an error.
+func TestSubscription_Cancel(t *testing.T) {
+	t.Parallel()
+	walog, err := wal.Open("TestSubscription_Cancel", wal.WithFS(wal.NewMemFS()))
+	assert.NoError(t, err, "Failed to create WAL")
+	defer walog.Close()
+
+	entries, cancel := walog.Subscribe(1, wal.WithSubscribeErrorHandler(func(err error) {
+		t.Errorf("Unexpected error: %v", err)
+	}))
+	assert.NoError(t, walog.WriteEntry([]byte("entry01")), "Failed to write entry")
+	receiveEntries(t, entries, 1, 1)
+
+	cancel()
+	for range entries {
+	}
+	assert.NoError(t, walog.WriteEntry([]byte("entry02")), "Failed to write entry after cancel")
+}
+
+// Closing the WAL ends the subscriptions with ErrClosed, and invalid options
+// end them right away.
+func TestSubscription_Errors(t *testing.T) {
+	t.Parallel()
+	walog, err := wal.Open("TestSubscription_Errors", wal.WithFS(wal.NewMemFS()))
+	assert.NoError(t, err, "Failed to create WAL")
+
+	errs := make(chan error, 2)
+	onError := wal.WithSubscribeErrorHandler(func(err error) { errs <- err })
+	written, cancelWritten := walog.Subscribe(1, onError)
+	defer cancelWritten()
+	durable, cancelDurable := walog.Subscribe(1, onError, wal.WithSubscribeMode(wal.SubscribeDurable))
+	defer cancelDurable()
+
+	assert.NoError(t, walog.WriteEntry([]byte("entry01")), "Failed to write entry")
+	receiveEntries(t, written, 1, 1)
+	assert.NoError(t, walog.Close(), "Failed to close WAL")
+
+	for range written {
+	}
+	for range durable {
+	}
+	assert.ErrorIs(t, <-errs, wal.ErrClosed)
+	assert.ErrorIs(t, <-errs, wal.ErrClosed)
+
+	entries, _ := walog.Subscribe(1, onError, wal.WithSubscribeBufferSize(0))
+	for range entries {
+	}
+	assert.ErrorIs(t, <-errs, wal.ErrInvalidOption)
+}
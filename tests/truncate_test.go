@@ -0,0 +1,385 @@
+package tests
+
+import (
+	"fmt"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/JyotinderSingh/go-wal"
+	"github.com/stretchr/testify/assert"
+)
+
+// TruncateFront deletes the segments before the given sequence number, and hides
+// the entries before it in the remaining ones, even after reopening the WAL.
+func TestTruncate_Front(t *testing.T) {
+	t.Parallel()
+	dirPath := "TestTruncate_Front"
+	fs := wal.NewMemFS()
+	opts := []wal.Option{wal.WithFS(fs), wal.WithMaxFileSize(100), wal.WithMaxSegments(100)}
+
+	// Five entries per segment.
+	walog, err := wal.Open(dirPath, opts...)
+	assert.NoError(t, err, "Failed to create WAL")
+	writeTestEntries(t, walog, 1, 20)
+	assert.Len(t, segmentIDsOf(t, fs, dirPath), 4)
+
+	assert.NoError(t, walog.Close(), "Failed to close WAL")
+
+	var deleted []int
+	walog, err = wal.Open(dirPath, append(opts, wal.WithHooks(wal.Hooks{
+		OnSegmentDeleted: func(segmentID int) { deleted = append(deleted, segmentID) },
+	}))...)
+	assert.NoError(t, err, "Failed to reopen WAL")
+
+	assert.NoError(t, walog.TruncateFront(13), "Failed to truncate WAL")
+	assert.Equal(t, []int{0, 1}, deleted)
+	assert.Len(t, segmentIDsOf(t, fs, dirPath), 2)
+
+	checkTruncated := func(walog *wal.WAL, last uint64) {
+		entries, err := walog.ReadAllFromOffset(-1, false)
+		assert.NoError(t, err, "Failed to read entries")
+		assertEntriesFrom(t, entries, 13, last)
+
+		entries, err = walog.ReadFrom(15)
+		assert.NoError(t, err, "Failed to read entries")
+		assertEntriesFrom(t, entries, 15, last)
+
+		_, err = walog.ReadFrom(12)
+		assert.ErrorIs(t, err, wal.ErrSequenceNumberRemoved)
+		_, err = walog.Follow(1)
+		assert.ErrorIs(t, err, wal.ErrSequenceNumberRemoved)
+	}
+	checkTruncated(walog, 20)
+
+	// Truncating before the low-water mark does nothing, and truncating past the
+	// end of the log fails.
+	assert.NoError(t, walog.TruncateFront(5), "Failed to truncate WAL")
+	assert.Error(t, walog.TruncateFront(22))
+	checkTruncated(walog, 20)
+
+	// The low-water mark survives reopening the WAL, and new entries are
+	// appended after it.
+	assert.NoError(t, walog.Close(), "Failed to close WAL")
+	walog, err = wal.Open(dirPath, opts...)
+	assert.NoError(t, err, "Failed to reopen WAL")
+	writeTestEntries(t, walog, 21, 22)
+	checkTruncated(walog, 22)
+
+	readOnly, err := wal.OpenReadOnly(dirPath, wal.WithFS(fs))
+	assert.NoError(t, err, "Failed to open read-only WAL")
+	checkTruncated(readOnly, 22)
+	assert.ErrorIs(t, readOnly.TruncateFront(21), wal.ErrReadOnly)
+	assert.NoError(t, readOnly.Close(), "Failed to close read-only WAL")
+
+	// Truncating the whole log keeps the current segment.
+	assert.NoError(t, walog.TruncateFront(23), "Failed to truncate WAL")
+	assert.Len(t, segmentIDsOf(t, fs, dirPath), 1)
+	entries, err := walog.ReadAllFromOffset(-1, false)
+	assert.NoError(t, err, "Failed to read entries")
+	assert.Empty(t, entries)
+	writeTestEntries(t, walog, 23, 23)
+	entries, err = walog.ReadFrom(23)
+	assert.NoError(t, err, "Failed to read entries")
+	assertEntriesFrom(t, entries, 23, 23)
+	assert.NoError(t, walog.Close(), "Failed to close WAL")
+}
+
+// The sequence numbers removed by TruncateFront are not assigned again once a
+// point-in-time recovery or a repair discarded the entries up to the low-water
+// mark.
+func TestTruncate_FrontThenDiscard(t *testing.T) {
+	t.Parallel()
+	dirPath := "TestTruncate_FrontThenDiscard"
+	fs := wal.NewMemFS()
+
+	walog, err := wal.Open(dirPath, wal.WithFS(fs))
+	assert.NoError(t, err, "Failed to create WAL")
+	writeTestEntries(t, walog, 1, 10)
+	assert.NoError(t, walog.TruncateFront(8), "Failed to truncate WAL")
+	assert.NoError(t, walog.Close(), "Failed to close WAL")
+
+	policy := wal.RecoveryPolicy{Mode: wal.RecoveryPointInTime, StopSequenceNo: 5}
+	walog, err = wal.Open(dirPath, wal.WithFS(fs), wal.WithRecovery(policy))
+	assert.NoError(t, err, "Failed to reopen WAL")
+	entries, err := walog.ReadAllFromOffset(-1, false)
+	assert.NoError(t, err, "Failed to read entries")
+	assert.Empty(t, entries)
+	sequenceNo, err := walog.Append([]byte("entry08"))
+	assert.NoError(t, err, "Failed to append entry")
+	assert.Equal(t, uint64(8), sequenceNo)
+	writeTestEntries(t, walog, 9, 12)
+	assert.NoError(t, walog.TruncateFront(11), "Failed to truncate WAL")
+
+	// The repair discards every entry from the corrupted one, entry 9.
+	corruptSegment(t, fs, segmentFilePath(dirPath, 0), "entry09")
+	report, err := walog.RepairAll()
+	assert.NoError(t, err, "Failed to repair WAL")
+	assert.Equal(t, uint64(8), report.LastSequenceNo)
+	sequenceNo, err = walog.Append([]byte("entry11"))
+	assert.NoError(t, err, "Failed to append entry")
+	assert.Equal(t, uint64(11), sequenceNo)
+	assert.NoError(t, walog.Sync(), "Failed to sync WAL")
+	entries, err = walog.ReadFrom(11)
+	assert.NoError(t, err, "Failed to read entries")
+	assertEntriesFrom(t, entries, 11, 11)
+	assert.NoError(t, walog.Close(), "Failed to close WAL")
+}
+
+// MaxSegments keeps the given number of segments once TruncateFront deleted
+// some of them, rather than deleting the ones holding the entries kept.
+func TestTruncate_FrontWithMaxSegments(t *testing.T) {
+	t.Parallel()
+	dirPath := "TestTruncate_FrontWithMaxSegments"
+	fs := wal.NewMemFS()
+
+	// Five entries per segment.
+	walog, err := wal.Open(dirPath, wal.WithFS(fs), wal.WithMaxFileSize(100), wal.WithMaxSegments(3))
+	assert.NoError(t, err, "Failed to create WAL")
+	writeTestEntries(t, walog, 1, 40)
+	assert.NoError(t, walog.TruncateFront(38), "Failed to truncate WAL")
+	assert.Len(t, segmentIDsOf(t, fs, dirPath), 1)
+
+	writeTestEntries(t, walog, 41, 47)
+	assert.Len(t, segmentIDsOf(t, fs, dirPath), 3)
+	entries, err := walog.ReadFrom(38)
+	assert.NoError(t, err, "Failed to read entries")
+	assertEntriesFrom(t, entries, 38, 47)
+
+	writeTestEntries(t, walog, 48, 60)
+	assert.Len(t, segmentIDsOf(t, fs, dirPath), 3)
+	assert.NoError(t, walog.Close(), "Failed to close WAL")
+}
+
+// TruncateBack removes the entries after the given sequence number across
+// segments, and the following entries are appended right after it.
+func TestTruncate_Back(t *testing.T) {
+	t.Parallel()
+	dirPath := "TestTruncate_Back"
+	fs := wal.NewMemFS()
+	opts := []wal.Option{wal.WithFS(fs), wal.WithMaxFileSize(100), wal.WithMaxSegments(100)}
+
+	// Five entries per segment.
+	walog, err := wal.Open(dirPath, opts...)
+	assert.NoError(t, err, "Failed to create WAL")
+	writeTestEntries(t, walog, 1, 12)
+	// Some of the entries to keep are still buffered.
+	for i := 13; i <= 20; i++ {
+		assert.NoError(t, walog.WriteEntry([]byte(fmt.Sprintf("entry%02d", i))), "Failed to write entry")
+	}
+	assert.NoError(t, walog.TruncateBack(15), "Failed to truncate WAL")
+	assert.NoError(t, walog.WriteBatch([][]byte{[]byte("entry16"), []byte("entry17")}))
+	assert.NoError(t, walog.WriteEntry([]byte("entry18")), "Failed to write entry")
+
+	assert.ErrorContains(t, walog.TruncateBack(16), "batch")
+	assert.NoError(t, walog.TruncateBack(18), "Truncating at the last entry should do nothing")
+	assert.NoError(t, walog.TruncateBack(7), "Failed to truncate WAL")
+	assert.Len(t, segmentIDsOf(t, fs, dirPath), 2)
+
+	sequenceNo, err := walog.Append([]byte("entry08"))
+	assert.NoError(t, err, "Failed to append entry")
+	assert.Equal(t, uint64(8), sequenceNo)
+	writeTestEntries(t, walog, 9, 12)
+
+	entries, err := walog.ReadAllFromOffset(-1, false)
+	assert.NoError(t, err, "Failed to read entries")
+	assertEntriesFrom(t, entries, 1, 12)
+
+	// The truncation survives reopening the WAL.
+	assert.NoError(t, walog.Close(), "Failed to close WAL")
+	walog, err = wal.Open(dirPath, opts...)
+	assert.NoError(t, err, "Failed to reopen WAL")
+	entries, err = walog.ReadFrom(3)
+	assert.NoError(t, err, "Failed to read entries")
+	assertEntriesFrom(t, entries, 3, 12)
+
+	// Entries removed by TruncateFront cannot be kept.
+	assert.NoError(t, walog.TruncateFront(8), "Failed to truncate WAL")
+	assert.ErrorIs(t, walog.TruncateBack(5), wal.ErrSequenceNumberRemoved)
+	assert.NoError(t, walog.TruncateBack(7), "Failed to truncate WAL")
+	writeTestEntries(t, walog, 8, 9)
+	entries, err = walog.ReadAllFromOffset(-1, false)
+	assert.NoError(t, err, "Failed to read entries")
+	assertEntriesFrom(t, entries, 8, 9)
+	assert.NoError(t, walog.Close(), "Failed to close WAL")
+}
+
+// A crash during TruncateBack leaves a log holding the entries to keep and
+// possibly some of the removed ones, without holes.
+func TestTruncate_BackCrash(t *testing.T) {
+	t.Parallel()
+	for _, op := range []wal.FaultOp{wal.FaultRemove, wal.FaultRename, wal.FaultSyncDir} {
+		for n := 1; ; n++ {
+			dirPath := fmt.Sprintf("TestTruncate_BackCrash-%v-%d", op, n)
+			memFS := wal.NewMemFS()
+			fs := wal.NewFaultFS(memFS)
+			walog, err := wal.Open(dirPath, wal.WithFS(fs), wal.WithFsync(true), wal.WithMaxFileSize(100),
+				wal.WithMaxSegments(100))
+			assert.NoError(t, err, "Failed to create WAL")
+			writeTestEntries(t, walog, 1, 20)
+
+			fs.Inject(wal.Fault{Op: op, N: n, Crash: true})
+			walog.TruncateBack(7)
+			crashed := fs.Crashed()
+			walog.Close()
+
+			walog, err = wal.Open(dirPath, wal.WithFS(memFS))
+			if !assert.NoError(t, err, "Failed to reopen WAL after %v %d", op, n) {
+				return
+			}
+			entries, err := walog.ReadAllFromOffset(-1, false)
+			assert.NoError(t, err, "Failed to read entries")
+			assert.GreaterOrEqual(t, len(entries), 7, "Entries to keep are missing after %v %d", op, n)
+			assertEntriesFrom(t, entries, 1, uint64(len(entries)))
+			assert.NoError(t, walog.Close(), "Failed to close WAL")
+
+			if !crashed {
+				assert.Len(t, entries, 7)
+				break
+			}
+		}
+	}
+}
+
+// blockingSyncFS is a wal.FS which counts the fsyncs, and whose next fsync,
+// once blockSync is set, waits for the directory to be listed.
+type blockingSyncFS struct {
+	wal.FS
+	syncs     atomic.Int64
+	blockSync atomic.Bool
+	// syncing is closed once the blocked fsync has started.
+	syncing chan struct{}
+	listed  chan struct{}
+}
+
+func newSlowSyncFS() *blockingSyncFS {
+	return &blockingSyncFS{FS: wal.NewMemFS(), syncing: make(chan struct{}), listed: make(chan struct{}, 1)}
+}
+
+func (fs *blockingSyncFS) OpenFile(name string, flag int, perm os.FileMode) (wal.File, error) {
+	file, err := fs.FS.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &blockingSyncFile{File: file, fs: fs}, nil
+}
+
+func (fs *blockingSyncFS) ReadDir(name string) ([]string, error) {
+	select {
+	case <-fs.syncing:
+		select {
+		case fs.listed <- struct{}{}:
+		default:
+		}
+	default:
+	}
+	return fs.FS.ReadDir(name)
+}
+
+type blockingSyncFile struct {
+	wal.File
+	fs *blockingSyncFS
+}
+
+func (f *blockingSyncFile) Sync() error {
+	if f.fs.blockSync.CompareAndSwap(true, false) {
+		close(f.fs.syncing)
+		<-f.fs.listed
+	}
+	f.fs.syncs.Add(1)
+	return f.File.Sync()
+}
+
+// A group commit in progress during TruncateBack does not make the entries
+// appended after the truncation look durable.
+func TestTruncate_BackDuringGroupCommit(t *testing.T) {
+	t.Parallel()
+	fs := newSlowSyncFS()
+	walog, err := wal.Open("TestTruncate_BackDuringGroupCommit", wal.WithFS(fs), wal.WithFsync(false),
+		wal.WithSyncInterval(time.Hour))
+	assert.NoError(t, err, "Failed to create WAL")
+	defer walog.Close()
+
+	for i := 1; i <= 10; i++ {
+		assert.NoError(t, walog.WriteEntry([]byte(fmt.Sprintf("entry%02d", i))), "Failed to write entry")
+	}
+	// The group commit keeps fsyncing the segment until TruncateBack lists the
+	// segments, right before it waits for the fsync.
+	fs.blockSync.Store(true)
+	waited := make(chan struct{})
+	go func() {
+		defer close(waited)
+		walog.WaitDurable(10)
+	}()
+	<-fs.syncing
+	assert.NoError(t, walog.TruncateBack(5), "Failed to truncate WAL")
+	<-waited
+
+	sequenceNo, err := walog.Append([]byte("entry06"))
+	assert.NoError(t, err, "Failed to append entry")
+	assert.Equal(t, uint64(6), sequenceNo)
+	syncs := fs.syncs.Load()
+	assert.NoError(t, walog.WaitDurable(6), "Failed to wait for durability")
+	assert.Greater(t, fs.syncs.Load(), syncs, "Entry 6 was not fsynced")
+}
+
+// A failure during TruncateBack leaves a usable WAL.
+func TestTruncate_BackFailure(t *testing.T) {
+	t.Parallel()
+	dirPath := "TestTruncate_BackFailure"
+	memFS := wal.NewMemFS()
+	fs := wal.NewFaultFS(memFS)
+	opts := []wal.Option{wal.WithFS(fs), wal.WithMaxFileSize(100), wal.WithMaxSegments(100)}
+
+	walog, err := wal.Open(dirPath, opts...)
+	assert.NoError(t, err, "Failed to create WAL")
+	subscription, cancel := walog.Subscribe(1)
+	defer cancel()
+	writeTestEntries(t, walog, 1, 20)
+	receiveEntries(t, subscription, 1, 20)
+
+	// The entries that could not be removed are neither hidden nor discarded.
+	fs.Inject(wal.Fault{Op: wal.FaultRemove})
+	assert.ErrorIs(t, walog.TruncateBack(7), wal.ErrInjectedFault)
+	entries, err := walog.ReadFrom(1)
+	assert.NoError(t, err, "Failed to read entries")
+	assertEntriesFrom(t, entries, 1, 20)
+	writeTestEntries(t, walog, 21, 21)
+	receiveEntries(t, subscription, 21, 1)
+	assert.NoError(t, walog.Close(), "Failed to close WAL")
+
+	walog, err = wal.Open(dirPath, opts...)
+	assert.NoError(t, err, "Failed to reopen WAL")
+	entries, err = walog.ReadAllFromOffset(-1, false)
+	assert.NoError(t, err, "Failed to read entries")
+	assertEntriesFrom(t, entries, 1, 21)
+	assert.NoError(t, walog.Close(), "Failed to close WAL")
+}
+
+// Subscribers that received entries removed by TruncateBack are ended with
+// ErrSequenceNumberRemoved, the others keep receiving the new entries.
+func TestTruncate_BackSubscribers(t *testing.T) {
+	t.Parallel()
+	walog, err := wal.Open("TestTruncate_BackSubscribers", wal.WithFS(wal.NewMemFS()))
+	assert.NoError(t, err, "Failed to create WAL")
+	defer walog.Close()
+
+	errs := make(chan error, 1)
+	ahead, cancelAhead := walog.Subscribe(1, wal.WithSubscribeErrorHandler(func(err error) { errs <- err }))
+	defer cancelAhead()
+	behind, cancelBehind := walog.Subscribe(1)
+	defer cancelBehind()
+
+	writeTestEntries(t, walog, 1, 10)
+	receiveEntries(t, ahead, 1, 10)
+	receiveEntries(t, behind, 1, 5)
+
+	assert.NoError(t, walog.TruncateBack(5), "Failed to truncate WAL")
+	writeTestEntries(t, walog, 6, 8)
+
+	for range ahead {
+	}
+	assert.ErrorIs(t, <-errs, wal.ErrSequenceNumberRemoved)
+	receiveEntries(t, behind, 6, 3)
+}
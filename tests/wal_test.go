@@ -9,6 +9,7 @@ import (
 	"reflect"
 	"strconv"
 	"strings"
+	"sync"
 	"testing"
 
 	"github.com/JyotinderSingh/go-wal"
@@ -16,8 +17,9 @@ import (
 )
 
 const (
-	maxSegments = 3
-	maxFileSize = 64 * 1000 * 1000 // 64MB
+	maxSegments       = 3
+	maxFileSize       = 64 * 1000 * 1000 // 64MB
+	segmentHeaderSize = 32
 )
 
 func TestWAL_WriteAndRecover(t *testing.T) {
@@ -217,6 +219,35 @@ func TestWAL_WriteRepairRead2(t *testing.T) {
 	assert.Equal(t, "entry1", string(entries[0].Data))
 }
 
+// Repair repairs the last segment of an open WAL in place, and the following
+// entries are appended right after the last one kept. It fails without any
+// segment to repair.
+func TestWAL_RepairOpen(t *testing.T) {
+	t.Parallel()
+	dirPath := "TestWAL_RepairOpen"
+	fs := wal.NewMemFS()
+
+	walog, err := wal.Open(dirPath, wal.WithFS(fs))
+	assert.NoError(t, err, "Failed to create WAL")
+	writeTestEntries(t, walog, 1, 3)
+	assert.NoError(t, walog.WriteEntry([]byte("entry04")), "Failed to write entry")
+
+	corruptSegment(t, fs, segmentFilePath(dirPath, 0), "entry03")
+	entries, err := walog.Repair()
+	assert.NoError(t, err, "Failed to repair WAL")
+	assert.Equal(t, []string{"entry01", "entry02"}, entryData(entries))
+
+	writeTestEntries(t, walog, 3, 4)
+	entries, err = walog.ReadAll(false)
+	assert.NoError(t, err, "Failed to read entries")
+	assertEntriesFrom(t, entries, 1, 4)
+	assert.NoError(t, walog.Close(), "Failed to close WAL")
+
+	assert.NoError(t, fs.Remove(segmentFilePath(dirPath, 0)))
+	_, err = walog.Repair()
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
+
 // Test to verify log segment rotation. Creates very large log files (each file can only go upto 64 mb) to test
 // the rotation logic.
 func TestWAL_LogSegmentRotation(t *testing.T) {
@@ -242,16 +273,10 @@ func TestWAL_LogSegmentRotation(t *testing.T) {
 	_, err = walog.ReadAll(false)
 	assert.NoError(t, err, "Failed to recover entries")
 
-	// Validate that only three files should be present inside the directory
-	// with names segment-1, segment-2 and segment-3 were created.
+	// Validate that only three segment files should be present inside the
+	// directory with names segment-1, segment-2 and segment-3 were created.
 	// Each file should be 64 mb in size.
-	files, err := os.ReadDir(dirPath)
-	assert.NoError(t, err, "Failed to read directory")
-	assert.Equal(t, 3, len(files), "Expected 3 files")
-
-	for _, file := range files {
-		assert.True(t, strings.HasPrefix(file.Name(), "segment-"), "Unexpected file found")
-	}
+	assert.Equal(t, 3, len(segmentIDsOf(t, wal.OSFS(), dirPath)), "Expected 3 files")
 }
 
 func TestWAL_OldestLogDeletion(t *testing.T) {
@@ -280,14 +305,7 @@ func TestWAL_OldestLogDeletion(t *testing.T) {
 	// Validate that only three files should be present inside the directory
 	// with names segment-1, segment-2 and segment-3 were created.
 	// Each file should be 64 mb in size.
-	files, err := os.ReadDir(dirPath)
-	assert.NoError(t, err, "Failed to read directory")
-	assert.Equal(t, 3, len(files), "Expected 3 files")
-
-	for idx, file := range files {
-		assert.Equal(t, file.Name(), fmt.Sprintf("%s%d", "segment-", idx),
-			"Unexpected file found")
-	}
+	assert.Equal(t, []int{0, 1, 2}, segmentIDsOf(t, wal.OSFS(), dirPath), "Unexpected files found")
 
 	// Write entries to WAL
 	for _, entry := range entries {
@@ -301,14 +319,7 @@ func TestWAL_OldestLogDeletion(t *testing.T) {
 	assert.NoError(t, err, "Failed to recover entries")
 
 	// Validate that the oldest log file was deleted
-	files, err = os.ReadDir(dirPath)
-	assert.NoError(t, err, "Failed to read directory")
-	assert.Equal(t, 3, len(files), "Expected 3 files")
-
-	for idx, file := range files {
-		assert.Equal(t, file.Name(), fmt.Sprintf("%s%d", "segment-", idx+2),
-			"Unexpected file found")
-	}
+	assert.Equal(t, []int{2, 3, 4}, segmentIDsOf(t, wal.OSFS(), dirPath), "Unexpected files found")
 }
 
 // Writes 10000 entries to the WAL and then reads them back from offset 0.
@@ -551,3 +562,293 @@ func TestWAL_NoWritesAfterCheckpoint(t *testing.T) {
 	assert.Equal(t, true, recoveredEntries[0].GetIsCheckpoint(), "Expected checkpoint entry")
 	assert.Equal(t, []byte("checkpoint info"), recoveredEntries[0].GetData(), "Checkpoint info does not match")
 }
+
+// Writes a batch of entries and verifies that they are read back with a
+// contiguous range of sequence numbers.
+func TestWAL_WriteBatch(t *testing.T) {
+	t.Parallel()
+	dirPath := "TestWAL_WriteBatch"
+	defer os.RemoveAll(dirPath)
+
+	walog, err := wal.OpenWAL(dirPath, true, maxFileSize, maxSegments)
+	assert.NoError(t, err, "Failed to create WAL")
+
+	assert.NoError(t, walog.WriteEntry([]byte("entry1")), "Failed to write entry")
+	assert.NoError(t, walog.WriteBatch([][]byte{[]byte("batch1"), []byte("batch2"), []byte("batch3")}),
+		"Failed to write batch")
+	assert.NoError(t, walog.WriteEntry([]byte("entry2")), "Failed to write entry")
+	assert.NoError(t, walog.Close(), "Failed to close WAL")
+
+	entries, err := walog.ReadAll(false)
+	assert.NoError(t, err, "Failed to recover entries")
+
+	expected := []string{"entry1", "batch1", "batch2", "batch3", "entry2"}
+	assert.Equal(t, len(expected), len(entries), "Number of entries do not match")
+	for i, entry := range entries {
+		assert.Equal(t, expected[i], string(entry.GetData()))
+		assert.Equal(t, uint64(i+1), entry.GetLogSequenceNumber())
+	}
+}
+
+// Simulates a crash in the middle of writing a batch by cutting the last entry
+// of the batch off the segment file. The whole batch should be dropped on
+// recovery, and by Repair.
+func TestWAL_TornBatch(t *testing.T) {
+	t.Parallel()
+	dirPath := "TestWAL_TornBatch"
+	defer os.RemoveAll(dirPath)
+
+	walog, err := wal.OpenWAL(dirPath, true, maxFileSize, maxSegments)
+	assert.NoError(t, err, "Failed to create WAL")
+
+	assert.NoError(t, walog.WriteEntry([]byte("entry1")), "Failed to write entry")
+	assert.NoError(t, walog.WriteBatch([][]byte{[]byte("batch1"), []byte("batch2"), []byte("batch3")}),
+		"Failed to write batch")
+	assert.NoError(t, walog.Close(), "Failed to close WAL")
+
+	// Cut off the last entry of the batch.
+	segmentPath := filepath.Join(dirPath, "segment-0")
+	offsets := entryOffsets(t, segmentPath)
+	assert.NoError(t, os.Truncate(segmentPath, offsets[len(offsets)-1]))
+
+	walog, err = wal.OpenWAL(dirPath, true, maxFileSize, maxSegments)
+	assert.NoError(t, err, "Failed to reopen WAL")
+
+	entries, err := walog.ReadAll(false)
+	assert.NoError(t, err, "Failed to recover entries")
+	assert.Equal(t, 1, len(entries), "Torn batch should not be visible")
+	assert.Equal(t, "entry1", string(entries[0].GetData()))
+
+	// The sequence numbers of the torn batch are reused.
+	assert.NoError(t, walog.WriteEntry([]byte("entry2")), "Failed to write entry")
+	assert.NoError(t, walog.Close(), "Failed to close WAL")
+
+	entries, err = walog.ReadAll(false)
+	assert.NoError(t, err, "Failed to recover entries")
+	assert.Equal(t, 2, len(entries), "Number of entries do not match")
+	assert.Equal(t, "entry2", string(entries[1].GetData()))
+	assert.Equal(t, uint64(2), entries[1].GetLogSequenceNumber())
+
+	// Tear a batch at the end of the log again, and repair it.
+	walog, err = wal.OpenWAL(dirPath, true, maxFileSize, maxSegments)
+	assert.NoError(t, err, "Failed to reopen WAL")
+	assert.NoError(t, walog.WriteBatch([][]byte{[]byte("batch1"), []byte("batch2")}), "Failed to write batch")
+	assert.NoError(t, walog.Close(), "Failed to close WAL")
+
+	offsets = entryOffsets(t, segmentPath)
+	assert.NoError(t, os.Truncate(segmentPath, offsets[len(offsets)-1]))
+
+	entries, err = walog.Repair()
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(entries), "Number of entries do not match")
+	assert.Equal(t, "entry1", string(entries[0].GetData()))
+	assert.Equal(t, "entry2", string(entries[1].GetData()))
+
+	// Both torn batches should have been dropped from the file.
+	assert.Equal(t, 2, len(entryOffsets(t, segmentPath)), "Repair should drop torn batches")
+}
+
+// Verifies that the sequence numbers returned by the Append methods match the
+// ones stored in the log, including after reopening the WAL.
+func TestWAL_AppendReturnsSequenceNumber(t *testing.T) {
+	t.Parallel()
+	dirPath := "TestWAL_AppendReturnsSequenceNumber"
+	defer os.RemoveAll(dirPath)
+
+	walog, err := wal.OpenWAL(dirPath, true, maxFileSize, maxSegments)
+	assert.NoError(t, err, "Failed to create WAL")
+
+	lsn, err := walog.Append([]byte("entry1"))
+	assert.NoError(t, err, "Failed to append entry")
+	assert.Equal(t, uint64(1), lsn)
+
+	lsn, err = walog.AppendCheckpoint([]byte("checkpoint"))
+	assert.NoError(t, err, "Failed to append checkpoint")
+	assert.Equal(t, uint64(2), lsn)
+
+	lsn, err = walog.AppendBatch([][]byte{[]byte("batch1"), []byte("batch2")})
+	assert.NoError(t, err, "Failed to append batch")
+	assert.Equal(t, uint64(3), lsn)
+	assert.NoError(t, walog.Close(), "Failed to close WAL")
+
+	walog, err = wal.OpenWAL(dirPath, true, maxFileSize, maxSegments)
+	assert.NoError(t, err, "Failed to reopen WAL")
+
+	lsn, err = walog.Append([]byte("entry2"))
+	assert.NoError(t, err, "Failed to append entry")
+	assert.Equal(t, uint64(5), lsn)
+	assert.NoError(t, walog.Close(), "Failed to close WAL")
+
+	// Entries are read back from the checkpoint onwards.
+	entries, err := walog.ReadAll(true)
+	assert.NoError(t, err, "Failed to recover entries")
+	assert.Equal(t, 4, len(entries), "Number of entries do not match")
+	for i, entry := range entries {
+		assert.Equal(t, uint64(i+2), entry.GetLogSequenceNumber())
+	}
+	assert.Equal(t, "entry2", string(entries[len(entries)-1].GetData()))
+}
+
+// Entries appended with a sequence number chosen by the caller are only written
+// if it is the next one of the log.
+func TestWAL_AppendAt(t *testing.T) {
+	t.Parallel()
+	dirPath := "TestWAL_AppendAt"
+	fs := wal.NewMemFS()
+
+	walog, err := wal.Open(dirPath, wal.WithFS(fs))
+	assert.NoError(t, err, "Failed to create WAL")
+
+	assert.NoError(t, walog.AppendAt(1, []byte("entry1")), "Failed to append entry")
+
+	err = walog.AppendAt(3, []byte("entry3"))
+	assert.ErrorIs(t, err, wal.ErrSequenceGap)
+	assert.NotErrorIs(t, err, wal.ErrSequenceDuplicate)
+	var sequenceErr *wal.SequenceNumberError
+	if assert.ErrorAs(t, err, &sequenceErr) {
+		assert.Equal(t, uint64(3), sequenceErr.SequenceNo)
+		assert.Equal(t, uint64(2), sequenceErr.Expected)
+	}
+	assert.ErrorIs(t, walog.AppendAt(1, []byte("entry1")), wal.ErrSequenceDuplicate)
+	assert.ErrorIs(t, walog.AppendAt(0, []byte("entry0")), wal.ErrSequenceDuplicate)
+	assert.ErrorIs(t, walog.AppendBatchAt(1, [][]byte{[]byte("entry1")}), wal.ErrSequenceDuplicate)
+	assert.ErrorIs(t, walog.AppendBatchAt(99, nil), wal.ErrSequenceGap)
+	assert.ErrorIs(t, walog.AppendBatchAt(1, nil), wal.ErrSequenceDuplicate)
+	assert.NoError(t, walog.AppendBatchAt(2, nil), "Failed to append empty batch")
+
+	assert.NoError(t, walog.AppendBatchAt(2, [][]byte{[]byte("entry2"), []byte("entry3")}),
+		"Failed to append batch")
+	lsn, err := walog.Append([]byte("entry4"))
+	assert.NoError(t, err, "Failed to append entry")
+	assert.Equal(t, uint64(4), lsn)
+
+	// Conflicting entries are replaced after truncating them.
+	assert.ErrorIs(t, walog.AppendAt(4, []byte("entry4")), wal.ErrSequenceDuplicate)
+	assert.NoError(t, walog.TruncateBack(3), "Failed to truncate WAL")
+	assert.NoError(t, walog.AppendAt(4, []byte("entry4")), "Failed to append entry")
+	assert.NoError(t, walog.Close(), "Failed to close WAL")
+
+	walog, err = wal.Open(dirPath, wal.WithFS(fs))
+	assert.NoError(t, err, "Failed to reopen WAL")
+	assert.ErrorIs(t, walog.AppendAt(6, []byte("entry6")), wal.ErrSequenceGap)
+	assert.NoError(t, walog.AppendAt(5, []byte("entry5")), "Failed to append entry")
+	assert.NoError(t, walog.Sync(), "Failed to sync WAL")
+
+	entries, err := walog.ReadAllFromOffset(-1, false)
+	assert.NoError(t, err, "Failed to read entries")
+	assert.Equal(t, 5, len(entries), "Number of entries do not match")
+	for i, entry := range entries {
+		assert.Equal(t, uint64(i+1), entry.GetLogSequenceNumber())
+		assert.Equal(t, fmt.Sprintf("entry%d", i+1), string(entry.GetData()))
+	}
+	assert.NoError(t, walog.Close(), "Failed to close WAL")
+}
+
+// Concurrent writers wait for their own entries to become durable. Every entry
+// should be in the segment file once WaitDurable returns.
+func TestWAL_WaitDurable(t *testing.T) {
+	t.Parallel()
+	dirPath := "TestWAL_WaitDurable"
+	defer os.RemoveAll(dirPath)
+
+	walog, err := wal.OpenWAL(dirPath, false, maxFileSize, maxSegments)
+	assert.NoError(t, err, "Failed to create WAL")
+
+	const numWriters = 20
+	const entriesPerWriter = 50
+
+	var wg sync.WaitGroup
+	for i := 0; i < numWriters; i++ {
+		wg.Add(1)
+		go func(id int) {
+			defer wg.Done()
+			for j := 0; j < entriesPerWriter; j++ {
+				lsn, err := walog.Append([]byte(fmt.Sprintf("writer%d-entry%d", id, j)))
+				assert.NoError(t, err, "Failed to append entry")
+				assert.NoError(t, walog.WaitDurable(lsn), "Failed to wait for durability")
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	// Everything should be readable without an explicit Sync.
+	entries, err := walog.ReadAll(false)
+	assert.NoError(t, err, "Failed to recover entries")
+	assert.Equal(t, numWriters*entriesPerWriter, len(entries), "Number of entries do not match")
+
+	// Waiting for an entry that was never written fails instead of blocking.
+	assert.Error(t, walog.WaitDurable(uint64(numWriters*entriesPerWriter+1)))
+
+	assert.NoError(t, walog.Close(), "Failed to close WAL")
+	assert.ErrorIs(t, walog.WaitDurable(uint64(numWriters*entriesPerWriter+1)), wal.ErrClosed)
+}
+
+// Mixes appends with different durability levels, and checks which of them are
+// visible in the segment file.
+func TestWAL_AppendWithDurability(t *testing.T) {
+	t.Parallel()
+	dirPath := "TestWAL_AppendWithDurability"
+	defer os.RemoveAll(dirPath)
+
+	walog, err := wal.OpenWAL(dirPath, false, maxFileSize, maxSegments)
+	assert.NoError(t, err, "Failed to create WAL")
+	defer walog.Close()
+
+	_, err = walog.AppendWithDurability([]byte("buffered"), wal.DurabilityBuffered)
+	assert.NoError(t, err, "Failed to append entry")
+
+	// Buffered entries stay in memory until the next sync (the sync interval is
+	// much longer than this test takes to get here).
+	entries, err := walog.ReadAll(false)
+	assert.NoError(t, err, "Failed to recover entries")
+	assert.Equal(t, 0, len(entries), "Buffered entry should not be in the file yet")
+
+	_, err = walog.AppendWithDurability([]byte("flushed"), wal.DurabilityFlushed)
+	assert.NoError(t, err, "Failed to append entry")
+
+	entries, err = walog.ReadAll(false)
+	assert.NoError(t, err, "Failed to recover entries")
+	assert.Equal(t, 2, len(entries), "Flushing should write out all previous entries")
+
+	lsn, err := walog.AppendBatchWithDurability([][]byte{[]byte("fsynced1"), []byte("fsynced2")}, wal.DurabilityFsynced)
+	assert.NoError(t, err, "Failed to append batch")
+	assert.Equal(t, uint64(3), lsn)
+
+	entries, err = walog.ReadAll(false)
+	assert.NoError(t, err, "Failed to recover entries")
+	assert.Equal(t, 4, len(entries), "Number of entries do not match")
+
+	_, err = walog.AppendWithDurability([]byte("invalid"), wal.Durability(42))
+	assert.Error(t, err, "Invalid durability level should be rejected")
+}
+
+// Reopens the WAL after every log rotation, including with an empty current
+// segment, and verifies that sequence numbers are never reused.
+func TestWAL_SequenceNumberContinuityAcrossRestarts(t *testing.T) {
+	t.Parallel()
+	dirPath := "TestWAL_SequenceNumberContinuityAcrossRestarts"
+	defer os.RemoveAll(dirPath)
+
+	// Tiny segments, so that every append rotates the log, and a single
+	// segment kept at a time, so that previous entries are deleted on rotation.
+	const maxFileSize = 16
+	const maxSegments = 1
+
+	for i := 1; i <= 10; i++ {
+		walog, err := wal.OpenWAL(dirPath, true, maxFileSize, maxSegments)
+		assert.NoError(t, err, "Failed to open WAL")
+
+		lsn, err := walog.Append([]byte(fmt.Sprintf("entry%d", i)))
+		assert.NoError(t, err, "Failed to append entry")
+		assert.Equal(t, uint64(i), lsn, "Sequence number reused after restart")
+		assert.NoError(t, walog.Close(), "Failed to close WAL")
+
+		if i%2 == 0 {
+			// Simulate a crash right after the creation of a new segment by an
+			// older version of the WAL, which left it empty.
+			segmentIDs := segmentIDsOf(t, wal.OSFS(), dirPath)
+			emptySegment := segmentFilePath(dirPath, segmentIDs[len(segmentIDs)-1]+1)
+			assert.NoError(t, os.WriteFile(emptySegment, nil, 0644))
+		}
+	}
+}
@@ -0,0 +1,386 @@
+package wal
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// lowWaterMarkFileName is the name of the file recording the first sequence
+// number kept by TruncateFront.
+const lowWaterMarkFileName = "LOW_WATER_MARK"
+
+// TruncateFront logically removes all the entries before the one with the
+// given sequence number, e.g. once a snapshot covering them has been safely
+// persisted. The segments holding only such entries are deleted; the entries
+// before it in the remaining segments are no longer returned by the readers.
+// Reading from one of them returns ErrSequenceNumberRemoved, like reading from a
+// deleted segment. The current segment is never deleted, even if all its
+// entries are removed.
+//
+// The entries before the given one are made durable, and the low-water mark is
+// then persisted before any segment is deleted, so that the removed entries
+// never come back after a crash and their sequence numbers are never assigned
+// again. Truncating before the current low-water mark is a no-op, and
+// truncating past the next sequence number to be assigned is an error. Returns
+// ErrReadOnly if the WAL is read-only.
+func (wal *WAL) TruncateFront(sequenceNo uint64) error {
+	if wal.readOnly {
+		return ErrReadOnly
+	}
+
+	wal.lock.Lock()
+	defer wal.lock.Unlock()
+
+	if sequenceNo > wal.lastSequenceNo+1 {
+		return fmt.Errorf("cannot truncate the log up to entry %d, past its last entry %d", sequenceNo,
+			wal.lastSequenceNo)
+	}
+	if sequenceNo <= wal.snapshot().firstSequenceNo {
+		return nil
+	}
+
+	// A crash must not leave a low-water mark past the last entry recovered.
+	if sequenceNo-1 > wal.durableSequenceNumber() {
+		if err := wal.flushBuffer(); err != nil {
+			return err
+		}
+		wal.syncLock.Lock()
+		err := wal.syncSegmentDir()
+		wal.syncLock.Unlock()
+		if err != nil {
+			return err
+		}
+		if err := wal.fsyncCurrentSegment(); err != nil {
+			return err
+		}
+	}
+
+	if err := writeLowWaterMark(wal.dir, sequenceNo); err != nil {
+		return err
+	}
+	wal.visibleLock.Lock()
+	wal.visible.firstSequenceNo = sequenceNo
+	wal.visibleLock.Unlock()
+
+	return wal.deleteTruncatedSegments(sequenceNo)
+}
+
+// deleteTruncatedSegments deletes the sealed log segments whose entries are all
+// before the given sequence number, oldest first. Must be called with the lock
+// held.
+func (wal *WAL) deleteTruncatedSegments(sequenceNo uint64) error {
+	segmentIDs, err := listSegmentIDs(wal.dir)
+	if err != nil {
+		return err
+	}
+
+	for i := 0; i+1 < len(segmentIDs) && segmentIDs[i] != wal.currentSegmentIndex; i++ {
+		// The entries of a segment end right before the first entry of the next
+		// one.
+		nextSequenceNo, err := wal.firstSequenceNoOfSegment(segmentIDs[i+1])
+		if err != nil {
+			return err
+		}
+		if nextSequenceNo == 0 || nextSequenceNo > sequenceNo {
+			break
+		}
+
+		if err := wal.deleteSegment(segmentIDs[i]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// firstSequenceNoOfSegment returns the sequence number of the first entry of
+// the given log segment, or of the entry it starts at if it is empty. Returns 0
+// if it is unknown, i.e. for an empty segment without a header.
+func (wal *WAL) firstSequenceNoOfSegment(segmentID int) (uint64, error) {
+	header, err := readSegmentHeaderFromFile(wal.dir, segmentID)
+	if err != nil {
+		return 0, err
+	}
+	if header != nil {
+		return header.baseSequenceNo, nil
+	}
+
+	idx, err := wal.segmentIndex(segmentID)
+	if err != nil {
+		return 0, err
+	}
+	return idx.firstSequenceNo(), nil
+}
+
+// TruncateBack removes all the entries after the one with the given sequence
+// number, across segment boundaries if needed, e.g. to discard the entries of a
+// Raft log that conflict with the leader. The following appends continue from
+// the next sequence number. Truncating at or past the last entry is a no-op,
+// and truncating in the middle of a batch is an error, since batches are
+// atomic. Returns ErrSequenceNumberRemoved if the entries to keep were already
+// removed, and ErrReadOnly if the WAL is read-only.
+//
+// The segments after the one holding the given entry are deleted newest first,
+// and that segment is then atomically truncated, so that a crash midway leaves
+// a log holding the entries to keep and some of the removed ones, never a log
+// with a hole. The entries to keep are durable once it returns.
+//
+// Writers still waiting for the removed entries to become durable fail with
+// ErrSequenceNumberRemoved, as do the subscriptions in SubscribeWritten mode
+// that already delivered some of them. Followers and subscriptions in
+// SubscribeDurable mode past the given entry must be recreated.
+func (wal *WAL) TruncateBack(sequenceNo uint64) error {
+	if wal.readOnly {
+		return ErrReadOnly
+	}
+
+	wal.lock.Lock()
+	defer wal.lock.Unlock()
+
+	if sequenceNo >= wal.lastSequenceNo {
+		return nil
+	}
+	if sequenceNo+1 < wal.snapshot().firstSequenceNo {
+		return fmt.Errorf("entry %d: %w", sequenceNo, ErrSequenceNumberRemoved)
+	}
+
+	// Write out the buffered entries, some of which may be kept.
+	if err := wal.flushBuffer(); err != nil {
+		return err
+	}
+
+	segmentIDs, err := listSegmentIDs(wal.dir)
+	if err != nil {
+		return err
+	}
+	// Find the last segment starting at or before the first entry to remove.
+	last := -1
+	for i := len(segmentIDs) - 1; i >= 0 && last < 0; i-- {
+		firstSequenceNo, err := wal.firstSequenceNoOfSegment(segmentIDs[i])
+		if err != nil {
+			return err
+		}
+		if firstSequenceNo > 0 && firstSequenceNo <= sequenceNo+1 {
+			last = i
+		}
+	}
+	if last < 0 {
+		return fmt.Errorf("entry %d: %w", sequenceNo, ErrSequenceNumberRemoved)
+	}
+	segmentID := segmentIDs[last]
+
+	offset, err := wal.truncationOffset(segmentID, sequenceNo)
+	if err != nil {
+		return err
+	}
+
+	lastSequenceNo := wal.lastSequenceNo
+	wal.syncLock.Lock()
+	err = wal.currentSegment.Close()
+	wal.syncLock.Unlock()
+	if err == nil {
+		err = wal.truncateSegments(segmentIDs[last:], offset)
+	}
+	// Reopen the last segment left even if removing the entries failed midway,
+	// so that the WAL remains usable. Only the entries actually removed are
+	// hidden from the readers and discarded then.
+	if reopenErr := wal.reopenLastSegment(); err == nil {
+		err = reopenErr
+	}
+	wal.discardRemovedEntries(lastSequenceNo)
+
+	return err
+}
+
+// truncateSegments deletes the given log segments but the first one, newest
+// first, and then truncates the first one to the given size. Must be called
+// with the lock held, once the current segment has been closed.
+func (wal *WAL) truncateSegments(segmentIDs []int, size int64) error {
+	for i := len(segmentIDs) - 1; i > 0; i-- {
+		if err := wal.deleteSegment(segmentIDs[i]); err != nil {
+			return err
+		}
+	}
+
+	// The index would point past the end of the truncated segment.
+	segmentID := segmentIDs[0]
+	if err := removeSegmentIndex(wal.dir, segmentID); err != nil {
+		return err
+	}
+	info, err := wal.dir.fs.Stat(segmentPath(wal.dir, segmentID))
+	if err != nil {
+		return err
+	}
+	if info.Size() > size {
+		return truncateSegmentFile(wal.dir, segmentID, size)
+	}
+
+	return nil
+}
+
+// truncationOffset returns the offset right after the record of the entry with
+// the given sequence number in the given log segment, or the offset of its
+// first record if the segment starts after it.
+func (wal *WAL) truncationOffset(segmentID int, sequenceNo uint64) (int64, error) {
+	idx, err := wal.segmentIndex(segmentID)
+	if err != nil {
+		return 0, err
+	}
+
+	file, err := wal.dir.fs.OpenFile(segmentPath(wal.dir, segmentID), os.O_RDONLY, 0644)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	// Index points are never in the middle of a batch.
+	reader, err := seekSegmentReader(file, segmentID, idx.lookup(sequenceNo))
+	if err != nil {
+		return 0, err
+	}
+
+	offset := reader.offset
+	var batch batchAssembler
+	for {
+		entry, err := reader.next()
+		if err == io.EOF {
+			return offset, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+
+		entries := batch.add(entry)
+		if len(entries) == 0 {
+			continue
+		}
+		if entries[0].GetLogSequenceNumber() > sequenceNo {
+			return offset, nil
+		}
+		if entries[len(entries)-1].GetLogSequenceNumber() > sequenceNo {
+			return 0, fmt.Errorf("cannot truncate the log after entry %d, in the middle of a batch", sequenceNo)
+		}
+		offset = reader.offset
+	}
+}
+
+// reopenLastSegment makes the last log segment the current one (see
+// reopenSegment), e.g. once the log has been repaired.
+func (wal *WAL) reopenLastSegment() error {
+	segmentIDs, err := listSegmentIDs(wal.dir)
+	if err != nil {
+		return err
+	}
+	if len(segmentIDs) == 0 {
+		return fmt.Errorf("no log segments in %s: %w", wal.dir.path, os.ErrNotExist)
+	}
+
+	return wal.reopenSegment(segmentIDs[len(segmentIDs)-1])
+}
+
+// reopenSegment makes the given log segment the current one, and appends the
+// following entries after its last one. Its entries and the directory are
+// fsynced, even if fsync is disabled, since it may have been rewritten and
+// renamed into place. Must be called with the lock held, once the current
+// segment has been closed.
+func (wal *WAL) reopenSegment(segmentID int) error {
+	// The index of the current segment is only kept in memory.
+	if err := removeSegmentIndex(wal.dir, segmentID); err != nil {
+		return err
+	}
+
+	file, err := wal.dir.fs.OpenFile(segmentPath(wal.dir, segmentID), os.O_WRONLY, wal.dir.filePerm)
+	if err != nil {
+		return err
+	}
+
+	wal.currentSegment = file
+	wal.currentSegmentIndex = segmentID
+	if wal.currentHeader, err = readSegmentHeaderFromFile(wal.dir, segmentID); err != nil {
+		return err
+	}
+	// Also rebuilds the index of the segment and finds the end of its entries.
+	if wal.lastSequenceNo, err = wal.getLastSequenceNo(); err != nil {
+		return err
+	}
+	wal.lastSequenceNo = keepLowWaterMark(wal.lastSequenceNo, wal.snapshot().firstSequenceNo)
+	if _, err := file.Seek(wal.currentSegmentSize, io.SeekStart); err != nil {
+		return err
+	}
+	wal.bufWriter = bufio.NewWriterSize(file, wal.bufferSize)
+	wal.markVisible()
+
+	wal.syncLock.Lock()
+	wal.segmentDirSynced = false
+	err = wal.syncSegmentDir()
+	wal.syncLock.Unlock()
+	if err != nil {
+		return err
+	}
+	return wal.fsyncCurrentSegment()
+}
+
+// keepLowWaterMark returns the given last sequence number of the log, or the
+// one right before the given low-water mark if the entries up to it were lost,
+// e.g. discarded by a repair or a point-in-time recovery, so that the sequence
+// numbers removed by TruncateFront are never assigned again.
+func keepLowWaterMark(lastSequenceNo, lowWaterMark uint64) uint64 {
+	if lowWaterMark > lastSequenceNo+1 {
+		return lowWaterMark - 1
+	}
+	return lastSequenceNo
+}
+
+// dropTruncatedEntries removes the entries before the given sequence number,
+// removed by TruncateFront, from the given entries.
+func dropTruncatedEntries(entries []*WAL_Entry, firstSequenceNo uint64) []*WAL_Entry {
+	i := 0
+	for i < len(entries) && entries[i].GetLogSequenceNumber() < firstSequenceNo {
+		i++
+	}
+	return entries[i:]
+}
+
+// lowWaterMarkPath returns the path of the file recording the low-water mark.
+func lowWaterMarkPath(dir *walDir) string {
+	return filepath.Join(dir.path, lowWaterMarkFileName)
+}
+
+// readLowWaterMark returns the first sequence number kept by TruncateFront, or
+// 0 if the log was never truncated.
+func readLowWaterMark(dir *walDir) (uint64, error) {
+	data, err := readFile(dir.fs, lowWaterMarkPath(dir))
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	if len(data) != 8 {
+		return 0, fmt.Errorf("invalid low-water mark file size: %d", len(data))
+	}
+
+	return binary.LittleEndian.Uint64(data), nil
+}
+
+// writeLowWaterMark atomically and durably records the first sequence number
+// kept by TruncateFront. The file is fsynced even if fsync is disabled, since a
+// crash must neither leave it empty nor bring the removed entries back.
+func writeLowWaterMark(dir *walDir, sequenceNo uint64) error {
+	data := binary.LittleEndian.AppendUint64(nil, sequenceNo)
+
+	tempFilePath := fmt.Sprintf("%s.tmp", lowWaterMarkPath(dir))
+	if err := writeFile(dir.fs, tempFilePath, data, dir.filePerm, true); err != nil {
+		return err
+	}
+	if err := dir.fs.Rename(tempFilePath, lowWaterMarkPath(dir)); err != nil {
+		return err
+	}
+
+	return dir.fs.SyncDir(dir.path)
+}
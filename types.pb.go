@@ -30,6 +30,9 @@ type WAL_Entry struct {
 	CRC               uint32 `protobuf:"varint,3,opt,name=CRC,proto3" json:"CRC,omitempty"`
 	// Optional field for checkpointing.
 	IsCheckpoint *bool `protobuf:"varint,4,opt,name=isCheckpoint,proto3,oneof" json:"isCheckpoint,omitempty"`
+	// Number of entries in the atomic batch this entry belongs to. Only set
+	// for entries written with WriteBatch.
+	BatchSize *uint32 `protobuf:"varint,5,opt,name=batchSize,proto3,oneof" json:"batchSize,omitempty"`
 }
 
 func (x *WAL_Entry) Reset() {
@@ -92,10 +95,17 @@ func (x *WAL_Entry) GetIsCheckpoint() bool {
 	return false
 }
 
+func (x *WAL_Entry) GetBatchSize() uint32 {
+	if x != nil && x.BatchSize != nil {
+		return *x.BatchSize
+	}
+	return 0
+}
+
 var File_types_proto protoreflect.FileDescriptor
 
 var file_types_proto_rawDesc = []byte{
-	0x0a, 0x0b, 0x74, 0x79, 0x70, 0x65, 0x73, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x22, 0x99, 0x01,
+	0x0a, 0x0b, 0x74, 0x79, 0x70, 0x65, 0x73, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x22, 0xca, 0x01,
 	0x0a, 0x09, 0x57, 0x41, 0x4c, 0x5f, 0x45, 0x6e, 0x74, 0x72, 0x79, 0x12, 0x2c, 0x0a, 0x11, 0x6c,
 	0x6f, 0x67, 0x53, 0x65, 0x71, 0x75, 0x65, 0x6e, 0x63, 0x65, 0x4e, 0x75, 0x6d, 0x62, 0x65, 0x72,
 	0x18, 0x01, 0x20, 0x01, 0x28, 0x04, 0x52, 0x11, 0x6c, 0x6f, 0x67, 0x53, 0x65, 0x71, 0x75, 0x65,
@@ -104,11 +114,14 @@ var file_types_proto_rawDesc = []byte{
 	0x03, 0x43, 0x52, 0x43, 0x18, 0x03, 0x20, 0x01, 0x28, 0x0d, 0x52, 0x03, 0x43, 0x52, 0x43, 0x12,
 	0x27, 0x0a, 0x0c, 0x69, 0x73, 0x43, 0x68, 0x65, 0x63, 0x6b, 0x70, 0x6f, 0x69, 0x6e, 0x74, 0x18,
 	0x04, 0x20, 0x01, 0x28, 0x08, 0x48, 0x00, 0x52, 0x0c, 0x69, 0x73, 0x43, 0x68, 0x65, 0x63, 0x6b,
-	0x70, 0x6f, 0x69, 0x6e, 0x74, 0x88, 0x01, 0x01, 0x42, 0x0f, 0x0a, 0x0d, 0x5f, 0x69, 0x73, 0x43,
-	0x68, 0x65, 0x63, 0x6b, 0x70, 0x6f, 0x69, 0x6e, 0x74, 0x42, 0x26, 0x5a, 0x24, 0x67, 0x69, 0x74,
-	0x68, 0x75, 0x62, 0x2e, 0x63, 0x6f, 0x6d, 0x2f, 0x4a, 0x79, 0x6f, 0x74, 0x69, 0x6e, 0x64, 0x65,
-	0x72, 0x53, 0x69, 0x6e, 0x67, 0x68, 0x2f, 0x67, 0x6f, 0x2d, 0x77, 0x61, 0x6c, 0x2f, 0x77, 0x61,
-	0x6c, 0x62, 0x06, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x33,
+	0x70, 0x6f, 0x69, 0x6e, 0x74, 0x88, 0x01, 0x01, 0x12, 0x21, 0x0a, 0x09, 0x62, 0x61, 0x74, 0x63,
+	0x68, 0x53, 0x69, 0x7a, 0x65, 0x18, 0x05, 0x20, 0x01, 0x28, 0x0d, 0x48, 0x01, 0x52, 0x09, 0x62,
+	0x61, 0x74, 0x63, 0x68, 0x53, 0x69, 0x7a, 0x65, 0x88, 0x01, 0x01, 0x42, 0x0f, 0x0a, 0x0d, 0x5f,
+	0x69, 0x73, 0x43, 0x68, 0x65, 0x63, 0x6b, 0x70, 0x6f, 0x69, 0x6e, 0x74, 0x42, 0x0c, 0x0a, 0x0a,
+	0x5f, 0x62, 0x61, 0x74, 0x63, 0x68, 0x53, 0x69, 0x7a, 0x65, 0x42, 0x26, 0x5a, 0x24, 0x67, 0x69,
+	0x74, 0x68, 0x75, 0x62, 0x2e, 0x63, 0x6f, 0x6d, 0x2f, 0x4a, 0x79, 0x6f, 0x74, 0x69, 0x6e, 0x64,
+	0x65, 0x72, 0x53, 0x69, 0x6e, 0x67, 0x68, 0x2f, 0x67, 0x6f, 0x2d, 0x77, 0x61, 0x6c, 0x2f, 0x77,
+	0x61, 0x6c, 0x62, 0x06, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x33,
 }
 
 var (
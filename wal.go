@@ -2,32 +2,28 @@ package wal
 
 import (
 	"bufio"
+	"bytes"
 	"context"
-	"encoding/binary"
+	"errors"
 	"fmt"
-	"hash/crc32"
 	"io"
-	"log"
 	"math"
 	"os"
-	"path/filepath"
-	"strconv"
-	"strings"
 	"sync"
 	"time"
-
-	"google.golang.org/protobuf/proto"
 )
 
 const (
 	syncInterval  = 200 * time.Millisecond
 	segmentPrefix = "segment-"
+	// lockFileName is the name of the file locked by the writer of a WAL.
+	lockFileName = "LOCK"
 )
 
 // WAL structure
 type WAL struct {
-	directory           string
-	currentSegment      *os.File
+	dir                 *walDir
+	currentSegment      File
 	lock                sync.Mutex
 	lastSequenceNo      uint64
 	bufWriter           *bufio.Writer
@@ -36,8 +32,35 @@ type WAL struct {
 	maxFileSize         int64
 	maxSegments         int
 	currentSegmentIndex int
+	currentSegmentSize  int64          // Including the entries still buffered.
+	currentHeader       *segmentHeader // Nil if the current segment has none.
+	currentIndex        *segmentIndex  // Sparse index of the current segment.
 	ctx                 context.Context
 	cancel              context.CancelFunc
+	syncInterval        time.Duration
+	bufferSize          int
+	preallocationSize   int64 // Zero if segments are not preallocated.
+	retentionPeriod     time.Duration
+	hooks               Hooks
+	readOnly            bool
+	dirLock             io.Closer // Lock held by the writer, nil if read-only.
+
+	// Group commit state, see WaitDurable.
+	syncRequests      chan struct{}
+	syncLock          sync.Mutex // Held while fsyncing a segment outside of lock.
+	segmentDirSynced  bool       // Guarded by syncLock, see syncSegmentDir.
+	durabilityLock    sync.Mutex // Guards the fields below.
+	durableSequenceNo uint64
+	durabilityWaiters []durabilityWaiter
+	closed            bool
+
+	flushed broadcast // Notified when entries are flushed, see Follow.
+	durable broadcast // Notified when entries become durable.
+
+	subscribers map[*subscriber]struct{} // Guarded by lock, see Subscribe.
+
+	visibleLock sync.Mutex // Guards visible, taken by readers instead of lock.
+	visible     snapshot   // Part of the log the readers can see.
 }
 
 // Initialize a new WAL. If the directory does not exist, it will be created.
@@ -46,28 +69,87 @@ type WAL struct {
 // enableFsync enables fsync on the log segment file every time the log flushes.
 // maxFileSize is the maximum size of a log segment file in bytes.
 // maxSegments is the maximum number of log segment files to keep.
+// Corrupted records in any log segment make it fail (see RecoveryStrict).
+// The other settings are the DefaultOptions, use Open to change them.
 func OpenWAL(directory string, enableFsync bool, maxFileSize int64, maxSegments int) (*WAL, error) {
-	// Create the directory if it doesn't exist
-	if err := os.MkdirAll(directory, 0755); err != nil {
+	return Open(directory, WithFsync(enableFsync), WithMaxFileSize(maxFileSize), WithMaxSegments(maxSegments))
+}
+
+// OpenWALWithRecovery opens the WAL like OpenWAL, after recovering the log
+// according to the given recovery policy.
+func OpenWALWithRecovery(directory string, enableFsync bool, maxFileSize int64, maxSegments int, policy RecoveryPolicy) (*WAL, error) {
+	return Open(directory, WithFsync(enableFsync), WithMaxFileSize(maxFileSize), WithMaxSegments(maxSegments),
+		WithRecovery(policy))
+}
+
+// OpenReadOnly opens the WAL in the given directory for reading only, e.g. to
+// inspect it or to tail it from a sidecar process while another process writes
+// to it. It is a shortcut for Open with WithReadOnly.
+//
+// A read-only WAL never modifies the directory: it does not create it or its
+// first segment, does not take the writer lock, does not recover or repair
+// segments, and does not persist the indexes it rebuilds. Every write fails
+// with ErrReadOnly. All the read APIs are available, and they see the entries
+// flushed by the writer so far, including those written after the WAL was
+// opened. An incomplete record at the end of the log is assumed to be still
+// being written, and is not returned. Returns an error wrapping os.ErrNotExist
+// if the WAL has no segments yet.
+func OpenReadOnly(directory string, opts ...Option) (*WAL, error) {
+	return Open(directory, append(opts[:len(opts):len(opts)], WithReadOnly(true))...)
+}
+
+// Open opens the WAL in the given directory, configured with the given options
+// applied on top of DefaultOptions. If the directory does not exist, it will
+// be created. Returns an error wrapping ErrInvalidOption if the resulting
+// options are invalid.
+//
+// Only one writer can open a WAL at a time: the writer holds a lock on the LOCK
+// file of the directory until it is closed, and opening a WAL that is already
+// open for writing, by this process or another one, returns an error wrapping
+// ErrLocked. WALs opened with WithReadOnly do not take the lock.
+func Open(directory string, opts ...Option) (_ *WAL, err error) {
+	options, err := buildOptions(opts)
+	if err != nil {
 		return nil, err
 	}
+	dir := newWalDir(directory, &options)
+
+	var dirLock io.Closer
+	if !options.ReadOnly {
+		// Create the directory if it doesn't exist
+		if err := createDirectory(dir, options.DirPerm); err != nil {
+			return nil, err
+		}
 
-	// Get the list of log segment files in the directory
-	files, err := filepath.Glob(filepath.Join(directory, segmentPrefix+"*"))
+		if dirLock, err = dir.fs.Lock(lockPath(dir), options.FilePerm); err != nil {
+			return nil, err
+		}
+		defer func() {
+			if err != nil {
+				dirLock.Close()
+			}
+		}()
+
+		if err := recoverSegments(dir, options.Recovery); err != nil {
+			return nil, err
+		}
+	}
+
+	// Get the list of log segments in the directory
+	segmentIDs, err := listSegmentIDs(dir)
 	if err != nil {
 		return nil, err
 	}
 
 	var lastSegmentID int
-	if len(files) > 0 {
+	if len(segmentIDs) > 0 {
 		// Find the last segment ID
-		lastSegmentID, err = findLastSegmentIndexinFiles(files)
-		if err != nil {
-			return nil, err
-		}
+		lastSegmentID = segmentIDs[len(segmentIDs)-1]
+	} else if options.ReadOnly {
+		return nil, fmt.Errorf("no log segments in %s: %w", directory, os.ErrNotExist)
 	} else {
 		// Create the first log segment
-		file, err := createSegmentFile(directory, 0)
+		file, err := createSegmentFile(dir, 0, newSegmentHeader(1), options.preallocationSize())
 		if err != nil {
 			return nil, err
 		}
@@ -78,36 +160,116 @@ func OpenWAL(directory string, enableFsync bool, maxFileSize int64, maxSegments
 	}
 
 	// Open the last log segment file
-	filePath := filepath.Join(directory, fmt.Sprintf("%s%d", segmentPrefix, lastSegmentID))
-	file, err := os.OpenFile(filePath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-	if err != nil {
-		return nil, err
+	filePath := segmentPath(dir, lastSegmentID)
+	flag := os.O_CREATE | os.O_WRONLY
+	if options.ReadOnly {
+		flag = os.O_RDONLY
 	}
-
-	// Seek to the end of the file
-	if _, err = file.Seek(0, io.SeekEnd); err != nil {
+	file, err := dir.fs.OpenFile(filePath, flag, options.FilePerm)
+	if err != nil {
 		return nil, err
 	}
 
 	ctx, cancel := context.WithCancel(context.Background())
 
 	wal := &WAL{
-		directory:           directory,
+		dir:                 dir,
 		currentSegment:      file,
 		lastSequenceNo:      0,
-		bufWriter:           bufio.NewWriter(file),
-		syncTimer:           time.NewTimer(syncInterval), // syncInterval is a predefined duration
-		shouldFsync:         enableFsync,
-		maxFileSize:         maxFileSize,
-		maxSegments:         maxSegments,
+		bufWriter:           bufio.NewWriterSize(file, options.BufferSize),
+		syncTimer:           time.NewTimer(options.SyncInterval),
+		shouldFsync:         options.EnableFsync && !options.ReadOnly,
+		maxFileSize:         options.MaxFileSize,
+		maxSegments:         options.MaxSegments,
 		currentSegmentIndex: lastSegmentID,
 		ctx:                 ctx,
 		cancel:              cancel,
+		syncInterval:        options.SyncInterval,
+		bufferSize:          options.BufferSize,
+		preallocationSize:   options.preallocationSize(),
+		retentionPeriod:     options.RetentionPeriod,
+		hooks:               options.Hooks,
+		readOnly:            options.ReadOnly,
+		dirLock:             dirLock,
+		syncRequests:        make(chan struct{}, 1),
+		segmentDirSynced:    options.EnableFsync,
+		subscribers:         make(map[*subscriber]struct{}),
 	}
+	defer func() {
+		if err != nil {
+			cancel()
+			wal.syncTimer.Stop()
+			if wal.currentSegment != nil {
+				wal.currentSegment.Close()
+			}
+		}
+	}()
 
+	// Also finds the end of the entries of the current segment.
 	if wal.lastSequenceNo, err = wal.getLastSequenceNo(); err != nil {
 		return nil, err
 	}
+	lowWaterMark, err := readLowWaterMark(dir)
+	if err != nil {
+		return nil, err
+	}
+	wal.lastSequenceNo = keepLowWaterMark(wal.lastSequenceNo, lowWaterMark)
+	wal.durableSequenceNo = wal.lastSequenceNo
+	wal.markVisible()
+	wal.visible.firstSequenceNo = lowWaterMark
+	if options.ReadOnly {
+		// The entries are written by another process, readers see them as soon
+		// as they are flushed.
+		wal.visible.sequenceNo = math.MaxUint64
+	}
+
+	// Preallocated segments are larger than the entries they hold, start
+	// writing right after the last entry.
+	if _, err := file.Seek(wal.currentSegmentSize, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	// Empty segments without a header (left by older versions) are replaced by
+	// a fresh segment before any entry is written to them.
+	if wal.currentSegmentSize == 0 && !options.ReadOnly {
+		err := file.Close()
+		wal.currentSegment = nil
+		if err != nil {
+			return nil, err
+		}
+
+		header := newSegmentHeader(wal.lastSequenceNo + 1)
+		if file, err = createSegmentFile(dir, lastSegmentID, header, options.preallocationSize()); err != nil {
+			return nil, err
+		}
+		wal.currentSegment = file
+		wal.bufWriter = bufio.NewWriterSize(file, wal.bufferSize)
+		wal.currentHeader = header
+		wal.currentSegmentSize = header.size()
+	} else if wal.currentHeader, err = readSegmentHeaderFromFile(dir, lastSegmentID); err != nil {
+		return nil, err
+	}
+
+	// Read-only WALs only read the segments on demand, and do not need to keep
+	// the current one open.
+	if options.ReadOnly {
+		err := file.Close()
+		wal.currentSegment = nil
+		if err != nil {
+			return nil, err
+		}
+		return wal, nil
+	}
+
+	// Rebuild the missing indexes of the sealed segments.
+	for _, segmentID := range segmentIDs {
+		if segmentID == lastSegmentID {
+			continue
+		}
+		if _, err := loadSegmentIndex(dir, segmentID); err != nil {
+			return nil, err
+		}
+	}
 
 	go wal.keepSyncing()
 
@@ -116,60 +278,217 @@ func OpenWAL(directory string, enableFsync bool, maxFileSize int64, maxSegments
 
 // WriteEntry writes an entry to the WAL.
 func (wal *WAL) WriteEntry(data []byte) error {
-	return wal.writeEntry(data, false)
+	_, err := wal.Append(data)
+	return err
+}
+
+// Append writes an entry to the WAL and returns the sequence number assigned
+// to it.
+func (wal *WAL) Append(data []byte) (uint64, error) {
+	return wal.writeEntry(data, false, 0)
 }
 
 // CreateCheckpoint creates a checkpoint entry in the WAL. A checkpoint entry
 // is a special entry that can be used to restore the state of the system to
 // the point when the checkpoint was created.
 func (wal *WAL) CreateCheckpoint(data []byte) error {
-	return wal.writeEntry(data, true)
+	_, err := wal.AppendCheckpoint(data)
+	return err
+}
+
+// AppendCheckpoint creates a checkpoint entry in the WAL (see CreateCheckpoint)
+// and returns the sequence number assigned to it.
+func (wal *WAL) AppendCheckpoint(data []byte) (uint64, error) {
+	return wal.writeEntry(data, true, 0)
 }
 
-func (wal *WAL) writeEntry(data []byte, isCheckpoint bool) error {
+// writeEntry writes an entry to the WAL, with the given sequence number if it is
+// not zero (see AppendAt), and returns the sequence number assigned to it.
+func (wal *WAL) writeEntry(data []byte, isCheckpoint bool, sequenceNo uint64) (uint64, error) {
+	if wal.readOnly {
+		return 0, ErrReadOnly
+	}
+
+	var blocked []blockedPublish
 	wal.lock.Lock()
-	defer wal.lock.Unlock()
+	defer func() {
+		wal.lock.Unlock()
+		waitForSubscribers(blocked)
+	}()
 
+	if err := wal.checkSequenceNo(sequenceNo); err != nil {
+		return 0, err
+	}
 	if err := wal.rotateLogIfNeeded(); err != nil {
-		return err
+		return 0, err
 	}
 
-	wal.lastSequenceNo++
+	if isCheckpoint {
+		if err := wal.Sync(); err != nil {
+			return 0, fmt.Errorf("could not create checkpoint, error while syncing: %v", err)
+		}
+	}
+
+	sequenceNo = wal.lastSequenceNo + 1
 	entry := &WAL_Entry{
-		LogSequenceNumber: wal.lastSequenceNo,
+		LogSequenceNumber: sequenceNo,
 		Data:              data,
-		CRC:               crc32.ChecksumIEEE(append(data, byte(wal.lastSequenceNo))),
 	}
 
 	if isCheckpoint {
-		if err := wal.Sync(); err != nil {
-			return fmt.Errorf("could not create checkpoint, error while syncing: %v", err)
-		}
 		entry.IsCheckpoint = &isCheckpoint
 	}
+	entry.CRC = computeCRC(entry, wal.currentHeader.formatVersion())
+
+	offset := wal.currentSegmentSize
+	if err := wal.writeEntryToBuffer(entry); err != nil {
+		return 0, err
+	}
+	wal.lastSequenceNo = sequenceNo
+	wal.currentIndex.add(sequenceNo, offset)
+	wal.markWrittenOut()
+	blocked = wal.publish(entry)
 
-	return wal.writeEntryToBuffer(entry)
+	return sequenceNo, nil
 }
 
-func (wal *WAL) writeEntryToBuffer(entry *WAL_Entry) error {
-	marshaledEntry := MustMarshal(entry)
+// WriteBatch writes the given entries to the WAL as a single atomic batch. The
+// entries are assigned a contiguous range of sequence numbers, and on recovery
+// either all of them are read back or none of them are (in case the batch was
+// torn by a crash).
+func (wal *WAL) WriteBatch(entries [][]byte) error {
+	_, err := wal.AppendBatch(entries)
+	return err
+}
 
-	size := int32(len(marshaledEntry))
-	if err := binary.Write(wal.bufWriter, binary.LittleEndian, size); err != nil {
-		return err
+// AppendBatch writes the given entries to the WAL as a single atomic batch (see
+// WriteBatch) and returns the sequence number assigned to the first entry. The
+// remaining entries are assigned the sequence numbers that follow it. Returns 0
+// if entries is empty.
+func (wal *WAL) AppendBatch(entries [][]byte) (uint64, error) {
+	return wal.appendBatch(entries, 0)
+}
+
+// AppendAt writes an entry to the WAL with the given sequence number, chosen by
+// the caller, e.g. to store Raft indices as sequence numbers. It must be the
+// next sequence number of the log, i.e. the one following the last entry (see
+// TruncateBack to replace entries): otherwise nothing is written, and a
+// *SequenceNumberError matching ErrSequenceGap or ErrSequenceDuplicate is
+// returned. Appending the entry following the one a caller expects to be the
+// last is AppendAt(expected+1, data).
+func (wal *WAL) AppendAt(sequenceNo uint64, data []byte) error {
+	if sequenceNo == 0 {
+		return wal.sequenceNumberError(sequenceNo)
 	}
-	_, err := wal.bufWriter.Write(marshaledEntry)
 
+	_, err := wal.writeEntry(data, false, sequenceNo)
 	return err
 }
 
-func (wal *WAL) rotateLogIfNeeded() error {
-	fileInfo, err := wal.currentSegment.Stat()
-	if err != nil {
-		return err
+// AppendBatchAt writes the given entries to the WAL as a single atomic batch
+// (see WriteBatch), starting with the given sequence number. Like with
+// AppendAt, it must be the next sequence number of the log, even if the batch
+// is empty.
+func (wal *WAL) AppendBatchAt(sequenceNo uint64, entries [][]byte) error {
+	if sequenceNo == 0 {
+		return wal.sequenceNumberError(sequenceNo)
 	}
+	if len(entries) == 0 {
+		wal.lock.Lock()
+		defer wal.lock.Unlock()
 
-	if fileInfo.Size()+int64(wal.bufWriter.Buffered()) >= wal.maxFileSize {
+		return wal.checkSequenceNo(sequenceNo)
+	}
+
+	_, err := wal.appendBatch(entries, sequenceNo)
+	return err
+}
+
+// checkSequenceNo returns a *SequenceNumberError if the given sequence number,
+// chosen by the caller, is not the next one of the log. Zero lets the WAL
+// assign it. Must be called with the lock held.
+func (wal *WAL) checkSequenceNo(sequenceNo uint64) error {
+	if sequenceNo != 0 && sequenceNo != wal.lastSequenceNo+1 {
+		return &SequenceNumberError{SequenceNo: sequenceNo, Expected: wal.lastSequenceNo + 1}
+	}
+	return nil
+}
+
+// sequenceNumberError returns the *SequenceNumberError for appending an entry
+// with the given sequence number.
+func (wal *WAL) sequenceNumberError(sequenceNo uint64) error {
+	wal.lock.Lock()
+	defer wal.lock.Unlock()
+
+	return &SequenceNumberError{SequenceNo: sequenceNo, Expected: wal.lastSequenceNo + 1}
+}
+
+// appendBatch writes the given entries to the WAL as a single atomic batch,
+// starting with the given sequence number if it is not zero (see
+// AppendBatchAt), and returns the sequence number assigned to the first entry.
+func (wal *WAL) appendBatch(entries [][]byte, sequenceNo uint64) (uint64, error) {
+	if len(entries) == 0 {
+		return 0, nil
+	}
+	if wal.readOnly {
+		return 0, ErrReadOnly
+	}
+
+	var blocked []blockedPublish
+	wal.lock.Lock()
+	defer func() {
+		wal.lock.Unlock()
+		waitForSubscribers(blocked)
+	}()
+
+	if err := wal.checkSequenceNo(sequenceNo); err != nil {
+		return 0, err
+	}
+	if err := wal.rotateLogIfNeeded(); err != nil {
+		return 0, err
+	}
+
+	// Encode the whole batch up front, so that a failure midway does not leave
+	// a partial batch in the buffer or consume sequence numbers.
+	var buf bytes.Buffer
+	var written []*WAL_Entry
+	firstSequenceNo := wal.lastSequenceNo + 1
+	batchSize := uint32(len(entries))
+	for i, data := range entries {
+		entry := &WAL_Entry{
+			LogSequenceNumber: firstSequenceNo + uint64(i),
+			Data:              data,
+			BatchSize:         &batchSize,
+		}
+		entry.CRC = computeCRC(entry, wal.currentHeader.formatVersion())
+		if _, err := encodeEntry(&buf, entry); err != nil {
+			return 0, err
+		}
+		written = append(written, entry)
+	}
+
+	if _, err := wal.bufWriter.Write(buf.Bytes()); err != nil {
+		return 0, err
+	}
+	wal.lastSequenceNo += uint64(batchSize)
+	wal.currentIndex.add(firstSequenceNo, wal.currentSegmentSize)
+	wal.currentSegmentSize += int64(buf.Len())
+	wal.markWrittenOut()
+	blocked = wal.publish(written...)
+
+	return firstSequenceNo, nil
+}
+
+func (wal *WAL) writeEntryToBuffer(entry *WAL_Entry) error {
+	n, err := encodeEntry(wal.bufWriter, entry)
+	wal.currentSegmentSize += int64(n)
+
+	return err
+}
+
+func (wal *WAL) rotateLogIfNeeded() error {
+	// The segment header does not count towards the maximum file size.
+	if wal.currentSegmentSize-wal.currentHeader.size() >= wal.maxFileSize {
 		if err := wal.rotateLog(); err != nil {
 			return err
 		}
@@ -183,94 +502,206 @@ func (wal *WAL) rotateLog() error {
 		return err
 	}
 
-	if err := wal.currentSegment.Close(); err != nil {
-		return err
+	// Segments are always fsynced before being closed, so that writers waiting
+	// for their entries to become durable never depend on a closed segment.
+	if !wal.shouldFsync {
+		if err := wal.fsyncCurrentSegment(); err != nil {
+			return err
+		}
 	}
 
-	wal.currentSegmentIndex++
-	if wal.currentSegmentIndex >= wal.maxSegments {
-		if err := wal.deleteOldestSegment(); err != nil {
+	// Give the unused space of a preallocated segment back.
+	if wal.preallocationSize > 0 {
+		if err := wal.currentSegment.Truncate(wal.currentSegmentSize); err != nil {
 			return err
 		}
 	}
 
-	newFile, err := createSegmentFile(wal.directory, wal.currentSegmentIndex)
+	// Persist the index of the segment being sealed.
+	if err := writeSegmentIndex(wal.dir, wal.currentSegmentIndex, wal.currentIndex); err != nil {
+		return err
+	}
+
+	// The directory entry of the new segment is synced when it is created.
+	wal.syncLock.Lock()
+	err := wal.currentSegment.Close()
+	wal.segmentDirSynced = true
+	wal.syncLock.Unlock()
+	if err != nil {
+		return err
+	}
+
+	// The new segment is created before the oldest one is deleted, so that the
+	// last sequence number can always be recovered from the remaining segments.
+	wal.currentSegmentIndex++
+	header := newSegmentHeader(wal.lastSequenceNo + 1)
+	newFile, err := createSegmentFile(wal.dir, wal.currentSegmentIndex, header, wal.preallocationSize)
 	if err != nil {
 		return err
 	}
 
 	wal.currentSegment = newFile
-	wal.bufWriter = bufio.NewWriter(newFile)
+	wal.bufWriter = bufio.NewWriterSize(newFile, wal.bufferSize)
+	wal.currentHeader = header
+	wal.currentSegmentSize = header.size()
+	wal.currentIndex = &segmentIndex{}
+	wal.markVisible()
+
+	if wal.hooks.OnRotate != nil {
+		wal.hooks.OnRotate(wal.currentSegmentIndex)
+	}
 
-	return nil
+	if err := wal.deleteExcessSegments(); err != nil {
+		return err
+	}
+
+	return wal.deleteExpiredSegments()
 }
 
-// removes the oldest log file
-func (wal *WAL) deleteOldestSegment() error {
-	files, err := filepath.Glob(filepath.Join(wal.directory, segmentPrefix+"*"))
+// deleteExpiredSegments deletes the oldest sealed log segments that were last
+// written more than the retention period ago, along with their indexes.
+func (wal *WAL) deleteExpiredSegments() error {
+	if wal.retentionPeriod == 0 {
+		return nil
+	}
+
+	segmentIDs, err := listSegmentIDs(wal.dir)
 	if err != nil {
 		return err
 	}
 
-	var oldestSegmentFilePath string
-	if len(files) > 0 {
-		// Find the oldest segment ID
-		oldestSegmentFilePath, err = wal.findOldestSegmentFile(files)
+	expiry := time.Now().Add(-wal.retentionPeriod)
+	for _, segmentID := range segmentIDs {
+		if segmentID == wal.currentSegmentIndex {
+			break
+		}
+
+		info, err := wal.dir.fs.Stat(segmentPath(wal.dir, segmentID))
 		if err != nil {
 			return err
 		}
-	} else {
-		return nil
+		// Segments are deleted in order, so that the log never has holes.
+		if info.ModTime().After(expiry) {
+			break
+		}
+
+		if err := wal.deleteSegment(segmentID); err != nil {
+			return err
+		}
 	}
 
-	// Delete the oldest segment file
-	if err := os.Remove(oldestSegmentFilePath); err != nil {
+	return nil
+}
+
+// deleteExcessSegments deletes the oldest log files, along with their indexes,
+// until at most maxSegments of them are left. Segment IDs are not a count of
+// the segments, since TruncateFront may have deleted some of them already.
+func (wal *WAL) deleteExcessSegments() error {
+	segmentIDs, err := listSegmentIDs(wal.dir)
+	if err != nil {
 		return err
 	}
 
+	for i := 0; len(segmentIDs)-i > wal.maxSegments && segmentIDs[i] != wal.currentSegmentIndex; i++ {
+		if err := wal.deleteSegment(segmentIDs[i]); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
-func (wal *WAL) findOldestSegmentFile(files []string) (string, error) {
-	var oldestSegmentFilePath string
-	oldestSegmentID := math.MaxInt64
-	for _, file := range files {
-		// Get the segment index from the file name
-		segmentIndex, err := strconv.Atoi(strings.TrimPrefix(file,
-			filepath.Join(wal.directory, segmentPrefix)))
-		if err != nil {
-			return "", err
-		}
+// deleteSegment deletes the given log segment file, along with its index.
+func (wal *WAL) deleteSegment(segmentID int) error {
+	if err := wal.dir.fs.Remove(segmentPath(wal.dir, segmentID)); err != nil {
+		return err
+	}
 
-		if segmentIndex < oldestSegmentID {
-			oldestSegmentID = segmentIndex
-			oldestSegmentFilePath = file
-		}
+	if err := removeSegmentIndex(wal.dir, segmentID); err != nil {
+		return err
+	}
+
+	if err := wal.dir.syncDir(); err != nil {
+		return err
 	}
 
-	return oldestSegmentFilePath, nil
+	if wal.hooks.OnSegmentDeleted != nil {
+		wal.hooks.OnSegmentDeleted(segmentID)
+	}
+
+	return nil
 }
 
-// Close the WAL file. It also calls Sync() on the WAL.
-func (wal *WAL) Close() error {
+// Close the WAL file. It also calls Sync() on the WAL. Writers still waiting
+// for their entries to become durable are released with ErrClosed. The writer
+// lock is released even if closing fails.
+func (wal *WAL) Close() (err error) {
 	wal.cancel()
-	if err := wal.Sync(); err != nil {
-		return err
+
+	wal.lock.Lock()
+	defer wal.lock.Unlock()
+	defer func() {
+		if unlockErr := wal.releaseDirLock(); err == nil {
+			err = unlockErr
+		}
+	}()
+	// Wake up the Followers once the WAL is marked as closed.
+	defer wal.flushed.notify()
+	defer wal.releaseWaiters()
+
+	if wal.readOnly {
+		return nil
 	}
-	return wal.currentSegment.Close()
+
+	// The segment is closed even if the sync fails, so that it does not leak.
+	err = wal.Sync()
+
+	wal.syncLock.Lock()
+	defer wal.syncLock.Unlock()
+
+	if closeErr := wal.currentSegment.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// releaseDirLock releases the writer lock, if held. Must be called with the
+// lock held.
+func (wal *WAL) releaseDirLock() error {
+	if wal.dirLock == nil {
+		return nil
+	}
+
+	err := wal.dirLock.Close()
+	wal.dirLock = nil
+	return err
 }
 
 // Read all entries from the WAL. If readFromCheckpoint is true, it will return
 // all the entries from the last checkpoint (if no checkpoint is found, it will
 // return an empty slice.)
 func (wal *WAL) ReadAll(readFromCheckpoint bool) ([]*WAL_Entry, error) {
-	file, err := os.OpenFile(wal.currentSegment.Name(), os.O_RDONLY, 0644)
+	visible := wal.snapshot()
+	segmentID := visible.segmentID
+	if wal.readOnly {
+		// The writer may have rotated the log since the WAL was opened.
+		segmentIDs, err := listSegmentIDs(wal.dir)
+		if err != nil {
+			return nil, err
+		}
+		if len(segmentIDs) > 0 {
+			segmentID = segmentIDs[len(segmentIDs)-1]
+		}
+	}
+
+	file, err := wal.dir.fs.OpenFile(segmentPath(wal.dir, segmentID), os.O_RDONLY, 0644)
 	if err != nil {
 		return nil, err
 	}
 	defer file.Close()
 
-	entries, checkpoint, err := readAllEntriesFromFile(file, readFromCheckpoint)
+	entries, checkpoint, err := readAllEntriesFromFile(wal.dir, file, segmentID, visible.sequenceNo,
+		readFromCheckpoint)
 	if err != nil {
 		return entries, err
 	}
@@ -279,7 +710,7 @@ func (wal *WAL) ReadAll(readFromCheckpoint bool) ([]*WAL_Entry, error) {
 		return entries[:0], nil
 	}
 
-	return entries, nil
+	return dropTruncatedEntries(entries, visible.firstSequenceNo), nil
 }
 
 // Starts reading from log segment files starting from the given offset
@@ -287,8 +718,11 @@ func (wal *WAL) ReadAll(readFromCheckpoint bool) ([]*WAL_Entry, error) {
 // it will return all the entries from the last checkpoint (if no checkpoint is
 // found, it will return an empty slice.)
 func (wal *WAL) ReadAllFromOffset(offset int, readFromCheckpoint bool) ([]*WAL_Entry, error) {
-	// Get the list of log segment files in the directory
-	files, err := filepath.Glob(filepath.Join(wal.directory, segmentPrefix+"*"))
+	// Take the snapshot first, so that the segments it covers are all listed.
+	visible := wal.snapshot()
+
+	// Get the list of log segments in the directory
+	segmentIDs, err := listSegmentIDs(wal.dir)
 	if err != nil {
 		return nil, err
 	}
@@ -296,24 +730,19 @@ func (wal *WAL) ReadAllFromOffset(offset int, readFromCheckpoint bool) ([]*WAL_E
 	var entries []*WAL_Entry
 	prevCheckpointLogSequenceNo := uint64(0)
 
-	for _, file := range files {
-		// Get the segment index from the file name
-		segmentIndex, err := strconv.Atoi(strings.TrimPrefix(file,
-			filepath.Join(wal.directory, "segment-")))
-		if err != nil {
-			return entries, err
-		}
-
-		if segmentIndex < offset {
+	for _, segmentID := range segmentIDs {
+		if segmentID < offset {
 			continue
 		}
 
-		file, err := os.OpenFile(file, os.O_RDONLY, 0644)
+		file, err := wal.dir.fs.OpenFile(segmentPath(wal.dir, segmentID), os.O_RDONLY, 0644)
 		if err != nil {
 			return nil, err
 		}
 
-		entries_from_segment, checkpoint, err := readAllEntriesFromFile(file, readFromCheckpoint)
+		entries_from_segment, checkpoint, err := readAllEntriesFromFile(wal.dir, file, segmentID,
+			visible.sequenceNo, readFromCheckpoint)
+		file.Close()
 		if err != nil {
 			return entries, err
 		}
@@ -326,41 +755,70 @@ func (wal *WAL) ReadAllFromOffset(offset int, readFromCheckpoint bool) ([]*WAL_E
 		entries = append(entries, entries_from_segment...)
 	}
 
-	return entries, nil
+	return dropTruncatedEntries(entries, visible.firstSequenceNo), nil
 }
 
-func readAllEntriesFromFile(file *os.File, readFromCheckpoint bool) ([]*WAL_Entry, uint64, error) {
+// ReadFrom returns all the entries of the WAL starting from the entry with the
+// given sequence number, inclusive. Use NewReaderFrom to stream them instead.
+func (wal *WAL) ReadFrom(sequenceNo uint64) ([]*WAL_Entry, error) {
+	reader, err := wal.NewReaderFrom(sequenceNo)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
 	var entries []*WAL_Entry
-	checkpointLogSequenceNo := uint64(0)
 	for {
-		var size int32
-		if err := binary.Read(file, binary.LittleEndian, &size); err != nil {
-			if err == io.EOF {
-				break
-			}
-			return entries, checkpointLogSequenceNo, err
+		entry, err := reader.Next()
+		if err == io.EOF {
+			return entries, nil
 		}
-
-		data := make([]byte, size)
-		if _, err := io.ReadFull(file, data); err != nil {
-			return entries, checkpointLogSequenceNo, err
+		if err != nil {
+			return entries, err
 		}
+		entries = append(entries, entry)
+	}
+}
+
+// readAllEntriesFromFile reads the entries of the given segment file, up to the
+// one with the given sequence number, inclusive, so that the records the writer
+// is still writing out after it are never read.
+func readAllEntriesFromFile(dir *walDir, file File, segmentID int, lastSequenceNo uint64, readFromCheckpoint bool) ([]*WAL_Entry, uint64, error) {
+	var entries []*WAL_Entry
+	var batch batchAssembler
+	checkpointLogSequenceNo := uint64(0)
+	reader, err := newSegmentReader(file, segmentID)
+	if err != nil {
+		return nil, checkpointLogSequenceNo, err
+	}
+	// Last entry read, the one before the segment if known.
+	sequenceNo := uint64(0)
+	if reader.nextSequenceNo > 0 {
+		sequenceNo = reader.nextSequenceNo - 1
+	}
 
-		entry, err := unmarshalAndVerifyEntry(data)
+	for sequenceNo < lastSequenceNo {
+		entry, err := reader.next()
 		if err != nil {
+			if err == io.EOF || dir.tornTail(err) {
+				break
+			}
 			return entries, checkpointLogSequenceNo, err
 		}
 
-		// If we are reading from checkpoint and we find a checkpoint entry, we
-		// we should return the entries from the last checkpoint. So we empty the
-		// entries slice and start appending entries from the checkpoint.
-		if entry.IsCheckpoint != nil && entry.GetIsCheckpoint() {
-			checkpointLogSequenceNo = entry.GetLogSequenceNumber()
-			// Empty the entries slice
-			entries = entries[:0]
-		}
+		for _, entry := range batch.add(entry) {
+			sequenceNo = entry.GetLogSequenceNumber()
+			// If we are reading from checkpoint and we find a checkpoint entry, we
+			// we should return the entries from the last checkpoint. So we empty the
+			// entries slice and start appending entries from the checkpoint.
+			if entry.IsCheckpoint != nil && entry.GetIsCheckpoint() {
+				checkpointLogSequenceNo = entry.GetLogSequenceNumber()
+				// Empty the entries slice
+				entries = entries[:0]
+			}
 
-		entries = append(entries, entry)
+			entries = append(entries, entry)
+		}
 	}
 
 	return entries, checkpointLogSequenceNo, nil
@@ -370,11 +828,11 @@ func readAllEntriesFromFile(file *os.File, readFromCheckpoint bool) ([]*WAL_Entr
 // fsync is enabled, it also calls fsync on the segment file. It also resets
 // the synchronization timer.
 func (wal *WAL) Sync() error {
-	if err := wal.bufWriter.Flush(); err != nil {
+	if err := wal.flushBuffer(); err != nil {
 		return err
 	}
 	if wal.shouldFsync {
-		if err := wal.currentSegment.Sync(); err != nil {
+		if err := wal.fsyncCurrentSegment(); err != nil {
 			return err
 		}
 	}
@@ -385,23 +843,91 @@ func (wal *WAL) Sync() error {
 	return nil
 }
 
+// flushBuffer writes out the buffered entries to the segment file, makes them
+// visible to the readers, and wakes up the Followers waiting for them. Must be
+// called with the lock held.
+func (wal *WAL) flushBuffer() error {
+	err := wal.bufWriter.Flush()
+	if err == nil {
+		wal.markVisible()
+	}
+	wal.flushed.notify()
+
+	return err
+}
+
+// snapshot is the part of the log visible to the readers: the entries written
+// out to the segment files in full. Records still buffered, or being written
+// out, are past it.
+type snapshot struct {
+	sequenceNo uint64 // Last visible entry, math.MaxUint64 if read-only.
+	segmentID  int    // Segment the writer appends to.
+	// Entries before it were removed by TruncateFront, 0 if none were.
+	firstSequenceNo uint64
+	// Index of that segment. Its points are only ever appended, so it can be
+	// used without the lock while the writer keeps adding points to it.
+	index segmentIndex
+}
+
+// markVisible makes all the entries written out so far visible to the readers.
+// Must be called with the lock held, after the buffer has been flushed.
+func (wal *WAL) markVisible() {
+	wal.visibleLock.Lock()
+	defer wal.visibleLock.Unlock()
+
+	wal.visible.sequenceNo = wal.lastSequenceNo
+	wal.visible.segmentID = wal.currentSegmentIndex
+	wal.visible.index = *wal.currentIndex
+}
+
+// markWrittenOut makes the entries visible to the readers if the buffer wrote
+// them out to the segment file right away, e.g. because they do not fit in it.
+// Must be called with the lock held.
+func (wal *WAL) markWrittenOut() {
+	if wal.bufWriter.Buffered() == 0 {
+		wal.markVisible()
+	}
+}
+
+// snapshot returns the part of the log currently visible to the readers. It
+// does not take the lock, so that readers never wait for the writers.
+func (wal *WAL) snapshot() snapshot {
+	wal.visibleLock.Lock()
+	defer wal.visibleLock.Unlock()
+
+	return wal.visible
+}
+
+// VisibleSequenceNumber returns the sequence number of the last entry visible
+// to the readers, i.e. the last entry written out to the segment files, which
+// happens once they are flushed (see Sync), or right away if they do not fit in
+// the buffer. The readers created from now on see every entry up to it, and none
+// after it. For a read-only WAL, it is the last sequence number found when
+// opening it, since the readers see the entries of the other process as soon
+// as they are flushed.
+func (wal *WAL) VisibleSequenceNumber() uint64 {
+	if wal.readOnly {
+		return wal.lastSequenceNo
+	}
+
+	return wal.snapshot().sequenceNo
+}
+
 // resetTimer resets the synchronization timer.
 func (wal *WAL) resetTimer() {
-	wal.syncTimer.Reset(syncInterval)
+	wal.syncTimer.Reset(wal.syncInterval)
 }
 
+// keepSyncing periodically flushes the WAL (and fsyncs it if enabled), and
+// performs the group commits requested by WaitDurable.
 func (wal *WAL) keepSyncing() {
 	for {
 		select {
 		case <-wal.syncTimer.C:
+			wal.groupCommit(wal.shouldFsync)
 
-			wal.lock.Lock()
-			err := wal.Sync()
-			wal.lock.Unlock()
-
-			if err != nil {
-				log.Printf("Error while performing sync: %v", err)
-			}
+		case <-wal.syncRequests:
+			wal.groupCommit(true)
 
 		case <-wal.ctx.Done():
 			return
@@ -415,127 +941,114 @@ func (wal *WAL) keepSyncing() {
 // corruption and overwrites the existing WAL file with the repaired entries.
 // It checks the CRC of each entry to verify if it is corrupted, and if the CRC
 // is invalid, the file is truncated at that point.
+//
+// Only the last segment is repaired (see RepairAll). If the WAL is open, the
+// buffered entries are written out first, and the following entries are
+// appended right after the last entry kept, like RepairAll. If it was closed,
+// the writer lock is taken while repairing it, like RepairDirectory. Returns
+// ErrReadOnly if the WAL is read-only.
 func (wal *WAL) Repair() ([]*WAL_Entry, error) {
-	files, err := filepath.Glob(filepath.Join(wal.directory, segmentPrefix+"*"))
-	if err != nil {
-		return nil, err
+	if wal.readOnly {
+		return nil, ErrReadOnly
 	}
 
-	var lastSegmentID int
-	if len(files) > 0 {
-		// Find the last segment ID
-		lastSegmentID, err = findLastSegmentIndexinFiles(files)
+	wal.lock.Lock()
+	defer wal.lock.Unlock()
+
+	if wal.isClosed() {
+		dirLock, err := wal.dir.fs.Lock(lockPath(wal.dir), wal.dir.filePerm)
 		if err != nil {
 			return nil, err
 		}
-	} else {
-		log.Fatalf("No log segments found, nothing to repair.")
+		defer dirLock.Close()
+
+		return repairLastSegment(wal.dir)
 	}
+	if err := wal.flushBuffer(); err != nil {
+		return nil, err
+	}
+
+	lastSequenceNo := wal.lastSequenceNo
+	var entries []*WAL_Entry
+	wal.syncLock.Lock()
+	err := wal.currentSegment.Close()
+	wal.syncLock.Unlock()
+	if err == nil {
+		entries, err = repairLastSegment(wal.dir)
+	}
+	// Reopen the segment even if the repair failed, so that the WAL remains
+	// usable.
+	if reopenErr := wal.reopenLastSegment(); err == nil {
+		err = reopenErr
+	}
+	wal.discardRemovedEntries(lastSequenceNo)
+
+	return entries, err
+}
+
+// repairLastSegment repairs the last log segment of the given directory (see
+// Repair), and returns the entries kept.
+func repairLastSegment(dir *walDir) ([]*WAL_Entry, error) {
+	segmentIDs, err := listSegmentIDs(dir)
+	if err != nil {
+		return nil, err
+	}
+	if len(segmentIDs) == 0 {
+		return nil, fmt.Errorf("no log segments in %s, nothing to repair: %w", dir.path, os.ErrNotExist)
+	}
+	lastSegmentID := segmentIDs[len(segmentIDs)-1]
+
 	// Open the last log segment file
-	filePath := filepath.Join(wal.directory, fmt.Sprintf("%s%d", segmentPrefix, lastSegmentID))
-	file, err := os.OpenFile(filePath, os.O_RDONLY, 0644)
+	file, err := dir.fs.OpenFile(segmentPath(dir, lastSegmentID), os.O_RDONLY, 0644)
 	if err != nil {
 		return nil, err
 	}
 
 	defer file.Close()
 
-	// Seek to the beginning of the file
-	if _, err = file.Seek(0, io.SeekStart); err != nil {
+	reader, err := newSegmentReader(file, lastSegmentID)
+	if err != nil {
 		return nil, err
 	}
 
 	var entries []*WAL_Entry
+	var batch batchAssembler
 
 	for {
-		// Read the size of the next entry.
-		var size int32
-		if err := binary.Read(file, binary.LittleEndian, &size); err != nil {
-			if err == io.EOF {
-				// End of file reached, no corruption found.
-				return entries, err
-			}
-			log.Printf("Error while reading entry size: %v", err)
-			// Truncate the file at this point.
-			if err := wal.replaceWithFixedFile(entries); err != nil {
-				return entries, err
-			}
-			return nil, nil
-		}
-
-		// Read the entry data.
-		data := make([]byte, size)
-		if _, err := io.ReadFull(file, data); err != nil {
-			// Truncate the file at this point
-			if err := wal.replaceWithFixedFile(entries); err != nil {
-				return entries, err
-			}
-			return entries, nil
-		}
-
-		// Deserialize the entry.
-		var entry WAL_Entry
-		if err := proto.Unmarshal(data, &entry); err != nil {
-			if err := wal.replaceWithFixedFile(entries); err != nil {
-				return entries, err
+		entry, err := reader.next()
+		if err == io.EOF {
+			if batch.incomplete() {
+				// The last batch was torn, drop it from the file as a unit.
+				if err := replaceSegmentFile(dir, lastSegmentID, reader.header, entries); err != nil {
+					return entries, err
+				}
+				return entries, nil
 			}
-			return entries, nil
+			// End of file reached, no corruption found.
+			return entries, err
 		}
-
-		if !verifyCRC(&entry) {
-			log.Printf("CRC mismatch: data may be corrupted")
+		if errors.Is(err, ErrCorruptRecord) {
+			dir.logger.Printf("Truncating log: %v", err)
 			// Truncate the file at this point
-			if err := wal.replaceWithFixedFile(entries); err != nil {
+			if err := replaceSegmentFile(dir, lastSegmentID, reader.header, entries); err != nil {
 				return entries, err
 			}
-
 			return entries, nil
 		}
-
-		// Add the entry to the slice.
-		entries = append(entries, &entry)
-	}
-}
-
-// replaceWithFixedFile replaces the existing WAL file with the given entries
-// atomically.
-func (wal *WAL) replaceWithFixedFile(entries []*WAL_Entry) error {
-	// Create a temporary file to make the operation look atomic.
-	tempFilePath := fmt.Sprintf("%s.tmp", wal.currentSegment.Name())
-	tempFile, err := os.OpenFile(tempFilePath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-	if err != nil {
-		return err
-	}
-
-	// Write the entries to the temporary file
-	for _, entry := range entries {
-		marshaledEntry := MustMarshal(entry)
-
-		size := int32(len(marshaledEntry))
-		if err := binary.Write(tempFile, binary.LittleEndian, size); err != nil {
-			return err
-		}
-		_, err := tempFile.Write(marshaledEntry)
-
 		if err != nil {
-			return err
+			return entries, err
 		}
-	}
-
-	// Close the temporary file
-	if err := tempFile.Close(); err != nil {
-		return err
-	}
 
-	// Rename the temporary file to the original file name
-	if err := os.Rename(tempFilePath, wal.currentSegment.Name()); err != nil {
-		return err
+		// Add the entry to the slice once the batch it belongs to (if any) is
+		// complete.
+		entries = append(entries, batch.add(entry)...)
 	}
-
-	return nil
 }
 
-// Returns the last sequence number in the current log.
+// Returns the last sequence number in the current log. If the current segment
+// has no entries (e.g. the WAL was reopened right after a log rotation), the
+// sequence number is recovered from the base sequence number recorded in the
+// segment header, or from the previous segments.
 func (wal *WAL) getLastSequenceNo() (uint64, error) {
 	entry, err := wal.getLastEntryInLog()
 	if err != nil {
@@ -546,62 +1059,50 @@ func (wal *WAL) getLastSequenceNo() (uint64, error) {
 		return entry.GetLogSequenceNumber(), nil
 	}
 
-	return 0, nil
-}
-
-// getLastEntryInLog iterates through all the entries of the log and returns the
-// last entry.
-func (wal *WAL) getLastEntryInLog() (*WAL_Entry, error) {
-	file, err := os.OpenFile(wal.currentSegment.Name(), os.O_RDONLY, 0644)
+	segmentIDs, err := listSegmentIDs(wal.dir)
 	if err != nil {
-		return nil, err
+		return 0, err
 	}
-	defer file.Close()
-
-	var previousSize int32
-	var offset int64
-	var entry *WAL_Entry
-
-	for {
-		var size int32
-		if err := binary.Read(file, binary.LittleEndian, &size); err != nil {
-			if err == io.EOF {
-				// End of file reached, read the last entry at the saved offset.
-				if offset == 0 {
-					return entry, nil
-				}
-
-				if _, err := file.Seek(offset, io.SeekStart); err != nil {
-					return nil, err
-				}
 
-				// Read the entry data.
-				data := make([]byte, previousSize)
-				if _, err := io.ReadFull(file, data); err != nil {
-					return nil, err
-				}
-
-				entry, err = unmarshalAndVerifyEntry(data)
-				if err != nil {
-					return nil, err
-				}
+	for i := len(segmentIDs) - 1; i >= 0; i-- {
+		segmentID := segmentIDs[i]
+		if segmentID > wal.currentSegmentIndex {
+			continue
+		}
 
-				return entry, nil
+		if segmentID != wal.currentSegmentIndex {
+			scan, err := scanSegment(wal.dir, segmentID)
+			if err != nil {
+				return 0, err
+			}
+			if scan.lastEntry != nil {
+				return scan.lastEntry.GetLogSequenceNumber(), nil
 			}
-			return nil, err
 		}
 
-		// Get current offset
-		offset, err = file.Seek(0, io.SeekCurrent)
-		previousSize = size
-
+		header, err := readSegmentHeaderFromFile(wal.dir, segmentID)
 		if err != nil {
-			return nil, err
+			return 0, err
 		}
-
-		// Skip to the next entry.
-		if _, err := file.Seek(int64(size), io.SeekCurrent); err != nil {
-			return nil, err
+		if header != nil && header.baseSequenceNo > 0 {
+			return header.baseSequenceNo - 1, nil
 		}
 	}
+
+	return 0, nil
+}
+
+// getLastEntryInLog iterates through all the entries of the log and returns the
+// last entry. Entries belonging to a batch that was torn by a crash are
+// ignored. It also rebuilds the index of the current segment and finds the end
+// of its entries along the way.
+func (wal *WAL) getLastEntryInLog() (*WAL_Entry, error) {
+	scan, err := scanSegment(wal.dir, wal.currentSegmentIndex)
+	if err != nil {
+		return nil, err
+	}
+	wal.currentIndex = scan.index
+	wal.currentSegmentSize = scan.end
+
+	return scan.lastEntry, nil
 }
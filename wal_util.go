@@ -1,57 +1,397 @@
 package wal
 
 import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"hash/crc32"
+	"io"
+	"log"
 	"os"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+
+	"google.golang.org/protobuf/proto"
 )
 
+var castagnoliTable = crc32.MakeTable(crc32.Castagnoli)
+
+// maxPreallocatedRecordSize is the largest record size for which the buffer
+// holding the record is allocated up front. Larger records are read
+// incrementally, so that a corrupted size cannot trigger a huge allocation.
+const maxPreallocatedRecordSize = 1 << 20
+
+// readRecordData reads the data of a record of the given size. It returns
+// io.ErrUnexpectedEOF if the reader holds fewer bytes than announced.
+func readRecordData(reader io.Reader, size int32) ([]byte, error) {
+	if size < 0 {
+		return nil, fmt.Errorf("%w: negative size %d", errMalformedRecord, size)
+	}
+
+	if size <= maxPreallocatedRecordSize {
+		data := make([]byte, size)
+		if _, err := io.ReadFull(reader, data); err != nil {
+			return nil, err
+		}
+		return data, nil
+	}
+
+	var buf bytes.Buffer
+	n, err := buf.ReadFrom(io.LimitReader(reader, int64(size)))
+	if err != nil {
+		return nil, err
+	}
+	if n < int64(size) {
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	return buf.Bytes(), nil
+}
+
 // unmarshalAndVerifyEntry unmarshals the given data into a WAL entry and
-// verifies the CRC of the entry. Only returns an error if the CRC is invalid.
-func unmarshalAndVerifyEntry(data []byte) (*WAL_Entry, error) {
+// verifies the CRC of the entry, using the checksum rule of the given segment
+// format version. Returns an error wrapping errMalformedRecord if the data is
+// not a valid entry, and errCRCMismatch if the CRC is invalid.
+func unmarshalAndVerifyEntry(data []byte, formatVersion uint16) (*WAL_Entry, error) {
 	var entry WAL_Entry
-	MustUnmarshal(data, &entry)
+	if err := proto.Unmarshal(data, &entry); err != nil {
+		return nil, fmt.Errorf("%w: %v", errMalformedRecord, err)
+	}
 
-	if !verifyCRC(&entry) {
-		return nil, fmt.Errorf("CRC mismatch: data may be corrupted")
+	if !verifyCRC(&entry, formatVersion) {
+		return nil, errCRCMismatch
 	}
 
 	return &entry, nil
 }
 
 // Validates whether the given entry has a valid CRC.
-func verifyCRC(entry *WAL_Entry) bool {
-	// Reset the entry CRC for the verification.
-	actualCRC := crc32.ChecksumIEEE(append(entry.GetData(), byte(entry.GetLogSequenceNumber())))
+func verifyCRC(entry *WAL_Entry, formatVersion uint16) bool {
+	actualCRC := computeCRC(entry, formatVersion)
 
 	return entry.CRC == actualCRC
 }
 
-// Finds the last segment ID from the given list of files.
-func findLastSegmentIndexinFiles(files []string) (int, error) {
-	var lastSegmentID int
-	for _, file := range files {
-		_, fileName := filepath.Split(file)
-		segmentID, err := strconv.Atoi(strings.TrimPrefix(fileName, "segment-"))
-		if err != nil {
-			return 0, err
+// computeCRC computes the CRC of an entry using the checksum rule of the given
+// segment format version:
+//
+//   - Up to formatVersionHeader, CRC32 (IEEE) over the data and the low byte of
+//     the sequence number.
+//   - From formatVersionCRC32C, CRC32C (Castagnoli, hardware accelerated on
+//     most platforms) over the full sequence number, the data length, the
+//     flags (checkpoint and batch size) and the data.
+//
+// It never modifies the data of the entry.
+func computeCRC(entry *WAL_Entry, formatVersion uint16) uint32 {
+	if formatVersion < formatVersionCRC32C {
+		crc := crc32.ChecksumIEEE(entry.GetData())
+		return crc32.Update(crc, crc32.IEEETable, []byte{byte(entry.GetLogSequenceNumber())})
+	}
+
+	var checkpointFlag byte
+	if entry.GetIsCheckpoint() {
+		checkpointFlag = 1
+	}
+
+	fields := make([]byte, 0, 17)
+	fields = binary.LittleEndian.AppendUint64(fields, entry.GetLogSequenceNumber())
+	fields = binary.LittleEndian.AppendUint32(fields, uint32(len(entry.GetData())))
+	fields = append(fields, checkpointFlag)
+	fields = binary.LittleEndian.AppendUint32(fields, entry.GetBatchSize())
+
+	crc := crc32.Checksum(fields, castagnoliTable)
+	return crc32.Update(crc, castagnoliTable, entry.GetData())
+}
+
+// encodeEntry writes the given entry to the writer, prefixed with its size. It
+// returns the number of bytes written.
+func encodeEntry(writer io.Writer, entry *WAL_Entry) (int, error) {
+	marshaledEntry := MustMarshal(entry)
+
+	size := int32(len(marshaledEntry))
+	if err := binary.Write(writer, binary.LittleEndian, size); err != nil {
+		return 0, err
+	}
+	n, err := writer.Write(marshaledEntry)
+
+	return binary.Size(size) + n, err
+}
+
+// batchAssembler groups the entries read from a log segment into the units they
+// were written in: either a single entry, or all the entries of a batch written
+// with WriteBatch. A batch is only released once all of its entries have been
+// seen, so that a batch torn by a crash is dropped as a whole.
+type batchAssembler struct {
+	pending []*WAL_Entry
+}
+
+// add adds the next entry read from the log and returns the entries that became
+// visible as a result, in order.
+func (b *batchAssembler) add(entry *WAL_Entry) []*WAL_Entry {
+	if b.incomplete() && !b.continuesBatch(entry) {
+		// The pending batch never completed, drop it.
+		b.pending = nil
+	}
+
+	if entry.BatchSize == nil {
+		return []*WAL_Entry{entry}
+	}
+
+	b.pending = append(b.pending, entry)
+	if len(b.pending) < int(entry.GetBatchSize()) {
+		return nil
+	}
+
+	complete := b.pending
+	b.pending = nil
+	return complete
+}
+
+// incomplete returns true if a batch has been started but not completed.
+func (b *batchAssembler) incomplete() bool {
+	return len(b.pending) > 0
+}
+
+// continuesBatch returns true if the entry is the next entry of the pending
+// batch.
+func (b *batchAssembler) continuesBatch(entry *WAL_Entry) bool {
+	first := b.pending[0]
+	return entry.BatchSize != nil &&
+		entry.GetBatchSize() == first.GetBatchSize() &&
+		entry.GetLogSequenceNumber() == first.GetLogSequenceNumber()+uint64(len(b.pending))
+}
+
+// broadcast wakes up all the goroutines waiting for an event at once.
+type broadcast struct {
+	lock sync.Mutex
+	ch   chan struct{}
+}
+
+// wait returns a channel that is closed the next time notify is called.
+func (b *broadcast) wait() <-chan struct{} {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.ch == nil {
+		b.ch = make(chan struct{})
+	}
+	return b.ch
+}
+
+// notify wakes up the goroutines waiting for the event.
+func (b *broadcast) notify() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.ch != nil {
+		close(b.ch)
+		b.ch = nil
+	}
+}
+
+// walDir locates the files of a WAL in its directory, and holds the settings
+// used to create them.
+type walDir struct {
+	fs            FS
+	path          string
+	segmentPrefix string
+	filePerm      os.FileMode
+	fsync         bool
+	readOnly      bool // Files are never written if set.
+	logger        *log.Logger
+}
+
+// newWalDir returns the walDir of the WAL in the given directory, opened with
+// the given options.
+func newWalDir(directory string, options *Options) *walDir {
+	return &walDir{
+		fs:            options.FS,
+		path:          directory,
+		segmentPrefix: options.SegmentPrefix,
+		filePerm:      options.FilePerm,
+		fsync:         options.EnableFsync,
+		readOnly:      options.ReadOnly,
+		logger:        options.Logger,
+	}
+}
+
+// syncFile fsyncs the given file if fsync is enabled. Files written to a
+// temporary path are synced before being renamed into place, otherwise a crash
+// could leave the renamed file without its contents.
+func (dir *walDir) syncFile(file File) error {
+	if !dir.fsync {
+		return nil
+	}
+	return file.Sync()
+}
+
+// syncDir fsyncs the directory of the WAL if fsync is enabled, making the files
+// created, renamed and removed in it durable.
+func (dir *walDir) syncDir() error {
+	if !dir.fsync {
+		return nil
+	}
+	return dir.fs.SyncDir(dir.path)
+}
+
+// createDirectory creates the directory of the WAL, along with any missing
+// parents. When fsync is enabled, the parent of a newly created directory is
+// synced so that the directory survives a crash.
+func createDirectory(dir *walDir, perm os.FileMode) error {
+	_, statErr := dir.fs.Stat(dir.path)
+	if err := dir.fs.MkdirAll(dir.path, perm); err != nil {
+		return err
+	}
+
+	if errors.Is(statErr, os.ErrNotExist) && dir.fsync {
+		return dir.fs.SyncDir(filepath.Dir(dir.path))
+	}
+
+	return nil
+}
+
+// Returns the IDs of the log segment files in the given directory, in
+// increasing order. Files that merely share the segment prefix (e.g. temporary
+// files created during a repair) are ignored.
+func listSegmentIDs(dir *walDir) ([]int, error) {
+	names, err := dir.fs.ReadDir(dir.path)
+	if err != nil {
+		return nil, err
+	}
+
+	var segmentIDs []int
+	for _, name := range names {
+		suffix, ok := strings.CutPrefix(name, dir.segmentPrefix)
+		if !ok {
+			continue
 		}
-		if segmentID > lastSegmentID {
-			lastSegmentID = segmentID
+		segmentID, err := strconv.Atoi(suffix)
+		if err != nil || strconv.Itoa(segmentID) != suffix {
+			continue
 		}
+		segmentIDs = append(segmentIDs, segmentID)
 	}
-	return lastSegmentID, nil
+	sort.Ints(segmentIDs)
+
+	return segmentIDs, nil
+}
+
+// tornTail returns true if the given error, returned while reading a segment,
+// only means that the last record of the segment is incomplete because the
+// writer is still appending it. This can only be known for read-only WALs: a
+// WAL opened for writing has no concurrent writer, so such records were torn
+// by a crash.
+func (dir *walDir) tornTail(err error) bool {
+	return dir.readOnly && errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// lockPath returns the path of the lock file held by the writer of the WAL.
+func lockPath(dir *walDir) string {
+	return filepath.Join(dir.path, lockFileName)
+}
+
+// Returns the path of the log segment file with the given segment ID in the
+// given directory.
+func segmentPath(dir *walDir, segmentID int) string {
+	return filepath.Join(dir.path, fmt.Sprintf("%s%d", dir.segmentPrefix, segmentID))
 }
 
-// Creates a log segment file with the given segment ID in the given directory.
-func createSegmentFile(directory string, segmentID int) (*os.File, error) {
-	filePath := filepath.Join(directory, fmt.Sprintf("segment-%d", segmentID))
-	file, err := os.Create(filePath)
+// Creates a log segment file with the given segment ID in the given directory,
+// and writes its header. The header is written to a temporary file which is
+// then renamed, so that a crash never leaves a segment with a torn header
+// behind. The header and the directory are fsynced even if fsync is disabled,
+// since the sequence numbers continue from the header once the previous
+// segments are deleted: the new segment is durable once this returns. If
+// preallocationSize is positive, the file is extended to that size and its
+// header is marked as preallocated. The returned file is positioned right after
+// the header.
+func createSegmentFile(dir *walDir, segmentID int, header *segmentHeader, preallocationSize int64) (File, error) {
+	filePath := segmentPath(dir, segmentID)
+	tempFilePath := fmt.Sprintf("%s.tmp", filePath)
+	file, err := dir.fs.OpenFile(tempFilePath, os.O_CREATE|os.O_TRUNC|os.O_RDWR, dir.filePerm)
 	if err != nil {
 		return nil, err
 	}
+
+	if preallocationSize > 0 {
+		header.flags |= segmentFlagPreallocated
+	}
+	if err := writeSegmentHeader(file, header); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	if preallocationSize > 0 {
+		if err := preallocate(file, preallocationSize); err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	if err := dir.fs.Rename(tempFilePath, filePath); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	if err := dir.fs.SyncDir(dir.path); err != nil {
+		file.Close()
+		return nil, err
+	}
+
 	return file, nil
 }
+
+// Replaces the log segment file with the given segment ID by a segment holding
+// the given header and entries. The new segment is written to a temporary file
+// which is then renamed, so that the operation looks atomic.
+func replaceSegmentFile(dir *walDir, segmentID int, header *segmentHeader, entries []*WAL_Entry) error {
+	filePath := segmentPath(dir, segmentID)
+	tempFilePath := fmt.Sprintf("%s.tmp", filePath)
+	tempFile, err := dir.fs.OpenFile(tempFilePath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, dir.filePerm)
+	if err != nil {
+		return err
+	}
+
+	// Write the header and entries to the temporary file
+	writer := bufio.NewWriter(tempFile)
+	if err := writeSegmentHeader(writer, header); err != nil {
+		tempFile.Close()
+		return err
+	}
+	for _, entry := range entries {
+		if _, err := encodeEntry(writer, entry); err != nil {
+			tempFile.Close()
+			return err
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		tempFile.Close()
+		return err
+	}
+	if err := dir.syncFile(tempFile); err != nil {
+		tempFile.Close()
+		return err
+	}
+
+	// Close the temporary file
+	if err := tempFile.Close(); err != nil {
+		return err
+	}
+
+	// Rename the temporary file to the original file name
+	if err := dir.fs.Rename(tempFilePath, filePath); err != nil {
+		return err
+	}
+
+	return dir.syncDir()
+}